@@ -0,0 +1,288 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/util/stats"
+	v1 "github.com/prometheus/prometheus/web/api/v1"
+)
+
+var _ RemoteInstantEngine = &queryableEngine{}
+
+type queryableEngine struct {
+	engine    v1.QueryEngine
+	queryable storage.Queryable
+	metadata  EngineMetadata
+}
+
+// NewQueryableEngine creates a RemoteEngine which executes queries with the given engine
+// against the queryable. The metadata describes the data available in the queryable.
+func NewQueryableEngine(engine v1.QueryEngine, q storage.Queryable, metadata EngineMetadata) RemoteEngine {
+	return &queryableEngine{
+		engine:    engine,
+		queryable: q,
+		metadata:  metadata,
+	}
+}
+
+func (e *queryableEngine) MinT() int64 { return e.metadata.MinT }
+
+func (e *queryableEngine) MaxT() int64 { return e.metadata.MaxT }
+
+func (e *queryableEngine) LabelSets() []labels.Labels { return e.metadata.LabelSets }
+
+func (e *queryableEngine) NewRangeQuery(ctx context.Context, opts promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	return e.engine.NewRangeQuery(ctx, e.queryable, opts, qs, start, end, interval)
+}
+
+func (e *queryableEngine) NewInstantQuery(ctx context.Context, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	return e.engine.NewInstantQuery(ctx, e.queryable, opts, qs, ts)
+}
+
+type handler struct {
+	engine RemoteEngine
+	mux    *http.ServeMux
+}
+
+// NewHandler creates a handler which exposes the engine as a remote engine. It serves instant and
+// range queries in the format of the Prometheus HTTP query API and the metadata of the engine on
+// MetadataPath, so the engine can be used by distributed engines through an HTTPEngine.
+// Instant queries are executed as range queries with a single step when the engine does not
+// implement RemoteInstantEngine. Statistics of queries are returned when the stats parameter
+// is set, and include the samples of each step for "all", same as in the Prometheus HTTP API.
+func NewHandler(engine RemoteEngine) http.Handler {
+	h := &handler{engine: engine, mux: http.NewServeMux()}
+	h.mux.HandleFunc(QueryPath, h.query)
+	h.mux.HandleFunc(QueryRangePath, h.queryRange)
+	h.mux.HandleFunc(MetadataPath, h.metadata)
+	return h
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *handler) metadata(w http.ResponseWriter, _ *http.Request) {
+	writeResponse(w, http.StatusOK, &v1.Response{
+		Status: "success",
+		Data: EngineMetadata{
+			MinT:      h.engine.MinT(),
+			MaxT:      h.engine.MaxT(),
+			LabelSets: h.engine.LabelSets(),
+		},
+	})
+}
+
+func (h *handler) query(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, errorBadData, errors.Wrap(err, "parsing form"))
+		return
+	}
+	ts := time.Now()
+	if s := r.Form.Get("time"); s != "" {
+		var err error
+		if ts, err = parseTime(s); err != nil {
+			writeError(w, errorBadData, errors.Wrap(err, "invalid parameter \"time\""))
+			return
+		}
+	}
+	opts, err := parseQueryOpts(r)
+	if err != nil {
+		writeError(w, errorBadData, err)
+		return
+	}
+
+	qs := r.Form.Get("query")
+	var qry promql.Query
+	if instantEngine, ok := h.engine.(RemoteInstantEngine); ok {
+		qry, err = instantEngine.NewInstantQuery(r.Context(), opts, qs, ts)
+	} else {
+		qry, err = h.engine.NewRangeQuery(r.Context(), opts, qs, ts, ts, 0)
+	}
+	if err != nil {
+		writeError(w, errorBadData, err)
+		return
+	}
+	h.exec(w, r, qry, ts, true)
+}
+
+func (h *handler) queryRange(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, errorBadData, errors.Wrap(err, "parsing form"))
+		return
+	}
+	start, err := parseTime(r.Form.Get("start"))
+	if err != nil {
+		writeError(w, errorBadData, errors.Wrap(err, "invalid parameter \"start\""))
+		return
+	}
+	end, err := parseTime(r.Form.Get("end"))
+	if err != nil {
+		writeError(w, errorBadData, errors.Wrap(err, "invalid parameter \"end\""))
+		return
+	}
+	if end.Before(start) {
+		writeError(w, errorBadData, errors.New("end timestamp must not be before start time"))
+		return
+	}
+	step, err := parseDuration(r.Form.Get("step"))
+	if err != nil {
+		writeError(w, errorBadData, errors.Wrap(err, "invalid parameter \"step\""))
+		return
+	}
+	if step <= 0 {
+		writeError(w, errorBadData, errors.New("zero or negative query resolution step widths are not accepted"))
+		return
+	}
+	opts, err := parseQueryOpts(r)
+	if err != nil {
+		writeError(w, errorBadData, err)
+		return
+	}
+
+	qry, err := h.engine.NewRangeQuery(r.Context(), opts, r.Form.Get("query"), start, end, step)
+	if err != nil {
+		writeError(w, errorBadData, err)
+		return
+	}
+	h.exec(w, r, qry, end, false)
+}
+
+func (h *handler) exec(w http.ResponseWriter, r *http.Request, qry promql.Query, ts time.Time, instant bool) {
+	defer qry.Close()
+
+	res := qry.Exec(r.Context())
+	if res.Err != nil {
+		writeError(w, errorTypeFor(res.Err), res.Err)
+		return
+	}
+	value := res.Value
+	if m, ok := value.(promql.Matrix); ok && instant {
+		value = matrixToVector(m, ts)
+	}
+	var qs stats.QueryStats
+	if r.Form.Get("stats") != "" {
+		qs = stats.NewQueryStats(qry.Stats())
+	}
+	writeResponse(w, http.StatusOK, &v1.Response{
+		Status:   "success",
+		Data:     &v1.QueryData{ResultType: value.Type(), Result: value, Stats: qs},
+		Warnings: res.Warnings.AsStrings(qry.String(), 0),
+	})
+}
+
+// matrixToVector converts the result of a range query with a single step into a vector.
+func matrixToVector(m promql.Matrix, ts time.Time) promql.Vector {
+	vector := make(promql.Vector, 0, len(m))
+	for _, s := range m {
+		switch {
+		case len(s.Floats) > 0:
+			vector = append(vector, promql.Sample{Metric: s.Metric, T: ts.UnixMilli(), F: s.Floats[0].F})
+		case len(s.Histograms) > 0:
+			vector = append(vector, promql.Sample{Metric: s.Metric, T: ts.UnixMilli(), H: s.Histograms[0].H})
+		}
+	}
+	return vector
+}
+
+type errorType struct {
+	name string
+	code int
+}
+
+var (
+	errorBadData   = errorType{name: "bad_data", code: http.StatusBadRequest}
+	errorExecution = errorType{name: "execution", code: http.StatusUnprocessableEntity}
+	errorCanceled  = errorType{name: "canceled", code: http.StatusServiceUnavailable}
+	errorTimeout   = errorType{name: "timeout", code: http.StatusServiceUnavailable}
+	errorInternal  = errorType{name: "internal", code: http.StatusInternalServerError}
+)
+
+// errorTypeFor classifies query errors the same way as the Prometheus HTTP API.
+func errorTypeFor(err error) errorType {
+	var (
+		canceled promql.ErrQueryCanceled
+		timeout  promql.ErrQueryTimeout
+		storage  promql.ErrStorage
+	)
+	switch {
+	case errors.As(err, &canceled), errors.Is(err, context.Canceled):
+		return errorCanceled
+	case errors.As(err, &timeout), errors.Is(err, context.DeadlineExceeded):
+		return errorTimeout
+	case errors.As(err, &storage):
+		return errorInternal
+	}
+	return errorExecution
+}
+
+func writeError(w http.ResponseWriter, typ errorType, err error) {
+	b, _ := json.Marshal(apiResponse{Status: "error", ErrorType: typ.name, Error: err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(typ.code)
+	_, _ = w.Write(b)
+}
+
+// writeResponse encodes the response with the codec of the Prometheus HTTP API.
+func writeResponse(w http.ResponseWriter, code int, resp *v1.Response) {
+	b, err := v1.JSONCodec{}.Encode(resp)
+	if err != nil {
+		writeError(w, errorInternal, errors.Wrap(err, "encoding response"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+func parseQueryOpts(r *http.Request) (promql.QueryOpts, error) {
+	var lookbackDelta time.Duration
+	if s := r.Form.Get("lookback_delta"); s != "" {
+		var err error
+		if lookbackDelta, err = parseDuration(s); err != nil {
+			return nil, errors.Wrap(err, "invalid parameter \"lookback_delta\"")
+		}
+	}
+	return promql.NewPrometheusQueryOpts(r.Form.Get("stats") == "all", lookbackDelta), nil
+}
+
+// parseTime parses timestamps in seconds or in RFC3339 format, same as the Prometheus HTTP API.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		s, ns := math.Modf(t)
+		ns = math.Round(ns*1000) / 1000
+		return time.Unix(int64(s), int64(ns*float64(time.Second))).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.Newf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDuration parses durations in seconds or in the Prometheus duration format.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		ts := d * float64(time.Second)
+		if ts > float64(math.MaxInt64) || ts < float64(math.MinInt64) {
+			return 0, errors.Newf("cannot parse %q to a valid duration. It overflows int64", s)
+		}
+		return time.Duration(ts), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, errors.Newf("cannot parse %q to a valid duration", s)
+}
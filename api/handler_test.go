@@ -0,0 +1,212 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package api_test
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+
+	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/engine"
+)
+
+func TestHandlerDistributedQuery(t *testing.T) {
+	east := `load 30s
+		http_requests_total{pod="a", region="east"} 1+1x40
+		http_requests_total{pod="b", region="east"} 1+2x40`
+	west := `load 30s
+		http_requests_total{pod="a", region="west"} 1+3x40
+		http_requests_total{pod="c", region="west"} 1+4x40`
+	all := east + `
+		http_requests_total{pod="a", region="west"} 1+3x40
+		http_requests_total{pod="c", region="west"} 1+4x40`
+
+	opts := engine.Opts{EngineOpts: promql.EngineOpts{MaxSamples: math.MaxInt64, Timeout: time.Minute}}
+	ctx := context.Background()
+
+	var remotes []api.RemoteEngine
+	for _, leaf := range []struct {
+		load   string
+		region string
+	}{{load: east, region: "east"}, {load: west, region: "west"}} {
+		storage := promql.LoadedStorage(t, leaf.load)
+		defer storage.Close()
+
+		labelSets := []labels.Labels{labels.FromStrings("region", leaf.region)}
+		server := httptest.NewServer(api.NewHandler(engine.NewRemoteEngine(opts, storage, math.MinInt64, math.MaxInt64, labelSets)))
+		defer server.Close()
+
+		remote, err := api.NewHTTPEngine(api.HTTPEngineOpts{URL: server.URL})
+		testutil.Ok(t, err)
+		testutil.Ok(t, remote.Discover(ctx))
+		testutil.Equals(t, labelSets, remote.LabelSets())
+		testutil.Equals(t, int64(math.MaxInt64), remote.MaxT())
+		remotes = append(remotes, remote)
+	}
+
+	storage := promql.LoadedStorage(t, all)
+	defer storage.Close()
+	prom := promql.NewEngine(opts.EngineOpts)
+	ng := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(remotes))
+
+	for _, query := range []string{
+		`sum by (pod) (rate(http_requests_total[2m]))`,
+		`max(http_requests_total)`,
+		`count by (region) (http_requests_total)`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			expected, err := prom.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			q, err := ng.NewRangeQuery(ctx, nil, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			testutil.Equals(t, encodeResult(t, expected.Exec(ctx)), encodeResult(t, q.Exec(ctx)))
+
+			expected, err = prom.NewInstantQuery(ctx, storage, nil, query, time.Unix(600, 0))
+			testutil.Ok(t, err)
+			q, err = ng.NewInstantQuery(ctx, nil, nil, query, time.Unix(600, 0))
+			testutil.Ok(t, err)
+			testutil.Equals(t, encodeResult(t, expected.Exec(ctx)), encodeResult(t, q.Exec(ctx)))
+		})
+	}
+}
+
+func TestHandlerQueryableEngine(t *testing.T) {
+	storage := promql.LoadedStorage(t, testLoad)
+	defer storage.Close()
+
+	prom := promql.NewEngine(promql.EngineOpts{MaxSamples: math.MaxInt64, Timeout: time.Minute})
+	metadata := api.EngineMetadata{MinT: 0, MaxT: 1200000}
+	remote := api.NewQueryableEngine(prom, storage, metadata)
+
+	ctx := context.Background()
+	for _, tcase := range []struct {
+		name   string
+		remote api.RemoteEngine
+	}{
+		{name: "engine with instant queries", remote: remote},
+		{name: "engine without instant queries", remote: rangeOnlyEngine{remote}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			server := httptest.NewServer(api.NewHandler(tcase.remote))
+			defer server.Close()
+			client, err := api.NewHTTPEngine(api.HTTPEngineOpts{URL: server.URL})
+			testutil.Ok(t, err)
+
+			testutil.Ok(t, client.Discover(ctx))
+			testutil.Equals(t, metadata.MaxT, client.MaxT())
+
+			const query = `sum by (pod) (http_request_duration_seconds)`
+			expected, err := prom.NewInstantQuery(ctx, storage, nil, query, time.Unix(600, 0))
+			testutil.Ok(t, err)
+			q, err := client.NewInstantQuery(ctx, nil, query, time.Unix(600, 0))
+			testutil.Ok(t, err)
+			testutil.Equals(t, encodeResult(t, expected.Exec(ctx)), encodeResult(t, q.Exec(ctx)))
+
+			expected, err = prom.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			q, err = client.NewRangeQuery(ctx, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			testutil.Equals(t, encodeResult(t, expected.Exec(ctx)), encodeResult(t, q.Exec(ctx)))
+		})
+	}
+}
+
+func TestHandlerStats(t *testing.T) {
+	storage := promql.LoadedStorage(t, testLoad)
+	defer storage.Close()
+
+	prom := promql.NewEngine(promql.EngineOpts{MaxSamples: math.MaxInt64, Timeout: time.Minute, EnablePerStepStats: true})
+	server := httptest.NewServer(api.NewHandler(api.NewQueryableEngine(prom, storage, api.EngineMetadata{})))
+	defer server.Close()
+	client, err := api.NewHTTPEngine(api.HTTPEngineOpts{URL: server.URL})
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	const query = `sum(rate(http_requests_total[2m]))`
+	opts := promql.NewPrometheusQueryOpts(true, 0)
+	expected, err := prom.NewRangeQuery(ctx, storage, opts, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	testutil.Ok(t, expected.Exec(ctx).Err)
+	q, err := client.NewRangeQuery(ctx, opts, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	testutil.Ok(t, q.Exec(ctx).Err)
+
+	testutil.Equals(t, expected.Stats().Samples, q.Stats().Samples)
+	timings := q.(api.TimedQuery).Timings()
+	testutil.Assert(t, timings.ExecTotalTime > 0, "expected execution time of the remote query")
+	testutil.Assert(t, timings.EvalTotalTime <= timings.ExecTotalTime, "evaluation time should not exceed execution time")
+}
+
+func TestHandlerErrors(t *testing.T) {
+	storage := promql.LoadedStorage(t, testLoad)
+	defer storage.Close()
+
+	prom := promql.NewEngine(promql.EngineOpts{MaxSamples: math.MaxInt64, Timeout: time.Minute})
+	server := httptest.NewServer(api.NewHandler(api.NewQueryableEngine(prom, storage, api.EngineMetadata{})))
+	defer server.Close()
+
+	for _, tcase := range []struct {
+		path   string
+		params url.Values
+		code   int
+		body   string
+	}{
+		{
+			path:   api.QueryPath,
+			params: url.Values{"query": {"sum("}},
+			code:   http.StatusBadRequest,
+			body:   `{"status":"error","errorType":"bad_data","error":"1:5: parse error: unclosed left parenthesis"}`,
+		},
+		{
+			path:   api.QueryPath,
+			params: url.Values{"query": {"up"}, "time": {"yesterday"}},
+			code:   http.StatusBadRequest,
+			body:   `{"status":"error","errorType":"bad_data","error":"invalid parameter \"time\": cannot parse \"yesterday\" to a valid timestamp"}`,
+		},
+		{
+			path:   api.QueryRangePath,
+			params: url.Values{"query": {"up"}, "start": {"0"}, "end": {"60"}, "step": {"0"}},
+			code:   http.StatusBadRequest,
+			body:   `{"status":"error","errorType":"bad_data","error":"zero or negative query resolution step widths are not accepted"}`,
+		},
+		{
+			path:   api.QueryRangePath,
+			params: url.Values{"query": {"up"}, "start": {"60"}, "end": {"0"}, "step": {"15s"}},
+			code:   http.StatusBadRequest,
+			body:   `{"status":"error","errorType":"bad_data","error":"end timestamp must not be before start time"}`,
+		},
+		{
+			path:   api.QueryRangePath,
+			params: url.Values{"query": {"up"}, "start": {"1970-01-01T00:00:00Z"}, "end": {"1970-01-01T00:01:00Z"}, "step": {"15s"}},
+			code:   http.StatusOK,
+			body:   `{"status":"success","data":{"resultType":"matrix","result":[]}}`,
+		},
+	} {
+		t.Run(tcase.params.Encode(), func(t *testing.T) {
+			resp, err := http.PostForm(server.URL+tcase.path, tcase.params)
+			testutil.Ok(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.code, resp.StatusCode)
+			testutil.Equals(t, tcase.body, string(body))
+		})
+	}
+}
+
+// rangeOnlyEngine hides the instant queries of the wrapped engine.
+type rangeOnlyEngine struct {
+	api.RemoteEngine
+}
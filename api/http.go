@@ -0,0 +1,641 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/util/annotations"
+	"github.com/prometheus/prometheus/util/stats"
+)
+
+// Paths of the HTTP API used by remote engines.
+const (
+	QueryPath      = "/api/v1/query"
+	QueryRangePath = "/api/v1/query_range"
+	// MetadataPath serves the EngineMetadata of a remote engine.
+	MetadataPath = "/api/v1/status/engine"
+)
+
+// EngineMetadata describes the data which is available to a remote engine.
+type EngineMetadata struct {
+	MinT      int64           `json:"minT"`
+	MaxT      int64           `json:"maxT"`
+	LabelSets []labels.Labels `json:"labelSets"`
+}
+
+// HTTPEngineOpts configures an HTTPEngine.
+type HTTPEngineOpts struct {
+	// URL is the base URL of the Prometheus HTTP API, for example http://localhost:9090.
+	URL string
+	// Client is used to send requests. http.DefaultClient is used when it is not set.
+	Client *http.Client
+	// MinT, MaxT and LabelSets describe the data which is available to the engine.
+	// Engines which are not limited in time should use math.MinInt64 and math.MaxInt64.
+	// They are replaced by the metadata of the engine when calling Discover.
+	MinT      int64
+	MaxT      int64
+	LabelSets []labels.Labels
+}
+
+// HTTPEngine is a RemoteEngine which executes queries through the Prometheus HTTP query API.
+// Range queries are sent to /api/v1/query_range and instant queries to /api/v1/query.
+// Statistics are requested with every query and returned by the Stats of the query.
+type HTTPEngine struct {
+	url    *url.URL
+	client *http.Client
+
+	mu       sync.RWMutex
+	metadata EngineMetadata
+}
+
+// NewHTTPEngine creates a remote engine which sends queries to the Prometheus HTTP API at opts.URL.
+func NewHTTPEngine(opts HTTPEngineOpts) (*HTTPEngine, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing engine URL")
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPEngine{
+		url:    u,
+		client: client,
+		metadata: EngineMetadata{
+			MinT:      opts.MinT,
+			MaxT:      opts.MaxT,
+			LabelSets: opts.LabelSets,
+		},
+	}, nil
+}
+
+func (e *HTTPEngine) MinT() int64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.metadata.MinT
+}
+
+func (e *HTTPEngine) MaxT() int64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.metadata.MaxT
+}
+
+func (e *HTTPEngine) LabelSets() []labels.Labels {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.metadata.LabelSets
+}
+
+// Discover replaces the time range and label sets of the engine with the ones
+// advertised by the remote engine on its metadata endpoint.
+func (e *HTTPEngine) Discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.url.JoinPath(MetadataPath).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := e.do(req)
+	if err != nil {
+		return errors.Wrap(err, "discovering engine metadata")
+	}
+	var metadata EngineMetadata
+	if err := json.Unmarshal(resp.Data, &metadata); err != nil {
+		return errors.Wrap(err, "decoding engine metadata")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.metadata = metadata
+	return nil
+}
+
+func (e *HTTPEngine) NewRangeQuery(_ context.Context, opts promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	params := url.Values{
+		"query": []string{qs},
+		"start": []string{formatTime(start)},
+		"end":   []string{formatTime(end)},
+		"step":  []string{strconv.FormatFloat(interval.Seconds(), 'f', -1, 64)},
+	}
+	return e.newQuery(QueryRangePath, qs, params, opts), nil
+}
+
+func (e *HTTPEngine) NewInstantQuery(_ context.Context, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	params := url.Values{
+		"query": []string{qs},
+		"time":  []string{formatTime(ts)},
+	}
+	return e.newQuery(QueryPath, qs, params, opts), nil
+}
+
+func (e *HTTPEngine) newQuery(path, qs string, params url.Values, opts promql.QueryOpts) *httpQuery {
+	if opts != nil && opts.LookbackDelta() > 0 {
+		params.Set("lookback_delta", strconv.FormatFloat(opts.LookbackDelta().Seconds(), 'f', -1, 64))
+	}
+	// Statistics are always requested since remote executions report the timings of remote queries.
+	// Samples per step are only returned for "all", same as in the Prometheus HTTP API.
+	if opts != nil && opts.EnablePerStepStats() {
+		params.Set("stats", "all")
+	} else {
+		params.Set("stats", "true")
+	}
+	return &httpQuery{
+		engine: e,
+		path:   path,
+		query:  qs,
+		params: params,
+	}
+}
+
+// do sends the request and decodes the envelope of the response.
+func (e *HTTPEngine) do(req *http.Request) (*apiResponse, error) {
+	httpResp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading response")
+	}
+	var resp apiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		if httpResp.StatusCode/100 != 2 {
+			return nil, errors.Newf("unexpected status code %d: %s", httpResp.StatusCode, strings.TrimSpace(string(body)))
+		}
+		return nil, errors.Wrap(err, "decoding response")
+	}
+	if resp.Status != "success" {
+		return &resp, errors.Newf("%s: %s", resp.ErrorType, resp.Error)
+	}
+	return &resp, nil
+}
+
+type httpQuery struct {
+	engine *HTTPEngine
+	path   string
+	query  string
+	params url.Values
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	stats  *apiStats
+}
+
+func (q *httpQuery) Exec(ctx context.Context) *promql.Result {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	q.mu.Lock()
+	q.cancel = cancel
+	q.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, q.engine.url.JoinPath(q.path).String(), strings.NewReader(q.params.Encode()))
+	if err != nil {
+		return &promql.Result{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := q.engine.do(req)
+	result := &promql.Result{Err: err}
+	if resp == nil {
+		return result
+	}
+	// Warnings and infos are both propagated, info annotations keep their prefix.
+	annos := annotations.New()
+	for _, w := range append(resp.Warnings, resp.Infos...) {
+		annos.Add(errors.New(w))
+	}
+	result.Warnings = *annos
+	if result.Err != nil {
+		return result
+	}
+
+	var data queryData
+	if err := json.Unmarshal(resp.Data, &data); err != nil {
+		result.Err = errors.Wrap(err, "decoding query result")
+		return result
+	}
+	q.mu.Lock()
+	q.stats = data.Stats
+	q.mu.Unlock()
+	result.Value, result.Err = data.value()
+	return result
+}
+
+func (q *httpQuery) Close() {}
+
+func (q *httpQuery) Statement() parser.Statement { return nil }
+
+// Stats returns the samples reported by the remote engine. Timers cannot be restored from the
+// response, so they are empty and the timings of the remote engine are returned by Timings.
+func (q *httpQuery) Stats() *stats.Statistics {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return &stats.Statistics{Timers: stats.NewQueryTimers(), Samples: q.stats.samples()}
+}
+
+func (q *httpQuery) Timings() QueryTimings {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats.timings()
+}
+
+func (q *httpQuery) Cancel() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.cancel != nil {
+		q.cancel()
+	}
+}
+
+func (q *httpQuery) String() string { return q.query }
+
+type apiResponse struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ErrorType string          `json:"errorType,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Warnings  []string        `json:"warnings,omitempty"`
+	Infos     []string        `json:"infos,omitempty"`
+}
+
+type queryData struct {
+	ResultType parser.ValueType `json:"resultType"`
+	Result     json.RawMessage  `json:"result"`
+	Stats      *apiStats        `json:"stats,omitempty"`
+}
+
+// apiStats are the statistics of a query in the format of the Prometheus HTTP API. Timings are in seconds.
+type apiStats struct {
+	Timings struct {
+		EvalTotalTime float64 `json:"evalTotalTime"`
+		ExecQueueTime float64 `json:"execQueueTime"`
+		ExecTotalTime float64 `json:"execTotalTime"`
+	} `json:"timings"`
+	Samples *struct {
+		TotalQueryableSamplesPerStep []apiStepStat `json:"totalQueryableSamplesPerStep"`
+		TotalQueryableSamples        int64         `json:"totalQueryableSamples"`
+		PeakSamples                  int           `json:"peakSamples"`
+	} `json:"samples"`
+}
+
+func (s *apiStats) timings() QueryTimings {
+	if s == nil {
+		return QueryTimings{}
+	}
+	seconds := func(f float64) time.Duration { return time.Duration(f * float64(time.Second)) }
+	return QueryTimings{
+		EvalTotalTime: seconds(s.Timings.EvalTotalTime),
+		ExecQueueTime: seconds(s.Timings.ExecQueueTime),
+		ExecTotalTime: seconds(s.Timings.ExecTotalTime),
+	}
+}
+
+func (s *apiStats) samples() *stats.QuerySamples {
+	if s == nil || s.Samples == nil {
+		return stats.NewQuerySamples(false)
+	}
+	steps := s.Samples.TotalQueryableSamplesPerStep
+	samples := stats.NewQuerySamples(len(steps) > 0)
+	samples.TotalSamples = s.Samples.TotalQueryableSamples
+	samples.PeakSamples = s.Samples.PeakSamples
+	if len(steps) > 0 {
+		interval := int64(1)
+		if len(steps) > 1 {
+			interval = steps[1].T - steps[0].T
+		}
+		samples.InitStepTracking(steps[0].T, steps[len(steps)-1].T, interval)
+		for i := 0; i < len(steps) && i < len(samples.TotalSamplesPerStep); i++ {
+			samples.TotalSamplesPerStep[i] = steps[i].V
+		}
+	}
+	return samples
+}
+
+// apiStepStat is a [timestamp, samples] pair.
+type apiStepStat struct {
+	T int64
+	V int64
+}
+
+func (s *apiStepStat) UnmarshalJSON(b []byte) error {
+	var raw [2]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	t, err := parseTimestamp(raw[0])
+	if err != nil {
+		return err
+	}
+	s.T = t
+	return json.Unmarshal(raw[1], &s.V)
+}
+
+func (d queryData) value() (parser.Value, error) {
+	switch d.ResultType {
+	case parser.ValueTypeMatrix:
+		var result []apiSeries
+		if err := json.Unmarshal(d.Result, &result); err != nil {
+			return nil, errors.Wrap(err, "decoding matrix")
+		}
+		matrix := make(promql.Matrix, 0, len(result))
+		for _, s := range result {
+			series, err := s.series()
+			if err != nil {
+				return nil, err
+			}
+			matrix = append(matrix, series)
+		}
+		return matrix, nil
+	case parser.ValueTypeVector:
+		var result []apiSample
+		if err := json.Unmarshal(d.Result, &result); err != nil {
+			return nil, errors.Wrap(err, "decoding vector")
+		}
+		vector := make(promql.Vector, 0, len(result))
+		for _, s := range result {
+			sample, err := s.sample()
+			if err != nil {
+				return nil, err
+			}
+			vector = append(vector, sample)
+		}
+		return vector, nil
+	case parser.ValueTypeScalar:
+		var p apiPoint
+		if err := json.Unmarshal(d.Result, &p); err != nil {
+			return nil, errors.Wrap(err, "decoding scalar")
+		}
+		v, err := p.float()
+		if err != nil {
+			return nil, err
+		}
+		return promql.Scalar{T: p.T, V: v}, nil
+	case parser.ValueTypeString:
+		var p apiPoint
+		if err := json.Unmarshal(d.Result, &p); err != nil {
+			return nil, errors.Wrap(err, "decoding string")
+		}
+		return promql.String{T: p.T, V: p.V}, nil
+	}
+	return nil, errors.Newf("unexpected result type %q", d.ResultType)
+}
+
+type apiSeries struct {
+	Metric     map[string]string   `json:"metric"`
+	Values     []apiPoint          `json:"values"`
+	Histograms []apiHistogramPoint `json:"histograms"`
+}
+
+func (s apiSeries) series() (promql.Series, error) {
+	series := promql.Series{Metric: labels.FromMap(s.Metric)}
+	if len(s.Values) > 0 {
+		series.Floats = make([]promql.FPoint, 0, len(s.Values))
+	}
+	for _, p := range s.Values {
+		f, err := p.float()
+		if err != nil {
+			return promql.Series{}, err
+		}
+		series.Floats = append(series.Floats, promql.FPoint{T: p.T, F: f})
+	}
+	if len(s.Histograms) > 0 {
+		series.Histograms = make([]promql.HPoint, 0, len(s.Histograms))
+	}
+	for _, p := range s.Histograms {
+		h, err := p.H.floatHistogram()
+		if err != nil {
+			return promql.Series{}, err
+		}
+		series.Histograms = append(series.Histograms, promql.HPoint{T: p.T, H: h})
+	}
+	return series, nil
+}
+
+type apiSample struct {
+	Metric    map[string]string  `json:"metric"`
+	Value     *apiPoint          `json:"value"`
+	Histogram *apiHistogramPoint `json:"histogram"`
+}
+
+func (s apiSample) sample() (promql.Sample, error) {
+	sample := promql.Sample{Metric: labels.FromMap(s.Metric)}
+	switch {
+	case s.Histogram != nil:
+		h, err := s.Histogram.H.floatHistogram()
+		if err != nil {
+			return promql.Sample{}, err
+		}
+		sample.T, sample.H = s.Histogram.T, h
+	case s.Value != nil:
+		f, err := s.Value.float()
+		if err != nil {
+			return promql.Sample{}, err
+		}
+		sample.T, sample.F = s.Value.T, f
+	default:
+		return promql.Sample{}, errors.New("sample has neither a value nor a histogram")
+	}
+	return sample, nil
+}
+
+// apiPoint is a [timestamp, "value"] pair.
+type apiPoint struct {
+	T int64
+	V string
+}
+
+func (p *apiPoint) UnmarshalJSON(b []byte) error {
+	var raw [2]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	t, err := parseTimestamp(raw[0])
+	if err != nil {
+		return err
+	}
+	p.T = t
+	return json.Unmarshal(raw[1], &p.V)
+}
+
+func (p apiPoint) float() (float64, error) {
+	return strconv.ParseFloat(p.V, 64)
+}
+
+// apiHistogramPoint is a [timestamp, histogram] pair.
+type apiHistogramPoint struct {
+	T int64
+	H apiHistogram
+}
+
+func (p *apiHistogramPoint) UnmarshalJSON(b []byte) error {
+	var raw [2]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	t, err := parseTimestamp(raw[0])
+	if err != nil {
+		return err
+	}
+	p.T = t
+	return json.Unmarshal(raw[1], &p.H)
+}
+
+type apiHistogram struct {
+	Count   string      `json:"count"`
+	Sum     string      `json:"sum"`
+	Buckets []apiBucket `json:"buckets"`
+}
+
+// apiBucket is a [boundaries, "lower", "upper", "count"] tuple.
+type apiBucket struct {
+	Lower, Upper, Count float64
+}
+
+func (b *apiBucket) UnmarshalJSON(data []byte) error {
+	var raw [4]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	values := []*float64{&b.Lower, &b.Upper, &b.Count}
+	for i, v := range values {
+		var s string
+		if err := json.Unmarshal(raw[i+1], &s); err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*v = f
+	}
+	return nil
+}
+
+// floatHistogram reconstructs a native histogram from its buckets. The API only exposes bucket
+// boundaries, so the schema is derived from the ratio between them. Buckets overlapping with the
+// zero bucket have their boundary clamped to the zero threshold, so they are not used to infer it.
+func (h apiHistogram) floatHistogram() (*histogram.FloatHistogram, error) {
+	count, err := strconv.ParseFloat(h.Count, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing histogram count")
+	}
+	sum, err := strconv.ParseFloat(h.Sum, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing histogram sum")
+	}
+	fh := &histogram.FloatHistogram{Count: count, Sum: sum}
+	for _, b := range h.Buckets {
+		if b.Lower == -b.Upper {
+			fh.ZeroThreshold, fh.ZeroCount = b.Upper, b.Count
+		}
+	}
+
+	var nonZero int
+	inferred := false
+	for _, b := range h.Buckets {
+		if b.Lower == -b.Upper {
+			continue
+		}
+		nonZero++
+		if inferred || b.Lower == fh.ZeroThreshold || b.Upper == -fh.ZeroThreshold {
+			continue
+		}
+		ratio := b.Upper / b.Lower
+		if b.Upper < 0 {
+			ratio = 1 / ratio
+		}
+		// The zero bucket is only exposed when it is populated, so buckets clamped to the
+		// threshold of an empty one are recognized by a ratio which matches no schema.
+		fh.Schema, inferred = schemaForRatio(ratio)
+	}
+	if nonZero > 0 && !inferred {
+		return nil, errors.New("cannot infer histogram schema: all buckets overlap with the zero bucket")
+	}
+
+	var positive, negative []indexedBucket
+	for _, b := range h.Buckets {
+		switch {
+		case b.Lower == -b.Upper:
+			// The zero bucket was decoded above.
+		case b.Upper > 0:
+			positive = append(positive, indexedBucket{index: bucketIndex(b.Upper, fh.Schema), count: b.Count})
+		default:
+			negative = append(negative, indexedBucket{index: bucketIndex(-b.Lower, fh.Schema), count: b.Count})
+		}
+	}
+	fh.PositiveSpans, fh.PositiveBuckets = bucketSpans(positive)
+	fh.NegativeSpans, fh.NegativeBuckets = bucketSpans(negative)
+	return fh, nil
+}
+
+// schemaForRatio returns the schema whose buckets have the given ratio between their boundaries.
+func schemaForRatio(ratio float64) (int32, bool) {
+	if ratio <= 1 {
+		return 0, false
+	}
+	schema := -math.Log2(math.Log2(ratio))
+	rounded := math.Round(schema)
+	if math.Abs(schema-rounded) > 1e-6 || rounded < -4 || rounded > 8 {
+		return 0, false
+	}
+	return int32(rounded), true
+}
+
+type indexedBucket struct {
+	index int32
+	count float64
+}
+
+// bucketIndex returns the index of the exponential bucket with the given upper bound.
+func bucketIndex(upper float64, schema int32) int32 {
+	return int32(math.Round(math.Log2(upper) * math.Exp2(float64(schema))))
+}
+
+func bucketSpans(buckets []indexedBucket) ([]histogram.Span, []float64) {
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].index < buckets[j].index })
+
+	spans := []histogram.Span{{Offset: buckets[0].index, Length: 1}}
+	counts := []float64{buckets[0].count}
+	for i := 1; i < len(buckets); i++ {
+		if gap := buckets[i].index - buckets[i-1].index - 1; gap > 0 {
+			spans = append(spans, histogram.Span{Offset: gap, Length: 1})
+		} else {
+			spans[len(spans)-1].Length++
+		}
+		counts = append(counts, buckets[i].count)
+	}
+	return spans, counts
+}
+
+func parseTimestamp(raw json.RawMessage) (int64, error) {
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err != nil {
+		return 0, errors.Wrap(err, "parsing timestamp")
+	}
+	return int64(math.Round(seconds * 1000)), nil
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
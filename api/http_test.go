@@ -0,0 +1,282 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+	v1 "github.com/prometheus/prometheus/web/api/v1"
+
+	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/engine"
+)
+
+const testLoad = `load 30s
+	http_requests_total{pod="a"} 1+1x40
+	http_requests_total{pod="b"} 1+2x40
+	http_request_duration_seconds{pod="a"} {{schema:1 sum:5 count:4 z_bucket:1 z_bucket_w:0.001 buckets:[1 0 2] n_buckets:[1]}}+{{schema:1 sum:2 count:2 buckets:[1 1]}}x40
+	http_request_duration_seconds{pod="b"} {{schema:-1 sum:3 count:3 buckets:[1 0 0 2]}}x40`
+
+func TestHTTPEngineQueries(t *testing.T) {
+	storage := promql.LoadedStorage(t, testLoad)
+	defer storage.Close()
+
+	prom := promql.NewEngine(promql.EngineOpts{MaxSamples: math.MaxInt64, Timeout: time.Minute})
+	server := httptest.NewServer(newPrometheusHandler(t, prom, storage))
+	defer server.Close()
+
+	remote, err := api.NewHTTPEngine(api.HTTPEngineOpts{URL: server.URL})
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	for _, query := range []string{
+		`http_requests_total`,
+		`rate(http_requests_total[2m])`,
+		`http_request_duration_seconds`,
+		`sum(rate(http_request_duration_seconds[2m]))`,
+		`scalar(sum(http_requests_total))`,
+		`"string"`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			ts := time.Unix(600, 0)
+			expected, err := prom.NewInstantQuery(ctx, storage, nil, query, ts)
+			testutil.Ok(t, err)
+			q, err := remote.NewInstantQuery(ctx, nil, query, ts)
+			testutil.Ok(t, err)
+			testutil.Equals(t, encodeResult(t, expected.Exec(ctx)), encodeResult(t, q.Exec(ctx)))
+
+			if query == `"string"` || query == `scalar(sum(http_requests_total))` {
+				return
+			}
+			expected, err = prom.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), ts, 30*time.Second)
+			testutil.Ok(t, err)
+			q, err = remote.NewRangeQuery(ctx, promql.NewPrometheusQueryOpts(false, 2*time.Minute), query, time.Unix(0, 0), ts, 30*time.Second)
+			testutil.Ok(t, err)
+			testutil.Equals(t, encodeResult(t, expected.Exec(ctx)), encodeResult(t, q.Exec(ctx)))
+		})
+	}
+}
+
+func TestHTTPEngineHistogramsAdjacentToZeroBucket(t *testing.T) {
+	// With schema 3, the positive bucket at index -79 spans (2^-10, 2^-9.875] and overlaps with
+	// a zero bucket of width 0.001, so its lower boundary is clamped to the threshold.
+	storage := promql.LoadedStorage(t, `load 30s
+	clamped_only{pod="a"} {{schema:3 sum:1 count:3 z_bucket:1 z_bucket_w:0.001 offset:-79 buckets:[2]}}x10
+	clamped_only_empty_zero{pod="a"} {{schema:3 sum:1 count:2 z_bucket:0 z_bucket_w:0.001 offset:-79 buckets:[2]}}x10
+	clamped_and_unclamped{pod="a"} {{schema:3 sum:1 count:4 z_bucket:1 z_bucket_w:0.001 offset:-79 buckets:[2 1]}}x10`)
+	defer storage.Close()
+
+	prom := promql.NewEngine(promql.EngineOpts{MaxSamples: math.MaxInt64, Timeout: time.Minute})
+	server := httptest.NewServer(newPrometheusHandler(t, prom, storage))
+	defer server.Close()
+
+	remote, err := api.NewHTTPEngine(api.HTTPEngineOpts{URL: server.URL})
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	ts := time.Unix(60, 0)
+	for _, query := range []string{`clamped_only`, `clamped_only_empty_zero`} {
+		t.Run(query, func(t *testing.T) {
+			q, err := remote.NewInstantQuery(ctx, nil, query, ts)
+			testutil.Ok(t, err)
+			res := q.Exec(ctx)
+			testutil.NotOk(t, res.Err)
+			testutil.Equals(t, "cannot infer histogram schema: all buckets overlap with the zero bucket", res.Err.Error())
+		})
+	}
+
+	t.Run("clamped_and_unclamped", func(t *testing.T) {
+		expected, err := prom.NewInstantQuery(ctx, storage, nil, `clamped_and_unclamped`, ts)
+		testutil.Ok(t, err)
+		q, err := remote.NewInstantQuery(ctx, nil, `clamped_and_unclamped`, ts)
+		testutil.Ok(t, err)
+
+		expectedVector, err := expected.Exec(ctx).Vector()
+		testutil.Ok(t, err)
+		vector, err := q.Exec(ctx).Vector()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(vector))
+		// Counter reset hints are not exposed by the API.
+		expectedVector[0].H.CounterResetHint = histogram.UnknownCounterReset
+		testutil.Equals(t, expectedVector[0].H, vector[0].H)
+	})
+}
+
+func TestHTTPEngineWarningsAndErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Ok(t, r.ParseForm())
+		switch r.Form.Get("query") {
+		case "warning":
+			writeResponse(t, w, http.StatusOK, &v1.Response{
+				Status:   "success",
+				Data:     &v1.QueryData{ResultType: "matrix", Result: promql.Matrix{}},
+				Warnings: []string{"PromQL warning: remote warning"},
+			})
+		case "error":
+			writeResponse(t, w, http.StatusBadRequest, &v1.Response{
+				Status:    "error",
+				ErrorType: "bad_data",
+				Error:     "invalid query",
+			})
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = w.Write([]byte("bad gateway"))
+		}
+	}))
+	defer server.Close()
+
+	remote, err := api.NewHTTPEngine(api.HTTPEngineOpts{URL: server.URL})
+	testutil.Ok(t, err)
+
+	ctx := context.Background()
+	exec := func(query string) *promql.Result {
+		q, err := remote.NewRangeQuery(ctx, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		return q.Exec(ctx)
+	}
+
+	res := exec("warning")
+	testutil.Ok(t, res.Err)
+	testutil.Equals(t, promql.Matrix{}, res.Value)
+	testutil.Equals(t, 1, len(res.Warnings))
+	testutil.Equals(t, "PromQL warning: remote warning", res.Warnings.AsErrors()[0].Error())
+
+	res = exec("error")
+	testutil.NotOk(t, res.Err)
+	testutil.Equals(t, "bad_data: invalid query", res.Err.Error())
+
+	res = exec("unavailable")
+	testutil.NotOk(t, res.Err)
+	testutil.Equals(t, "unexpected status code 502: bad gateway", res.Err.Error())
+}
+
+func TestHTTPEngineDiscover(t *testing.T) {
+	metadata := api.EngineMetadata{
+		MinT:      1000,
+		MaxT:      2000,
+		LabelSets: []labels.Labels{labels.FromStrings("region", "east"), labels.FromStrings("region", "west")},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Equals(t, api.MetadataPath, r.URL.Path)
+		writeResponse(t, w, http.StatusOK, &v1.Response{Status: "success", Data: metadata})
+	}))
+	defer server.Close()
+
+	remote, err := api.NewHTTPEngine(api.HTTPEngineOpts{
+		URL:       server.URL,
+		MinT:      math.MinInt64,
+		MaxT:      math.MaxInt64,
+		LabelSets: []labels.Labels{labels.FromStrings("region", "north")},
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(math.MinInt64), remote.MinT())
+
+	testutil.Ok(t, remote.Discover(context.Background()))
+	testutil.Equals(t, metadata.MinT, remote.MinT())
+	testutil.Equals(t, metadata.MaxT, remote.MaxT())
+	testutil.Equals(t, metadata.LabelSets, remote.LabelSets())
+}
+
+func TestHTTPEngineDistributedQuery(t *testing.T) {
+	storage := promql.LoadedStorage(t, testLoad)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{MaxSamples: math.MaxInt64, Timeout: time.Minute}
+	prom := promql.NewEngine(opts)
+	server := httptest.NewServer(newPrometheusHandler(t, prom, storage))
+	defer server.Close()
+
+	remote, err := api.NewHTTPEngine(api.HTTPEngineOpts{URL: server.URL, MinT: math.MinInt64, MaxT: math.MaxInt64})
+	testutil.Ok(t, err)
+	ng := engine.NewDistributedEngine(engine.Opts{EngineOpts: opts}, api.NewStaticEndpoints([]api.RemoteEngine{remote}))
+
+	ctx := context.Background()
+	const query = `sum by (pod) (rate(http_requests_total[2m]))`
+	expected, err := prom.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	q, err := ng.NewRangeQuery(ctx, nil, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	testutil.Equals(t, encodeResult(t, expected.Exec(ctx)), encodeResult(t, q.Exec(ctx)))
+}
+
+// newPrometheusHandler serves queries the same way as the Prometheus HTTP API.
+func newPrometheusHandler(t *testing.T, ng *promql.Engine, q storage.Queryable) http.Handler {
+	parseTime := func(s string) time.Time {
+		f, err := strconv.ParseFloat(s, 64)
+		testutil.Ok(t, err)
+		return time.UnixMilli(int64(f * 1000))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		testutil.Ok(t, r.ParseForm())
+		var lookbackDelta time.Duration
+		if s := r.Form.Get("lookback_delta"); s != "" {
+			f, err := strconv.ParseFloat(s, 64)
+			testutil.Ok(t, err)
+			lookbackDelta = time.Duration(f * float64(time.Second))
+		}
+		opts := promql.NewPrometheusQueryOpts(false, lookbackDelta)
+
+		var (
+			qry promql.Query
+			err error
+		)
+		switch r.URL.Path {
+		case api.QueryPath:
+			qry, err = ng.NewInstantQuery(r.Context(), q, opts, r.Form.Get("query"), parseTime(r.Form.Get("time")))
+		case api.QueryRangePath:
+			step, perr := strconv.ParseFloat(r.Form.Get("step"), 64)
+			testutil.Ok(t, perr)
+			qry, err = ng.NewRangeQuery(r.Context(), q, opts, r.Form.Get("query"), parseTime(r.Form.Get("start")), parseTime(r.Form.Get("end")), time.Duration(step*float64(time.Second)))
+		default:
+			t.Fatalf("unexpected path %s", r.URL.Path)
+		}
+		testutil.Ok(t, err)
+		defer qry.Close()
+
+		res := qry.Exec(r.Context())
+		testutil.Ok(t, res.Err)
+		writeResponse(t, w, http.StatusOK, &v1.Response{
+			Status: "success",
+			Data:   &v1.QueryData{ResultType: res.Value.Type(), Result: res.Value},
+		})
+	})
+}
+
+func writeResponse(t *testing.T, w http.ResponseWriter, code int, resp *v1.Response) {
+	b, err := v1.JSONCodec{}.Encode(resp)
+	testutil.Ok(t, err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, err = w.Write(b)
+	testutil.Ok(t, err)
+}
+
+// encodeResult encodes a query result in the format of the Prometheus HTTP API, which
+// allows comparing results regardless of the bucket layout of native histograms.
+// Vectors are sorted by their labels since the order of their samples is not defined.
+func encodeResult(t *testing.T, res *promql.Result) string {
+	testutil.Ok(t, res.Err)
+	if vector, ok := res.Value.(promql.Vector); ok {
+		sort.Slice(vector, func(i, j int) bool { return labels.Compare(vector[i].Metric, vector[j].Metric) < 0 })
+	}
+	b, err := v1.JSONCodec{}.Encode(&v1.Response{Status: "success", Data: res.Value})
+	testutil.Ok(t, err)
+
+	// Make sure that the encoding is valid JSON.
+	testutil.Assert(t, json.Valid(b), "invalid result encoding %s", string(b))
+	return string(b)
+}
@@ -22,6 +22,48 @@ type RemoteEngine interface {
 	NewRangeQuery(ctx context.Context, opts promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error)
 }
 
+// RemoteInstantEngine is an optional interface implemented by remote engines which can
+// evaluate instant queries. Instant evaluations are sent to engines which do not implement
+// it as range queries with a single step.
+type RemoteInstantEngine interface {
+	NewInstantQuery(ctx context.Context, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error)
+}
+
+// RemotePlan is the logical plan of a query which is executed by a remote engine.
+type RemotePlan interface {
+	// String returns the PromQL representation of the plan.
+	String() string
+	// MarshalJSON serialises the plan in the versioned format of logicalplan.Marshal.
+	MarshalJSON() ([]byte, error)
+}
+
+// RemotePlanEngine is an optional interface implemented by remote engines which can execute
+// logical plans. Queries are sent to such engines as plans instead of PromQL strings, which
+// preserves the state set by optimizers and allows the remote engine to execute the plan
+// without parsing and optimizing it again.
+type RemotePlanEngine interface {
+	NewRangeQueryFromPlan(ctx context.Context, opts promql.QueryOpts, plan RemotePlan, start, end time.Time, interval time.Duration) (promql.Query, error)
+	NewInstantQueryFromPlan(ctx context.Context, opts promql.QueryOpts, plan RemotePlan, ts time.Time) (promql.Query, error)
+}
+
+// TimedQuery is an optional interface implemented by queries of remote engines whose timers
+// cannot be returned by Stats, such as queries sent through the HTTP API. Remote executions
+// use the timings to split the time spent on the query between the remote engine and the network.
+type TimedQuery interface {
+	// Timings returns the timings reported by the remote engine once the query was executed.
+	Timings() QueryTimings
+}
+
+// QueryTimings are the timings of a query reported by a remote engine.
+type QueryTimings struct {
+	// EvalTotalTime is the time the remote engine spent evaluating the query.
+	EvalTotalTime time.Duration
+	// ExecQueueTime is the time the query waited in the queue of the remote engine.
+	ExecQueueTime time.Duration
+	// ExecTotalTime is the total time the remote engine spent on the query.
+	ExecTotalTime time.Duration
+}
+
 type staticEndpoints struct {
 	engines []RemoteEngine
 }
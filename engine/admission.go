@@ -0,0 +1,126 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// admissionQueue limits the number of queries executing concurrently.
+// Queries which cannot be admitted immediately wait in a queue ordered
+// by priority, and by arrival time for queries with the same priority.
+type admissionQueue struct {
+	mu            sync.Mutex
+	maxConcurrent int
+	running       int
+	seq           uint64
+	waiting       waiterHeap
+	// queued is the number of queries waiting in the queue.
+	queued prometheus.Gauge
+}
+
+func newAdmissionQueue(maxConcurrent int, queued prometheus.Gauge) *admissionQueue {
+	if maxConcurrent <= 0 {
+		return nil
+	}
+	return &admissionQueue{maxConcurrent: maxConcurrent, queued: queued}
+}
+
+// acquire blocks until the query can be executed or the context is done.
+// The returned function must be called to release the slot once the query has finished.
+// A nil queue admits every query immediately.
+func (q *admissionQueue) acquire(ctx context.Context, priority int) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+
+	q.mu.Lock()
+	if q.running < q.maxConcurrent && len(q.waiting) == 0 {
+		q.running++
+		q.mu.Unlock()
+		return q.release, nil
+	}
+	w := &waiter{priority: priority, seq: q.seq, admitted: make(chan struct{})}
+	q.seq++
+	heap.Push(&q.waiting, w)
+	q.queued.Set(float64(len(q.waiting)))
+	q.mu.Unlock()
+
+	select {
+	case <-w.admitted:
+		return q.release, nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		if w.index < 0 {
+			// The query was admitted concurrently with the context being done,
+			// so the slot has to be handed over to the next query.
+			q.mu.Unlock()
+			q.release()
+			return nil, ctx.Err()
+		}
+		heap.Remove(&q.waiting, w.index)
+		q.queued.Set(float64(len(q.waiting)))
+		q.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (q *admissionQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.waiting) == 0 {
+		q.running--
+		return
+	}
+	// The slot is handed over to the next query so the number of running queries does not change.
+	w := heap.Pop(&q.waiting).(*waiter)
+	q.queued.Set(float64(len(q.waiting)))
+	close(w.admitted)
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	admitted chan struct{}
+	// index is the position of the waiter in the heap, or -1 once it has been admitted.
+	index int
+}
+
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*h = old[:n-1]
+	return w
+}
@@ -12,6 +12,7 @@ import (
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 	v1 "github.com/prometheus/prometheus/web/api/v1"
 )
@@ -50,6 +51,36 @@ func (l remoteEngine) NewRangeQuery(ctx context.Context, opts promql.QueryOpts,
 	return l.engine.NewRangeQuery(ctx, l.q, opts, qs, start, end, interval)
 }
 
+func (l remoteEngine) NewInstantQuery(ctx context.Context, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	return l.engine.NewInstantQuery(ctx, l.q, opts, qs, ts)
+}
+
+func (l remoteEngine) NewRangeQueryFromPlan(ctx context.Context, opts promql.QueryOpts, plan api.RemotePlan, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	root, err := decodePlan(plan)
+	if err != nil {
+		return nil, err
+	}
+	return l.engine.NewRangeQueryFromPlan(ctx, l.q, opts, root, start, end, interval)
+}
+
+func (l remoteEngine) NewInstantQueryFromPlan(ctx context.Context, opts promql.QueryOpts, plan api.RemotePlan, ts time.Time) (promql.Query, error) {
+	root, err := decodePlan(plan)
+	if err != nil {
+		return nil, err
+	}
+	return l.engine.NewInstantQueryFromPlan(ctx, l.q, opts, root, ts)
+}
+
+// decodePlan serialises and decodes the plan the same way as when it is sent over the network,
+// so that the remote execution does not share state with the plan of the distributed query.
+func decodePlan(plan api.RemotePlan) (parser.Expr, error) {
+	data, err := plan.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	return logicalplan.Unmarshal(data)
+}
+
 type distributedEngine struct {
 	endpoints    api.RemoteEndpoints
 	remoteEngine *compatibilityEngine
@@ -68,7 +99,9 @@ func NewDistributedEngine(opts Opts, endpoints api.RemoteEndpoints) v1.QueryEngi
 	}
 }
 
-func (l distributedEngine) SetQueryLogger(log promql.QueryLogger) {}
+func (l distributedEngine) SetQueryLogger(log promql.QueryLogger) {
+	l.remoteEngine.SetQueryLogger(log)
+}
 
 func (l distributedEngine) NewInstantQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
 	// Truncate milliseconds to avoid mismatch in timestamps between remote and local engines.
@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"strings"
 	"testing"
 	"time"
 
@@ -19,6 +20,9 @@ import (
 
 	"github.com/thanos-io/promql-engine/api"
 	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/remote"
+	"github.com/thanos-io/promql-engine/tracing"
 )
 
 type partition struct {
@@ -227,7 +231,12 @@ func TestDistributedAggregations(t *testing.T) {
 		{name: "binary nested with constants", query: `(1 + 2) + (1 atan2 (-1 % -1))`},
 		{name: "binary nested with functions", query: `(1 + exp(vector(1))) + (1 atan2 (-1 % -1))`},
 		{name: "filtered selector interaction", query: `sum by (region) (bar{region="east"}) / sum by (region) (bar)`},
-		{name: "unsupported aggregation", query: `count_values("pod", bar)`, expectFallback: true},
+		{name: "count_values", query: `count_values("value", bar)`},
+		{name: "count_values by", query: `count_values by (pod) ("value", bar)`},
+		{name: "count_values without", query: `count_values without (pod) ("value", bar)`},
+		{name: "count_values overriding a label", query: `count_values by (pod) ("pod", bar)`},
+		{name: "timestamp", query: `timestamp(bar)`},
+		{name: "aggregation of timestamp", query: `max by (pod) (timestamp(bar))`},
 		{name: "absent_over_time for non-existing metric", query: `absent_over_time(foo[2m])`},
 		{name: "absent_over_time for existing metric", query: `absent_over_time(bar{pod="nginx-1"}[2m])`},
 		{name: "absent for non-existing metric", query: `absent(foo)`},
@@ -345,3 +354,431 @@ func TestDistributedEngineWarnings(t *testing.T) {
 	res := q.Exec(context.Background())
 	testutil.Equals(t, 1, len(res.Warnings))
 }
+
+func TestDistributedEngineTracing(t *testing.T) {
+	load := `load 30s
+		foo{pod="a"} 1+1x40
+		foo{pod="b"} 1+2x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	recorder := tracing.NewRecorder()
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    1 * time.Minute,
+		},
+		EnableAnalysis: true,
+		Tracer:         recorder,
+	}
+	remote := engine.NewRemoteEngine(opts, storage, math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")})
+	ng := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remote}))
+
+	ctx := context.Background()
+	q, err := ng.NewRangeQuery(ctx, nil, nil, "sum by (pod) (foo)", time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	res := q.Exec(ctx)
+	testutil.Ok(t, res.Err)
+
+	// Tracing must not hide operators from analysis.
+	testutil.Assert(t, q.(engine.ExplainableQuery).ExplainAnalyze().Analyzed, "expected the root operator to be analyzed")
+
+	spans := recorder.Spans()
+	byID := make(map[uint64]tracing.RecordedSpan, len(spans))
+	for _, s := range spans {
+		byID[s.ID] = s
+	}
+
+	var roots, remoteQueries, remoteOperators int
+	for _, s := range spans {
+		testutil.Assert(t, !s.EndTime.Before(s.StartTime), "span %s ended before it started", s.Name)
+		if s.ParentID == 0 {
+			roots++
+			testutil.Equals(t, "query", s.Name)
+			testutil.Equals(t, "sum by (pod) (foo)", s.Attributes["query"])
+			continue
+		}
+		parent, ok := byID[s.ParentID]
+		testutil.Assert(t, ok, "parent of span %s was not recorded", s.Name)
+
+		switch {
+		case s.Name == "remote query":
+			remoteQueries++
+			testutil.Assert(t, strings.HasPrefix(parent.Name, "[*remoteExec]"), "unexpected parent %s of remote query", parent.Name)
+		case s.Name == "query":
+			// The query of the remote engine is part of the same trace.
+			testutil.Equals(t, "remote query", parent.Name)
+		case strings.HasPrefix(s.Name, "[*remoteExec]"):
+			remoteOperators++
+		}
+		if strings.HasSuffix(s.Name, " Next") {
+			_, ok := s.Attributes["steps"]
+			testutil.Assert(t, ok, "expected number of steps in span %s", s.Name)
+		}
+	}
+	testutil.Equals(t, 1, roots)
+	testutil.Equals(t, 1, remoteQueries)
+	testutil.Assert(t, remoteOperators > 1, "expected spans for Series and Next calls of the remote execution")
+}
+
+func TestDistributedInstantQuery(t *testing.T) {
+	load := `load 30s
+		foo{pod="a"} 1+1x40
+		foo{pod="b"} 1+2x40
+		foo{pod="c"} {{schema:0 sum:1 count:1}}x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    1 * time.Minute,
+		},
+	}
+	ctx := context.Background()
+	ts := time.Unix(600, 0)
+
+	for _, query := range []string{`foo`, `sum by (pod) (rate(foo[2m]))`, `max(foo)`} {
+		t.Run(query, func(t *testing.T) {
+			prom := promql.NewEngine(opts.EngineOpts)
+			q, err := prom.NewInstantQuery(ctx, storage, nil, query, ts)
+			testutil.Ok(t, err)
+			expected := q.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			for _, tcase := range []struct {
+				name           string
+				remote         func() (api.RemoteEngine, *queryCounter)
+				instantQueries int
+			}{
+				{
+					name: "engine with instant queries",
+					remote: func() (api.RemoteEngine, *queryCounter) {
+						e := &instantCountingEngine{countingEngine{RemoteEngine: engine.NewRemoteEngine(opts, storage, math.MinInt64, math.MaxInt64, nil)}}
+						return e, &e.queryCounter
+					},
+					instantQueries: 1,
+				},
+				{
+					name: "engine without instant queries",
+					remote: func() (api.RemoteEngine, *queryCounter) {
+						e := &countingEngine{RemoteEngine: engine.NewRemoteEngine(opts, storage, math.MinInt64, math.MaxInt64, nil)}
+						return e, &e.queryCounter
+					},
+				},
+			} {
+				t.Run(tcase.name, func(t *testing.T) {
+					remote, counter := tcase.remote()
+					ng := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remote}))
+					q, err := ng.NewInstantQuery(ctx, nil, nil, query, ts)
+					testutil.Ok(t, err)
+					defer q.Close()
+
+					res := q.Exec(ctx)
+					testutil.Ok(t, res.Err)
+					testutil.WithGoCmp(comparer).Equals(t, expected, res, queryExplanation(q))
+					testutil.Equals(t, tcase.instantQueries, counter.instantQueries)
+					testutil.Equals(t, 1-tcase.instantQueries, counter.rangeQueries)
+				})
+			}
+		})
+	}
+}
+
+type queryCounter struct {
+	rangeQueries   int
+	instantQueries int
+}
+
+// countingEngine counts the queries created in the wrapped engine and only supports range queries.
+type countingEngine struct {
+	api.RemoteEngine
+	queryCounter
+}
+
+func (e *countingEngine) NewRangeQuery(ctx context.Context, opts promql.QueryOpts, qs string, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	e.rangeQueries++
+	return e.RemoteEngine.NewRangeQuery(ctx, opts, qs, start, end, interval)
+}
+
+type instantCountingEngine struct {
+	countingEngine
+}
+
+func (e *instantCountingEngine) NewInstantQuery(ctx context.Context, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
+	e.instantQueries++
+	return e.RemoteEngine.(api.RemoteInstantEngine).NewInstantQuery(ctx, opts, qs, ts)
+}
+
+func TestDistributedEngineSendsPlans(t *testing.T) {
+	load := `load 30s
+		foo{pod="a"} 1+1x40
+		foo{pod="b"} 1+2x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    1 * time.Minute,
+		},
+	}
+	ctx := context.Background()
+	const query = `sum by (pod) (rate(foo[2m]))`
+
+	remote := &planRecordingEngine{planEngine: engine.NewRemoteEngine(opts, storage, math.MinInt64, math.MaxInt64, nil)}
+	ng := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remote}))
+	prom := promql.NewEngine(opts.EngineOpts)
+
+	q, err := ng.NewRangeQuery(ctx, nil, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	expected, err := prom.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	testutil.WithGoCmp(comparer).Equals(t, expected.Exec(ctx), q.Exec(ctx), queryExplanation(q))
+
+	q, err = ng.NewInstantQuery(ctx, nil, nil, query, time.Unix(600, 0))
+	testutil.Ok(t, err)
+	expected, err = prom.NewInstantQuery(ctx, storage, nil, query, time.Unix(600, 0))
+	testutil.Ok(t, err)
+	testutil.WithGoCmp(comparer).Equals(t, expected.Exec(ctx), q.Exec(ctx), queryExplanation(q))
+
+	testutil.Equals(t, []string{"range " + query, "instant " + query}, remote.plans)
+}
+
+type planEngine interface {
+	api.RemoteEngine
+	api.RemotePlanEngine
+}
+
+// planRecordingEngine records the plans executed by the wrapped engine.
+type planRecordingEngine struct {
+	planEngine
+	plans []string
+}
+
+func (e *planRecordingEngine) NewRangeQueryFromPlan(ctx context.Context, opts promql.QueryOpts, plan api.RemotePlan, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	e.plans = append(e.plans, "range "+plan.String())
+	return e.planEngine.NewRangeQueryFromPlan(ctx, opts, plan, start, end, interval)
+}
+
+func (e *planRecordingEngine) NewInstantQueryFromPlan(ctx context.Context, opts promql.QueryOpts, plan api.RemotePlan, ts time.Time) (promql.Query, error) {
+	e.plans = append(e.plans, "instant "+plan.String())
+	return e.planEngine.NewInstantQueryFromPlan(ctx, opts, plan, ts)
+}
+
+func TestDistributedEngineStreamsResults(t *testing.T) {
+	load := `load 30s
+		foo{pod="a"} 1+1x40
+		foo{pod="b"} 1+2x40
+		bar{pod="a"} {{schema:0 sum:5 count:4 buckets:[1 2 1]}}+{{schema:0 sum:2 count:2 buckets:[1 1]}}x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    1 * time.Minute,
+		},
+	}
+	ctx := context.Background()
+	prom := promql.NewEngine(opts.EngineOpts)
+
+	for _, query := range []string{
+		`sum by (pod) (rate(foo[2m]))`,
+		`sum(bar)`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			remote := &streamingEngine{planEngine: engine.NewRemoteEngine(opts, storage, math.MinInt64, math.MaxInt64, nil)}
+			ng := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remote}))
+
+			q, err := ng.NewRangeQuery(ctx, nil, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			expected, err := prom.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+			testutil.Ok(t, err)
+			testutil.WithGoCmp(comparer).Equals(t, expected.Exec(ctx), q.Exec(ctx), queryExplanation(q))
+			// The 21 steps of the query are read from the stream in batches of 10 steps.
+			testutil.Equals(t, 3, remote.batches)
+
+			remote.batches = 0
+			q, err = ng.NewInstantQuery(ctx, nil, nil, query, time.Unix(600, 0))
+			testutil.Ok(t, err)
+			expected, err = prom.NewInstantQuery(ctx, storage, nil, query, time.Unix(600, 0))
+			testutil.Ok(t, err)
+			testutil.WithGoCmp(comparer).Equals(t, expected.Exec(ctx), q.Exec(ctx), queryExplanation(q))
+			testutil.Equals(t, 1, remote.batches)
+		})
+	}
+}
+
+// streamingEngine counts the batches streamed from the queries of the wrapped engine.
+// Its queries fail when their result is materialised instead of being streamed.
+type streamingEngine struct {
+	planEngine
+	batches int
+}
+
+func (e *streamingEngine) NewRangeQueryFromPlan(ctx context.Context, opts promql.QueryOpts, plan api.RemotePlan, start, end time.Time, interval time.Duration) (promql.Query, error) {
+	q, err := e.planEngine.NewRangeQueryFromPlan(ctx, opts, plan, start, end, interval)
+	if err != nil {
+		return nil, err
+	}
+	return &streamingQuery{StreamingQuery: q.(remote.StreamingQuery), engine: e}, nil
+}
+
+func (e *streamingEngine) NewInstantQueryFromPlan(ctx context.Context, opts promql.QueryOpts, plan api.RemotePlan, ts time.Time) (promql.Query, error) {
+	q, err := e.planEngine.NewInstantQueryFromPlan(ctx, opts, plan, ts)
+	if err != nil {
+		return nil, err
+	}
+	return &streamingQuery{StreamingQuery: q.(remote.StreamingQuery), engine: e}, nil
+}
+
+type streamingQuery struct {
+	remote.StreamingQuery
+	engine *streamingEngine
+}
+
+func (q *streamingQuery) Exec(context.Context) *promql.Result {
+	return &promql.Result{Err: errors.New("result of streaming query was materialised")}
+}
+
+func (q *streamingQuery) Stream(ctx context.Context) (remote.ResultStream, error) {
+	stream, err := q.StreamingQuery.Stream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &countingStream{ResultStream: stream, engine: q.engine}, nil
+}
+
+type countingStream struct {
+	remote.ResultStream
+	engine *streamingEngine
+}
+
+func (s *countingStream) Next() ([]model.StepVector, error) {
+	batch, err := s.ResultStream.Next()
+	if batch != nil {
+		s.engine.batches++
+	}
+	return batch, err
+}
+
+func TestDistributedEngineWithConcurrencyLimit(t *testing.T) {
+	east := `load 30s
+		foo{region="east"} 1+1x40
+		bar{region="east"} 1+2x40`
+	west := `load 30s
+		foo{region="west"} 1+3x40
+		bar{region="west"} 1+4x40`
+	eastStorage := promql.LoadedStorage(t, east)
+	defer eastStorage.Close()
+	westStorage := promql.LoadedStorage(t, west)
+	defer westStorage.Close()
+	storage := promql.LoadedStorage(t, east+`
+		foo{region="west"} 1+3x40
+		bar{region="west"} 1+4x40`)
+	defer storage.Close()
+
+	// Remote engines which execute a single query at a time have to be able to
+	// execute distributed queries with several remote executions against them.
+	remoteOpts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    3 * time.Second,
+		},
+		MaxConcurrentQueries: 1,
+	}
+	remotes := []api.RemoteEngine{
+		engine.NewRemoteEngine(remoteOpts, eastStorage, math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+		engine.NewRemoteEngine(remoteOpts, westStorage, math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples: math.MaxInt64,
+			Timeout:    1 * time.Minute,
+		},
+	}
+	ng := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(remotes))
+	prom := promql.NewEngine(opts.EngineOpts)
+
+	ctx := context.Background()
+	const query = `sum(foo) / sum(bar)`
+	q, err := ng.NewRangeQuery(ctx, nil, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	expected, err := prom.NewRangeQuery(ctx, storage, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	testutil.WithGoCmp(comparer).Equals(t, expected.Exec(ctx), q.Exec(ctx), queryExplanation(q))
+}
+
+func TestDistributedAtModifiers(t *testing.T) {
+	east := `load 30s
+		foo{job="a", region="east"} 1+1x40
+		foo{job="b", region="east"} 1+2x40`
+	west := `load 30s
+		foo{job="a", region="west"} 1+3x40
+		foo{job="c", region="west"} 1+4x40`
+	eastStorage := promql.LoadedStorage(t, east)
+	defer eastStorage.Close()
+	westStorage := promql.LoadedStorage(t, west)
+	defer westStorage.Close()
+	combined := promql.LoadedStorage(t, east+`
+		foo{job="a", region="west"} 1+3x40
+		foo{job="c", region="west"} 1+4x40`)
+	defer combined.Close()
+
+	opts := engine.Opts{
+		EngineOpts: promql.EngineOpts{
+			MaxSamples:           math.MaxInt64,
+			Timeout:              1 * time.Minute,
+			EnableAtModifier:     true,
+			EnableNegativeOffset: true,
+		},
+	}
+	prom := promql.NewEngine(opts.EngineOpts)
+	newRemote := func(s storage.Queryable, region string) api.RemoteEngine {
+		return engine.NewRemoteEngine(opts, s, math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", region)})
+	}
+
+	ctx := context.Background()
+	for _, tcase := range []struct {
+		name    string
+		remotes []api.RemoteEngine
+	}{
+		{
+			name:    "engines which execute plans",
+			remotes: []api.RemoteEngine{newRemote(eastStorage, "east"), newRemote(westStorage, "west")},
+		},
+		{
+			name: "engines which execute queries",
+			remotes: []api.RemoteEngine{
+				&countingEngine{RemoteEngine: newRemote(eastStorage, "east")},
+				&countingEngine{RemoteEngine: newRemote(westStorage, "west")},
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			ng := engine.NewDistributedEngine(opts, api.NewStaticEndpoints(tcase.remotes))
+			for _, query := range []string{
+				`sum by (job) (foo @ end())`,
+				`sum by (job) (foo @ start())`,
+				`sum by (job) (rate(foo[2m] @ end()))`,
+				`max by (job) (max_over_time(foo[5m:1m] @ end()))`,
+				`sum by (job) (foo @ end()) - sum by (job) (foo)`,
+			} {
+				t.Run(query, func(t *testing.T) {
+					q, err := ng.NewRangeQuery(ctx, nil, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+					testutil.Ok(t, err)
+					expected, err := prom.NewRangeQuery(ctx, combined, nil, query, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+					testutil.Ok(t, err)
+					testutil.WithGoCmp(comparer).Equals(t, expected.Exec(ctx), q.Exec(ctx), queryExplanation(q))
+
+					q, err = ng.NewInstantQuery(ctx, nil, nil, query, time.Unix(600, 0))
+					testutil.Ok(t, err)
+					expected, err = prom.NewInstantQuery(ctx, combined, nil, query, time.Unix(600, 0))
+					testutil.Ok(t, err)
+					testutil.WithGoCmp(comparer).Equals(t, expected.Exec(ctx), q.Exec(ctx), queryExplanation(q))
+				})
+			}
+		})
+	}
+}
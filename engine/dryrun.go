@@ -0,0 +1,229 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/warnings"
+)
+
+// ErrDryRunNotSupported is returned when the cost of a query cannot be estimated without executing it,
+// because the query would be executed by the fallback engine or it loads series by evaluating samples.
+var ErrDryRunNotSupported = errors.New("dry run is not supported for query")
+
+// DefaultSampleInterval is the interval between the samples of a series which dry runs assume
+// unless QueryOpts.SampleInterval is set. It is the default scrape interval of Prometheus.
+const DefaultSampleInterval = time.Minute
+
+// CostEstimate is the estimated cost of an operator of a query. Estimates are computed
+// by loading the series of each operator, without evaluating any samples.
+type CostEstimate struct {
+	Name string `json:"name"`
+	// Series is the number of series returned by the operator.
+	Series int `json:"series"`
+	// Steps is the number of steps the operator is evaluated at. Operators under
+	// a subquery are evaluated at the steps of the subquery.
+	Steps int64 `json:"steps"`
+	// Range is the range of samples of each series which is evaluated at each step
+	// by range selectors and subqueries.
+	Range time.Duration `json:"range,omitempty"`
+	// EstimatedSamples is the number of samples the operator would evaluate if each of its
+	// series had a sample at each step, or, for operators with a range, a sample at each
+	// sample interval within the range of each step.
+	EstimatedSamples int64          `json:"estimatedSamples"`
+	Children         []CostEstimate `json:"children,omitempty"`
+}
+
+// Selected returns the number of series and the estimated number of samples
+// of the operators which select data, which are the leaves of the tree.
+func (c *CostEstimate) Selected() (series int, samples int64) {
+	if len(c.Children) == 0 {
+		return c.Series, c.EstimatedSamples
+	}
+	for i := range c.Children {
+		s, n := c.Children[i].Selected()
+		series += s
+		samples += n
+	}
+	return series, samples
+}
+
+// DryRunInstantQuery estimates the cost of an instant query without evaluating it.
+// It returns ErrDryRunNotSupported if the query would be executed by the fallback engine
+// or contains operators which evaluate samples to load their series, such as count_values.
+func (e *compatibilityEngine) DryRunInstantQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, ts time.Time) (*CostEstimate, error) {
+	qry, err := e.NewInstantQuery(ctx, q, opts, qs, ts)
+	if err != nil {
+		return nil, err
+	}
+	defer qry.Close()
+	return dryRun(ctx, qry, estimateOpts{steps: 1, sampleInterval: sampleInterval(opts)})
+}
+
+// DryRunRangeQuery estimates the cost of a range query without evaluating it.
+// It returns ErrDryRunNotSupported if the query would be executed by the fallback engine
+// or contains operators which evaluate samples to load their series, such as count_values.
+func (e *compatibilityEngine) DryRunRangeQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, start, end time.Time, step time.Duration) (*CostEstimate, error) {
+	qry, err := e.NewRangeQuery(ctx, q, opts, qs, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	defer qry.Close()
+	steps := int64(1)
+	if step > 0 {
+		steps += int64(end.Sub(start) / step)
+	}
+	return dryRun(ctx, qry, estimateOpts{steps: steps, step: step, sampleInterval: sampleInterval(opts)})
+}
+
+func sampleInterval(opts promql.QueryOpts) time.Duration {
+	if interval := engineQueryOpts(opts).SampleInterval; interval > 0 {
+		return interval
+	}
+	return DefaultSampleInterval
+}
+
+// estimateOpts are the steps an operator is evaluated at and the expected interval between samples in storage.
+type estimateOpts struct {
+	steps          int64
+	step           time.Duration
+	sampleInterval time.Duration
+}
+
+// eagerOperator is implemented by operators which evaluate their inputs when their series are loaded,
+// for example count_values, whose series depend on the values of its input, and remote executions.
+// Their cost cannot be estimated without executing the query.
+type eagerOperator interface {
+	EvaluatesInputForSeries()
+}
+
+// rangeOperator is implemented by operators which evaluate a range of samples of each series at each step.
+type rangeOperator interface {
+	// SelectRange returns the range which is evaluated at each step and the interval between the
+	// samples in the range. The interval is zero if it is given by the samples in storage.
+	SelectRange() (selectRange, interval time.Duration)
+}
+
+// subqueryOperator is implemented by operators which evaluate an inner operator at the steps of a subquery.
+type subqueryOperator interface {
+	rangeOperator
+	Inner() model.VectorOperator
+}
+
+// unwrapOperator returns the operator wrapped by wrappers such as the tracing wrapper.
+func unwrapOperator(op model.VectorOperator) model.VectorOperator {
+	for {
+		w, ok := op.(interface{ Unwrap() model.VectorOperator })
+		if !ok {
+			return op
+		}
+		op = w.Unwrap()
+	}
+}
+
+func dryRun(ctx context.Context, qry promql.Query, opts estimateOpts) (*CostEstimate, error) {
+	var cq *compatibilityQuery
+	switch q := qry.(type) {
+	case *compatibilityQuery:
+		cq = q
+	case *streamingQuery:
+		cq = q.compatibilityQuery
+	case *fallbackQuery:
+		return nil, errors.Wrapf(ErrDryRunNotSupported, "executed by the fallback engine: %s", q.reason)
+	default:
+		return nil, ErrDryRunNotSupported
+	}
+
+	ctx = warnings.NewContext(ctx)
+	ctx, cancel := context.WithTimeout(ctx, cq.engine.timeout)
+	defer cancel()
+
+	// Operators load the series of their inputs when their own series are loaded,
+	// so the whole tree is checked before any series are loaded.
+	if err := checkEstimable(cq.exec); err != nil {
+		return nil, err
+	}
+	estimate, err := estimateOperator(ctx, cq.exec, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := cq.memoryTracker.Err(); err != nil {
+		return nil, err
+	}
+	return &estimate, nil
+}
+
+// checkEstimable returns an error if the cost of an operator in the tree cannot be estimated without executing it.
+func checkEstimable(op model.VectorOperator) error {
+	name, children := op.Explain()
+	if _, ok := unwrapOperator(op).(eagerOperator); ok {
+		return errors.Wrapf(ErrDryRunNotSupported, "operator %s evaluates its input to load its series", name)
+	}
+	for _, c := range children {
+		if err := checkEstimable(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func estimateOperator(ctx context.Context, op model.VectorOperator, opts estimateOpts) (CostEstimate, error) {
+	series, err := op.Series(ctx)
+	if err != nil {
+		return CostEstimate{}, err
+	}
+	name, children := op.Explain()
+	estimate := CostEstimate{
+		Name:             name,
+		Series:           len(series),
+		Steps:            opts.steps,
+		EstimatedSamples: int64(len(series)) * opts.steps,
+	}
+
+	var (
+		inner      model.VectorOperator
+		innerOpts  = opts
+		unwrapped  = unwrapOperator(op)
+		samplesPer = int64(1)
+	)
+	if r, ok := unwrapped.(rangeOperator); ok {
+		selectRange, interval := r.SelectRange()
+		if interval <= 0 {
+			interval = opts.sampleInterval
+		}
+		estimate.Range = selectRange
+		if n := int64(selectRange / interval); n > 1 {
+			samplesPer = n
+		}
+		estimate.EstimatedSamples *= samplesPer
+
+		// The inner operator of a subquery is evaluated at each step of the subquery
+		// within the range of the first step up to the last step.
+		if sq, ok := unwrapped.(subqueryOperator); ok {
+			inner = sq.Inner()
+			innerOpts.steps = int64((time.Duration(opts.steps-1)*opts.step+selectRange)/interval) + 1
+			innerOpts.step = interval
+		}
+	}
+
+	for _, c := range children {
+		childOpts := opts
+		if c == inner {
+			childOpts = innerOpts
+		}
+		child, err := estimateOperator(ctx, c, childOpts)
+		if err != nil {
+			return CostEstimate{}, err
+		}
+		estimate.Children = append(estimate.Children, child)
+	}
+	return estimate, nil
+}
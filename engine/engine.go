@@ -8,6 +8,7 @@ import (
 	"math"
 	"runtime"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/efficientgo/core/errors"
@@ -24,19 +25,24 @@ import (
 
 	"github.com/thanos-io/promql-engine/execution"
 	"github.com/thanos-io/promql-engine/execution/function"
+	"github.com/thanos-io/promql-engine/execution/limits"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/execution/warnings"
 	"github.com/thanos-io/promql-engine/extlabels"
 	"github.com/thanos-io/promql-engine/logicalplan"
 	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/tracing"
 )
 
 type QueryType int
 
 type engineMetrics struct {
 	currentQueries prometheus.Gauge
+	queuedQueries  prometheus.Gauge
 	queries        *prometheus.CounterVec
+	fallbacks      *prometheus.CounterVec
+	queueDuration  prometheus.Histogram
 }
 
 const (
@@ -72,13 +78,72 @@ type Opts struct {
 	// FallbackEngine
 	Engine v1.QueryEngine
 
-	// EnableAnalysis enables query analysis.
+	// EnableAnalysis enables query analysis. It also records how each logical optimizer
+	// changed the plan of a query, which is returned by ExplainLogicalPlan.
 	EnableAnalysis bool
 
 	// SelectorBatchSize specifies the maximum number of samples to be returned by selectors in a single batch.
 	SelectorBatchSize int64
+
+	// MemoryLimitBytes is the maximum number of bytes a single query can allocate for series,
+	// step vectors and operator state. Queries exceeding the limit fail with an error
+	// wrapping limits.ErrMemoryLimitExceeded. Zero means no limit.
+	MemoryLimitBytes int64
+
+	// Parallelism determines the number of shards each selector of a query is split into, which is
+	// Parallelism / 2, and whether operators run in separate goroutines, which they do when it is
+	// larger than one. It does not limit the number of goroutines of a query, which grows with
+	// the number of selectors in the query. It can be overridden for individual queries through
+	// QueryOpts. Defaults to GOMAXPROCS if not specified.
+	Parallelism int
+
+	// MaxConcurrentQueries is the maximum number of queries executed at the same time.
+	// Queries above the limit wait in a queue until they can be executed, ordered by
+	// their priority and by arrival time. Queries executed by the fallback engine wait
+	// in the same queue. Zero means no limit.
+	MaxConcurrentQueries int
+
+	// EnableOperatorMetrics registers metrics about the operators of executed queries, such as
+	// operator execution times, series per selector, remote execution latencies and vector pool reuse.
+	// The metrics are computed from the telemetry used by Analyze, so enabling them also enables
+	// telemetry collection for all queries.
+	EnableOperatorMetrics bool
+
+	// Tracer records a span for the execution of each query and for the Series and Next calls
+	// of its operators. Remote engines which share the tracer attach their spans to the spans
+	// of the query that executes them. Queries are not traced if it is nil.
+	Tracer tracing.Tracer
 }
 
+// QueryOpts are options for a single query. They can be passed to NewInstantQuery and
+// NewRangeQuery in place of promql.QueryOpts to use features specific to this engine.
+type QueryOpts struct {
+	// LookbackDeltaParam is the lookback delta for the query. Defaults to the engine lookback delta.
+	LookbackDeltaParam time.Duration
+
+	// EnablePerStepStatsParam enables per step statistics for the query.
+	EnablePerStepStatsParam bool
+
+	// Parallelism overrides the parallelism of the engine for the query if set to a positive value.
+	Parallelism int
+
+	// Priority is a hint for ordering queries which are waiting to be executed.
+	// Queries with a higher priority are executed first. Defaults to zero.
+	Priority int
+
+	// ReportFallback adds an info annotation with the reason to the result
+	// of the query if it is executed by the fallback engine.
+	ReportFallback bool
+
+	// SampleInterval is the expected interval between the samples of a series in storage. It is used
+	// by dry runs to estimate the number of samples read by range selectors. Defaults to DefaultSampleInterval.
+	SampleInterval time.Duration
+}
+
+func (o QueryOpts) LookbackDelta() time.Duration { return o.LookbackDeltaParam }
+
+func (o QueryOpts) EnablePerStepStats() bool { return o.EnablePerStepStatsParam }
+
 func (o Opts) getLogicalOptimizers() []logicalplan.Optimizer {
 	var optimizers []logicalplan.Optimizer
 	if o.LogicalOptimizers == nil {
@@ -103,6 +168,9 @@ func New(opts Opts) *compatibilityEngine {
 		opts.ExtLookbackDelta = 1 * time.Hour
 		level.Debug(opts.Logger).Log("msg", "externallookback delta is zero, setting to default value", "value", 1*24*time.Hour)
 	}
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = runtime.GOMAXPROCS(0)
+	}
 	if opts.SelectorBatchSize != 0 {
 		opts.LogicalOptimizers = append(
 			[]logicalplan.Optimizer{logicalplan.SelectorBatchSize{Size: opts.SelectorBatchSize}},
@@ -129,6 +197,14 @@ func New(opts Opts) *compatibilityEngine {
 				Help:      "The current number of queries being executed or waiting.",
 			},
 		),
+		queuedQueries: promauto.With(opts.Reg).NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "queued_queries",
+				Help:      "The current number of queries waiting in the queue.",
+			},
+		),
 		queries: promauto.With(opts.Reg).NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: namespace,
@@ -137,6 +213,28 @@ func New(opts Opts) *compatibilityEngine {
 				Help:      "Number of PromQL queries.",
 			}, []string{"fallback"},
 		),
+		fallbacks: promauto.With(opts.Reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "fallback_queries_total",
+				Help:      "Number of PromQL queries executed by the fallback engine, by the feature which is not supported.",
+			}, []string{"reason"},
+		),
+		queueDuration: promauto.With(opts.Reg).NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "query_queue_duration_seconds",
+				Help:      "Time queries spent waiting in the queue before being executed.",
+				Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+			},
+		),
+	}
+
+	var opMetrics *operatorMetrics
+	if opts.EnableOperatorMetrics {
+		opMetrics = newOperatorMetrics(opts.Reg)
 	}
 
 	var engine v1.QueryEngine
@@ -157,8 +255,14 @@ func New(opts Opts) *compatibilityEngine {
 		timeout:           opts.Timeout,
 		metrics:           metrics,
 		extLookbackDelta:  opts.ExtLookbackDelta,
-		enableAnalysis:    opts.EnableAnalysis,
+		enableAnalysis:    opts.EnableAnalysis || opts.EnableOperatorMetrics,
+		traceOptimizers:   opts.EnableAnalysis,
+		operatorMetrics:   opMetrics,
 		enableSubqueries:  opts.EnableSubqueries,
+		memoryLimitBytes:  opts.MemoryLimitBytes,
+		parallelism:       opts.Parallelism,
+		queue:             newAdmissionQueue(opts.MaxConcurrentQueries, metrics.queuedQueries),
+		tracer:            opts.Tracer,
 		noStepSubqueryIntervalFn: func(d time.Duration) time.Duration {
 			return time.Duration(opts.NoStepSubqueryIntervalFn(d.Milliseconds()) * 1000000)
 		},
@@ -178,12 +282,52 @@ type compatibilityEngine struct {
 
 	extLookbackDelta         time.Duration
 	enableAnalysis           bool
+	traceOptimizers          bool
 	enableSubqueries         bool
+	memoryLimitBytes         int64
+	parallelism              int
+	queue                    *admissionQueue
+	tracer                   tracing.Tracer
+	operatorMetrics          *operatorMetrics
 	noStepSubqueryIntervalFn func(time.Duration) time.Duration
+
+	queryLoggerLock sync.RWMutex
+	queryLogger     promql.QueryLogger
 }
 
+// SetQueryLogger sets the logger for queries executed by the engine, including
+// queries executed by the fallback engine. The previous logger is closed.
 func (e *compatibilityEngine) SetQueryLogger(l promql.QueryLogger) {
-	e.prom.SetQueryLogger(l)
+	e.queryLoggerLock.Lock()
+	defer e.queryLoggerLock.Unlock()
+
+	if e.queryLogger != nil {
+		if err := e.queryLogger.Close(); err != nil {
+			level.Warn(e.logger).Log("msg", "error while closing the previous query logger", "err", err)
+		}
+	}
+	e.queryLogger = l
+}
+
+// engineQueryOpts returns the engine specific options for a query, if any were passed.
+func engineQueryOpts(opts promql.QueryOpts) QueryOpts {
+	switch qOpts := opts.(type) {
+	case QueryOpts:
+		return qOpts
+	case *QueryOpts:
+		if qOpts != nil {
+			return *qOpts
+		}
+	}
+	return QueryOpts{}
+}
+
+// queryParallelism returns the parallelism for a query, taking per-query overrides into account.
+func (e *compatibilityEngine) queryParallelism(opts QueryOpts) int {
+	if opts.Parallelism > 0 {
+		return opts.Parallelism
+	}
+	return e.parallelism
 }
 
 func (e *compatibilityEngine) NewInstantQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, ts time.Time) (promql.Query, error) {
@@ -191,7 +335,19 @@ func (e *compatibilityEngine) NewInstantQuery(ctx context.Context, q storage.Que
 	if err != nil {
 		return nil, err
 	}
+	return e.newInstantQuery(ctx, q, opts, expr, qs, ts, e.logicalOptimizers)
+}
+
+// NewInstantQueryFromPlan creates an instant query which executes the given logical plan, for example
+// a plan decoded with logicalplan.Unmarshal. Only the logical optimizers of the engine which can be
+// applied to an already optimized plan are run, see planOptimizers.
+func (e *compatibilityEngine) NewInstantQueryFromPlan(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, root parser.Expr, ts time.Time) (promql.Query, error) {
+	return e.newInstantQuery(ctx, q, opts, root, root.String(), ts, e.planOptimizers())
+}
 
+func (e *compatibilityEngine) newInstantQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, expr parser.Expr, qs string, ts time.Time, optimizers []logicalplan.Optimizer) (promql.Query, error) {
+	engineOpts := engineQueryOpts(opts)
+	parallelism := e.queryParallelism(engineOpts)
 	if opts == nil {
 		opts = promql.NewPrometheusQueryOpts(false, e.lookbackDelta)
 	}
@@ -215,28 +371,35 @@ func (e *compatibilityEngine) NewInstantQuery(ctx context.Context, q storage.Que
 		EnableAnalysis:           e.enableAnalysis,
 		EnableSubqueries:         e.enableSubqueries,
 		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
+		MemoryTracker:            limits.NewMemoryTracker(e.memoryLimitBytes),
+		Parallelism:              parallelism,
+		Tracer:                   e.tracer,
 	}
+	qOpts.SampleTracker = query.NewSampleTracker(qOpts.Start, qOpts.End, qOpts.Step)
 
-	lplan, warns := logicalplan.New(expr, qOpts).Optimize(e.logicalOptimizers)
+	lplan, warns := e.newLogicalPlan(expr, qOpts).Optimize(optimizers)
 	exec, err := execution.New(lplan.Expr(), q, qOpts)
 	if e.triggerFallback(err) {
-		e.metrics.queries.WithLabelValues("true").Inc()
-		return e.prom.NewInstantQuery(ctx, q, opts, qs, ts)
+		return e.fallback(err, queryParams{query: qs, start: ts, end: ts}, engineOpts, func() (promql.Query, error) {
+			return e.prom.NewInstantQuery(ctx, q, opts, qs, ts)
+		})
 	}
 	e.metrics.queries.WithLabelValues("false").Inc()
 	if err != nil {
 		return nil, err
 	}
 
-	return &compatibilityQuery{
-		Query:      &Query{exec: exec, opts: opts},
+	return e.streamable(&compatibilityQuery{
+		Query:      newQuery(lplan, exec, opts, qOpts),
 		engine:     e,
 		expr:       expr,
 		ts:         ts,
+		params:     queryParams{query: qs, start: ts, end: ts},
 		warns:      warns,
 		t:          InstantQuery,
 		resultSort: resultSort,
-	}, nil
+		priority:   engineOpts.Priority,
+	}), nil
 }
 
 func (e *compatibilityEngine) NewRangeQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, qs string, start, end time.Time, step time.Duration) (promql.Query, error) {
@@ -244,12 +407,47 @@ func (e *compatibilityEngine) NewRangeQuery(ctx context.Context, q storage.Query
 	if err != nil {
 		return nil, err
 	}
+	return e.newRangeQuery(ctx, q, opts, expr, qs, start, end, step, e.logicalOptimizers)
+}
+
+// NewRangeQueryFromPlan creates a range query which executes the given logical plan, for example
+// a plan decoded with logicalplan.Unmarshal. Only the logical optimizers of the engine which can be
+// applied to an already optimized plan are run, see planOptimizers.
+func (e *compatibilityEngine) NewRangeQueryFromPlan(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, root parser.Expr, start, end time.Time, step time.Duration) (promql.Query, error) {
+	return e.newRangeQuery(ctx, q, opts, root, root.String(), start, end, step, e.planOptimizers())
+}
+
+// newLogicalPlan creates the logical plan of a query. The plan is only traced when analysis is enabled
+// since tracing renders the whole plan before and after each optimizer.
+func (e *compatibilityEngine) newLogicalPlan(expr parser.Expr, opts *query.Options) logicalplan.Plan {
+	if e.traceOptimizers {
+		return logicalplan.NewTraced(expr, opts)
+	}
+	return logicalplan.New(expr, opts)
+}
+
+// planOptimizers returns the logical optimizers of the engine which can be run again on a plan
+// that was already optimized by another engine. Distributed optimizers are skipped since they
+// would distribute the plan a second time.
+func (e *compatibilityEngine) planOptimizers() []logicalplan.Optimizer {
+	optimizers := make([]logicalplan.Optimizer, 0, len(e.logicalOptimizers))
+	for _, o := range e.logicalOptimizers {
+		switch o.(type) {
+		case logicalplan.SortMatchers, logicalplan.MergeSelectsOptimizer, logicalplan.PropagateMatchersOptimizer:
+			optimizers = append(optimizers, o)
+		}
+	}
+	return optimizers
+}
 
+func (e *compatibilityEngine) newRangeQuery(ctx context.Context, q storage.Queryable, opts promql.QueryOpts, expr parser.Expr, qs string, start, end time.Time, step time.Duration, optimizers []logicalplan.Optimizer) (promql.Query, error) {
 	// Use same check as Prometheus for range queries.
 	if expr.Type() != parser.ValueTypeVector && expr.Type() != parser.ValueTypeScalar {
 		return nil, errors.Newf("invalid expression type %q for range query, must be Scalar or instant Vector", parser.DocumentedType(expr.Type()))
 	}
 
+	engineOpts := engineQueryOpts(opts)
+	parallelism := e.queryParallelism(engineOpts)
 	if opts == nil {
 		opts = promql.NewPrometheusQueryOpts(false, e.lookbackDelta)
 	}
@@ -266,41 +464,78 @@ func (e *compatibilityEngine) NewRangeQuery(ctx context.Context, q storage.Query
 		LookbackDelta:            opts.LookbackDelta(),
 		ExtLookbackDelta:         e.extLookbackDelta,
 		EnableAnalysis:           e.enableAnalysis,
-		EnableSubqueries:         false, // not yet implemented for range queries.
+		EnableSubqueries:         e.enableSubqueries,
 		NoStepSubqueryIntervalFn: e.noStepSubqueryIntervalFn,
+		MemoryTracker:            limits.NewMemoryTracker(e.memoryLimitBytes),
+		Parallelism:              parallelism,
+		Tracer:                   e.tracer,
 	}
+	qOpts.SampleTracker = query.NewSampleTracker(qOpts.Start, qOpts.End, qOpts.Step)
 
-	lplan, warns := logicalplan.New(expr, qOpts).Optimize(e.logicalOptimizers)
+	lplan, warns := e.newLogicalPlan(expr, qOpts).Optimize(optimizers)
 	exec, err := execution.New(lplan.Expr(), q, qOpts)
 	if e.triggerFallback(err) {
-		e.metrics.queries.WithLabelValues("true").Inc()
-		return e.prom.NewRangeQuery(ctx, q, opts, qs, start, end, step)
+		return e.fallback(err, queryParams{query: qs, start: start, end: end, step: step}, engineOpts, func() (promql.Query, error) {
+			return e.prom.NewRangeQuery(ctx, q, opts, qs, start, end, step)
+		})
 	}
 	e.metrics.queries.WithLabelValues("false").Inc()
 	if err != nil {
 		return nil, err
 	}
 
-	return &compatibilityQuery{
-		Query:  &Query{exec: exec, opts: opts},
-		engine: e,
-		expr:   expr,
-		warns:  warns,
-		t:      RangeQuery,
-	}, nil
+	return e.streamable(&compatibilityQuery{
+		Query:    newQuery(lplan, exec, opts, qOpts),
+		engine:   e,
+		expr:     expr,
+		params:   queryParams{query: qs, start: start, end: end, step: step},
+		warns:    warns,
+		t:        RangeQuery,
+		priority: engineOpts.Priority,
+	}), nil
 }
 
 type Query struct {
+	plan logicalplan.Plan
 	exec model.VectorOperator
 	opts promql.QueryOpts
+
+	enableAnalysis bool
+
+	memoryTracker *limits.MemoryTracker
+	sampleTracker *query.SampleTracker
+	timers        *stats.QueryTimers
+}
+
+func newQuery(plan logicalplan.Plan, exec model.VectorOperator, opts promql.QueryOpts, qOpts *query.Options) *Query {
+	return &Query{
+		plan:           plan,
+		exec:           exec,
+		opts:           opts,
+		enableAnalysis: qOpts.EnableAnalysis,
+		memoryTracker:  qOpts.MemoryTracker,
+		sampleTracker:  qOpts.SampleTracker,
+		timers:         stats.NewQueryTimers(),
+	}
+}
+
+// RootOperator returns the root of the operators the query is executed with.
+// It allows remote executions to embed the operators of remote queries into distributed plans.
+func (q *Query) RootOperator() model.VectorOperator {
+	return q.exec
 }
 
 // Explain returns human-readable explanation of the created executor.
+// The logical plan the executor was created from is explained by ExplainLogicalPlan.
 func (q *Query) Explain() *ExplainOutputNode {
-	// TODO(bwplotka): Explain plan and steps.
 	return explainVector(q.exec)
 }
 
+// ExplainLogicalPlan returns the logical plan of the query and how it was changed by each optimizer.
+func (q *Query) ExplainLogicalPlan() *LogicalPlanOutput {
+	return explainLogicalPlan(q.plan)
+}
+
 func (q *Query) Analyze() *AnalyzeOutputNode {
 	if observableRoot, ok := q.exec.(model.ObservableVectorOperator); ok {
 		return analyzeVector(observableRoot)
@@ -308,23 +543,30 @@ func (q *Query) Analyze() *AnalyzeOutputNode {
 	return nil
 }
 
+// ExplainAnalyze returns the operators of the query merged with the telemetry they
+// collected during execution. Telemetry is only available when analysis is enabled
+// in the engine and after the query was executed.
+func (q *Query) ExplainAnalyze() *ExplainAnalyzeNode {
+	return explainAnalyze(q.exec, q.enableAnalysis)
+}
+
 type compatibilityQuery struct {
 	*Query
 	engine *compatibilityEngine
 	expr   parser.Expr
 	ts     time.Time // Empty for range queries.
+	params queryParams
 	warns  annotations.Annotations
 
 	t          QueryType
 	resultSort resultSorter
 	cancel     context.CancelFunc
+	priority   int
 }
 
 func (q *compatibilityQuery) Exec(ctx context.Context) (ret *promql.Result) {
-	ctx = warnings.NewContext(ctx)
-	defer func() {
-		ret.Warnings = ret.Warnings.Merge(warnings.FromContext(ctx))
-	}()
+	ctx, run := q.start(ctx)
+	defer func() { run.finish(ret) }()
 
 	// Handle case with strings early on as this does not need us to process samples.
 	switch e := q.expr.(type) {
@@ -337,22 +579,27 @@ func (q *compatibilityQuery) Exec(ctx context.Context) (ret *promql.Result) {
 	}
 	defer recoverEngine(q.engine.logger, q.expr, &ret.Err)
 
-	q.engine.metrics.currentQueries.Inc()
-	defer q.engine.metrics.currentQueries.Dec()
-
-	ctx, cancel := context.WithTimeout(ctx, q.engine.timeout)
-	defer cancel()
-	q.cancel = cancel
+	ctx, err := q.admit(ctx, run)
+	if err != nil {
+		return newErrResult(ret, err)
+	}
 
+	prepareSpanTimer, _ := q.timers.GetSpanTimer(ctx, stats.QueryPreparationTime)
 	resultSeries, err := q.Query.exec.Series(ctx)
+	prepareSpanTimer.Finish()
 	if err != nil {
 		return newErrResult(ret, err)
 	}
+	if err := q.Query.memoryTracker.Err(); err != nil {
+		return newErrResult(ret, err)
+	}
 
 	series := make([]promql.Series, len(resultSeries))
 	for i, s := range resultSeries {
 		series[i].Metric = s
 	}
+
+	innerEvalSpanTimer, _ := q.timers.GetSpanTimer(ctx, stats.InnerEvalTime)
 loop:
 	for {
 		select {
@@ -363,6 +610,10 @@ loop:
 			if err != nil {
 				return newErrResult(ret, err)
 			}
+			// Buffers are allocated from pools which cannot fail, so we check the limit after each batch.
+			if err := q.Query.memoryTracker.Err(); err != nil {
+				return newErrResult(ret, err)
+			}
 			if r == nil {
 				break loop
 			}
@@ -397,6 +648,10 @@ loop:
 			q.Query.exec.GetPool().PutVectors(r)
 		}
 	}
+	innerEvalSpanTimer.Finish()
+
+	sortSpanTimer, _ := q.timers.GetSpanTimer(ctx, stats.ResultSortTime)
+	defer sortSpanTimer.Finish()
 
 	// For range Query we expect always a Matrix value type.
 	if q.t == RangeQuery {
@@ -465,6 +720,85 @@ loop:
 	return ret
 }
 
+// queryRun holds the functions which finish the execution of a query.
+// The execution of a query is set up the same way by Exec and Stream.
+type queryRun struct {
+	deferred []func(res *promql.Result)
+}
+
+func (r *queryRun) onFinish(f func(res *promql.Result)) {
+	r.deferred = append(r.deferred, f)
+}
+
+// finish calls the functions registered with onFinish in reverse order, same as deferred calls.
+func (r *queryRun) finish(res *promql.Result) {
+	for i := len(r.deferred) - 1; i >= 0; i-- {
+		r.deferred[i](res)
+	}
+	r.deferred = nil
+}
+
+// start sets up the logging, annotations and tracing of the execution of the query.
+// The returned run has to be finished with the result of the query.
+func (q *compatibilityQuery) start(ctx context.Context) (context.Context, *queryRun) {
+	run := &queryRun{}
+	logCtx := ctx
+	run.onFinish(func(res *promql.Result) {
+		q.engine.logQuery(logCtx, q.params, res, q.Stats(), "")
+	})
+
+	ctx = warnings.NewContext(ctx)
+	warnCtx := ctx
+	run.onFinish(func(res *promql.Result) {
+		res.Warnings = res.Warnings.Merge(warnings.FromContext(warnCtx))
+	})
+
+	if q.engine.tracer != nil {
+		var span tracing.Span
+		ctx, span = q.engine.tracer.Start(ctx, "query")
+		span.SetAttribute("query", q.String())
+		run.onFinish(func(res *promql.Result) {
+			if res.Err != nil {
+				span.RecordError(res.Err)
+			}
+			span.End()
+		})
+	}
+	return ctx, run
+}
+
+// admit starts the timers of the query and waits until it is admitted by the query queue.
+// The operators of the query have to be evaluated with the returned context.
+func (q *compatibilityQuery) admit(ctx context.Context, run *queryRun) (context.Context, error) {
+	execSpanTimer, ctx := q.timers.GetSpanTimer(ctx, stats.ExecTotalTime)
+	run.onFinish(func(*promql.Result) { execSpanTimer.Finish() })
+
+	q.engine.metrics.currentQueries.Inc()
+	run.onFinish(func(*promql.Result) { q.engine.metrics.currentQueries.Dec() })
+
+	// The timeout includes the time spent in the queue, same as in Prometheus.
+	ctx, cancel := context.WithTimeout(ctx, q.engine.timeout)
+	run.onFinish(func(*promql.Result) { cancel() })
+	q.cancel = cancel
+
+	queueSpanTimer, _ := q.timers.GetSpanTimer(ctx, stats.ExecQueueTime, q.engine.metrics.queueDuration)
+	release, err := q.engine.queue.acquire(ctx, q.priority)
+	queueSpanTimer.Finish()
+	if err != nil {
+		return nil, errors.Wrap(err, "waiting in query queue")
+	}
+	run.onFinish(func(*promql.Result) { release() })
+	if m := q.engine.operatorMetrics; m != nil {
+		if root, ok := q.exec.(model.ObservableVectorOperator); ok {
+			run.onFinish(func(*promql.Result) { m.observe(root) })
+		}
+	}
+
+	evalSpanTimer, ctx := q.timers.GetSpanTimer(ctx, stats.EvalTotalTime)
+	run.onFinish(func(*promql.Result) { evalSpanTimer.Finish() })
+	return ctx, nil
+}
+
 func newErrResult(r *promql.Result, err error) *promql.Result {
 	if r == nil {
 		r = &promql.Result{}
@@ -477,13 +811,14 @@ func newErrResult(r *promql.Result, err error) *promql.Result {
 
 func (q *compatibilityQuery) Statement() parser.Statement { return nil }
 
-// Stats always returns empty query stats for now to avoid panic.
+// Stats returns the timers and the samples loaded by the query. Unlike in Prometheus, the peak
+// samples are the highest number of samples loaded for a single step.
 func (q *compatibilityQuery) Stats() *stats.Statistics {
 	var enablePerStepStats bool
 	if q.opts != nil {
 		enablePerStepStats = q.opts.EnablePerStepStats()
 	}
-	return &stats.Statistics{Timers: stats.NewQueryTimers(), Samples: stats.NewQuerySamples(enablePerStepStats)}
+	return &stats.Statistics{Timers: q.timers, Samples: q.sampleTracker.QuerySamples(enablePerStepStats)}
 }
 
 func (q *compatibilityQuery) Close() { q.Cancel() }
@@ -505,6 +840,67 @@ func (e *compatibilityEngine) triggerFallback(err error) bool {
 	return errors.Is(err, parse.ErrNotSupportedExpr) || errors.Is(err, parse.ErrNotImplemented)
 }
 
+// fallback creates the query with the fallback engine and records the reason why
+// the query could not be executed by this engine.
+func (e *compatibilityEngine) fallback(err error, params queryParams, engineOpts QueryOpts, newQuery func() (promql.Query, error)) (promql.Query, error) {
+	reason := parse.Reason(err)
+	e.metrics.queries.WithLabelValues("true").Inc()
+	e.metrics.fallbacks.WithLabelValues(reason).Inc()
+	level.Debug(e.logger).Log("msg", "falling back to prometheus engine", "reason", reason, "query", params.query, "err", err)
+
+	qry, err := newQuery()
+	if err != nil {
+		return nil, err
+	}
+	return &fallbackQuery{
+		Query:    qry,
+		engine:   e,
+		params:   params,
+		reason:   reason,
+		report:   engineOpts.ReportFallback,
+		priority: engineOpts.Priority,
+	}, nil
+}
+
+// fallbackQuery is a query executed by the fallback engine. It waits in the query queue of this
+// engine, logs the query to the query log of this engine and optionally reports the reason of the
+// fallback in its annotations.
+type fallbackQuery struct {
+	promql.Query
+	engine   *compatibilityEngine
+	params   queryParams
+	reason   string
+	report   bool
+	priority int
+}
+
+func (q *fallbackQuery) Exec(ctx context.Context) *promql.Result {
+	res := q.exec(ctx)
+	if q.report {
+		res.Warnings = res.Warnings.Add(errors.Newf("%s: query was executed by the fallback engine: %s", annotations.PromQLInfo.Error(), q.reason))
+	}
+	q.engine.logQuery(ctx, q.params, res, q.Stats(), q.reason)
+	return res
+}
+
+func (q *fallbackQuery) exec(ctx context.Context) *promql.Result {
+	q.engine.metrics.currentQueries.Inc()
+	defer q.engine.metrics.currentQueries.Dec()
+
+	// The timeout includes the time spent in the queue, same as for queries executed by this engine.
+	ctx, cancel := context.WithTimeout(ctx, q.engine.timeout)
+	defer cancel()
+
+	start := time.Now()
+	release, err := q.engine.queue.acquire(ctx, q.priority)
+	q.engine.metrics.queueDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return &promql.Result{Err: errors.Wrap(err, "waiting in query queue")}
+	}
+	defer release()
+	return q.Query.Exec(ctx)
+}
+
 func recoverEngine(logger log.Logger, expr parser.Expr, errp *error) {
 	e := recover()
 	if e == nil {
@@ -18,8 +18,6 @@ import (
 	"testing"
 	"time"
 
-	"github.com/stretchr/testify/require"
-
 	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
 	"go.uber.org/goleak"
@@ -28,9 +26,12 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 
+	"github.com/thanos-io/promql-engine/api"
 	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/execution/limits"
 	"github.com/thanos-io/promql-engine/logicalplan"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/timestamp"
@@ -105,10 +106,11 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 	// Negative offset and at modifier are enabled by default
 	// since Prometheus v2.33.0 so we also enable them.
 	opts := promql.EngineOpts{
-		Timeout:              1 * time.Hour,
-		MaxSamples:           1e10,
-		EnableNegativeOffset: true,
-		EnableAtModifier:     true,
+		Timeout:                  1 * time.Hour,
+		MaxSamples:               1e10,
+		EnableNegativeOffset:     true,
+		EnableAtModifier:         true,
+		NoStepSubqueryIntervalFn: func(rangeMillis int64) int64 { return 30 * time.Second.Milliseconds() },
 	}
 
 	cases := []struct {
@@ -119,6 +121,48 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 		end   time.Time
 		step  time.Duration
 	}{
+		{
+			name: "max_over_time with subquery",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x30 _x5 1+2x5`,
+			query: `max_over_time(rate(http_requests_total[1m])[5m:])`,
+		},
+		{
+			name: "sum_over_time with subquery with step smaller than query step",
+			load: `load 10s
+				http_requests_total{pod="nginx-1"} 1+1x200
+				http_requests_total{pod="nginx-2"} 1+2x150`,
+			query: `sum_over_time(http_requests_total[2m:10s])`,
+		},
+		{
+			name: "sum_over_time with subquery with step larger than query step",
+			load: `load 10s
+				http_requests_total{pod="nginx-1"} 1+1x200
+				http_requests_total{pod="nginx-2"} 1+2x150`,
+			query: `sum_over_time(http_requests_total[10m:2m])`,
+		},
+		{
+			name: "quantile_over_time with subquery and offset",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: `quantile_over_time(0.9, sum by (pod) (http_requests_total)[3m:1m] offset 1m)`,
+		},
+		{
+			name: "nested subqueries",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: `avg_over_time(max_over_time(http_requests_total[2m:30s])[5m:1m])`,
+		},
+		{
+			name: "subquery with @ modifier",
+			load: `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x40`,
+			query: `count_over_time(http_requests_total[5m:1m] @ 600)`,
+		},
 		{
 			name:  "nested unary negation",
 			query: "1/(-(2*2))",
@@ -188,6 +232,29 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 					http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: "quantile_over_time(0.9, http_requests_total[1m])",
 		},
+		{
+			name: "quantile_over_time with non-constant argument",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18
+					quantile 0.1+0.05x15`,
+			query: "quantile_over_time(scalar(quantile), http_requests_total[1m])",
+		},
+		{
+			name: "quantile_over_time with missing argument",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18
+					quantile 0.5x5`,
+			query: "quantile_over_time(scalar(quantile), http_requests_total[1m])",
+		},
+		{
+			name: "quantile_over_time with expression argument",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x18`,
+			query: "quantile_over_time(scalar(count(http_requests_total)) / 4, http_requests_total[2m])",
+		},
 		{
 			name: "changes",
 			load: `load 30s
@@ -208,6 +275,118 @@ func TestQueriesAgainstOldEngine(t *testing.T) {
 					http_requests_total{pod="nginx-2"} 1+2x18`,
 			query: "deriv(http_requests_total[30s])",
 		},
+		{
+			name: "timestamp",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 _ _ 20+1x10`,
+			query: "timestamp(http_requests_total)",
+		},
+		{
+			name: "timestamp with offset",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 _ _ 20+1x10`,
+			query: "timestamp(http_requests_total offset 2m)",
+		},
+		{
+			name: "timestamp with @ modifier",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 _ _ 20+1x10`,
+			query: "timestamp(http_requests_total @ 100)",
+		},
+		{
+			name: "timestamp with @ modifier in parentheses",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 _ _ 20+1x10`,
+			query: "timestamp((http_requests_total @ end()))",
+		},
+		{
+			name: "timestamp for staleness detection",
+			load: `load 30s
+					up{pod="nginx-1"} 1+0x15
+					up{pod="nginx-2"} 1+0x4 _ _ _ _ _ _ _ _ _ _ _ 1+0x5`,
+			query: "time() - timestamp(up) > 100",
+		},
+		{
+			name: "timestamp of aggregation",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 _ _ 20+1x10`,
+			query: "timestamp(sum by (pod) (http_requests_total))",
+		},
+		{
+			name: "timestamp of function",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 _ _ 20+1x10`,
+			query: "timestamp(rate(http_requests_total[1m]))",
+		},
+		{
+			name: "predict_linear",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20`,
+			query: "predict_linear(http_requests_total[2m], 60)",
+		},
+		{
+			name: "predict_linear with offset",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20`,
+			query: "predict_linear(http_requests_total[2m] offset 1m, -120)",
+		},
+		{
+			name: "predict_linear with non-constant argument",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20
+					duration 0+10x40`,
+			query: "predict_linear(http_requests_total[2m], scalar(duration))",
+		},
+		{
+			name: "predict_linear over subquery",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20`,
+			query: "predict_linear(sum(http_requests_total)[3m:30s], 3600)",
+		},
+		{
+			name: "holt_winters",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20`,
+			query: "holt_winters(http_requests_total[5m], 0.5, 0.1)",
+		},
+		{
+			name: "holt_winters with non-constant arguments",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20
+					factor 0.1+0.01x40`,
+			query: "holt_winters(http_requests_total[5m], scalar(factor), 1 - scalar(factor))",
+		},
+		{
+			name: "holt_winters over subquery",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15
+					http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20`,
+			query: "holt_winters(rate(http_requests_total[1m])[5m:30s], 0.3, 0.6)",
+		},
+		{
+			name: "holt_winters with invalid smoothing factor",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: "holt_winters(http_requests_total[5m], 1, 0.1)",
+		},
+		{
+			name: "holt_winters with invalid trend factor",
+			load: `load 30s
+					http_requests_total{pod="nginx-1"} 1+1x15`,
+			query: "holt_winters(http_requests_total[5m], 0.5, 0)",
+		},
 		{
 			name: "abs",
 			load: `load 30s
@@ -1504,6 +1683,33 @@ load 30s
 			http_requests_total{pod="nginx-2", le="+Inf"} 4+1x10`,
 			query: `histogram_quantile(scalar(max(quantile)), http_requests_total)`,
 		},
+		{
+			name: "count_values",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+1x40
+				http_requests_total{pod="nginx-3", series="2"} 1+2x20
+				http_requests_total{pod="nginx-4", series="2"} 5+0.5x40`,
+			query: `count_values("value", http_requests_total)`,
+		},
+		{
+			name: "count_values by",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+1x40
+				http_requests_total{pod="nginx-3", series="2"} 1+2x20
+				http_requests_total{pod="nginx-4", series="2"} 5+0.5x40`,
+			query: `count_values by (series) ("value", http_requests_total)`,
+		},
+		{
+			name: "count_values without",
+			load: `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1x40
+				http_requests_total{pod="nginx-2", series="1"} 2+1x40
+				http_requests_total{pod="nginx-3", series="2"} 1+2x20
+				http_requests_total{pod="nginx-4", series="2"} 5+0.5x40`,
+			query: `count_values without (pod) ("pod", http_requests_total)`,
+		},
 		{
 			name: "topk",
 			load: `load 30s
@@ -1809,6 +2015,7 @@ load 30s
 									EngineOpts:        opts,
 									DisableFallback:   disableFallback,
 									LogicalOptimizers: optimizers,
+									EnableSubqueries:  true,
 									// Set to 1 to make sure batching is tested.
 									SelectorBatchSize: 1,
 								})
@@ -2045,10 +2252,6 @@ func TestDisabledXFunction(t *testing.T) {
 }
 
 func TestXFunctionsWithNativeHistograms(t *testing.T) {
-	defaultQueryTime := time.Unix(50, 0)
-
-	expr := "sum(xincrease(native_histogram_series[50s]))"
-
 	// Negative offset and at modifier are enabled by default
 	// since Prometheus v2.33.0, so we also enable them.
 	opts := promql.EngineOpts{
@@ -2058,28 +2261,55 @@ func TestXFunctionsWithNativeHistograms(t *testing.T) {
 		EnableAtModifier:     true,
 	}
 
+	// Extended functions are linear, so applying them to a histogram has to give the same
+	// count and sum as applying them to floats series with the count and sum of the histogram.
 	lStorage := teststorage.New(t)
 	defer lStorage.Close()
 
 	app := lStorage.Appender(context.TODO())
-	testutil.Ok(t, generateFloatHistogramSeries(app, 3000, false))
+	for i := 0; i < 40; i++ {
+		// Reset the counter in the middle of the series.
+		h := tsdbutil.GenerateTestFloatHistogram(i % 25)
+		ts := time.Unix(int64(i*15), 0).UnixMilli()
+		_, err := app.AppendHistogram(0, labels.FromStrings(labels.MetricName, "native_histogram_series", "foo", "bar"), ts, nil, h)
+		testutil.Ok(t, err)
+		_, err = app.Append(0, labels.FromStrings(labels.MetricName, "native_histogram_count", "foo", "bar"), ts, h.Count)
+		testutil.Ok(t, err)
+		_, err = app.Append(0, labels.FromStrings(labels.MetricName, "native_histogram_sum", "foo", "bar"), ts, h.Sum)
+		testutil.Ok(t, err)
+	}
 	testutil.Ok(t, app.Commit())
 
-	optimizers := logicalplan.AllOptimizers
-
-	ctx := context.Background()
 	newEngine := engine.New(engine.Opts{
-		EngineOpts:        opts,
-		DisableFallback:   true,
-		LogicalOptimizers: optimizers,
-		EnableXFunctions:  true,
+		EngineOpts:       opts,
+		DisableFallback:  true,
+		EnableXFunctions: true,
 	})
-	query, err := newEngine.NewInstantQuery(ctx, lStorage, nil, expr, defaultQueryTime)
-	testutil.Ok(t, err)
-	defer query.Close()
+	ctx := context.Background()
+	exec := func(t *testing.T, query string) promql.Matrix {
+		q, err := newEngine.NewRangeQuery(ctx, lStorage, nil, query, time.Unix(0, 0), time.Unix(700, 0), 10*time.Second)
+		testutil.Ok(t, err)
+		defer q.Close()
 
-	engineResult := query.Exec(ctx)
-	require.Error(t, engineResult.Err)
+		res := q.Exec(ctx)
+		testutil.Ok(t, res.Err)
+		m, err := res.Matrix()
+		testutil.Ok(t, err)
+		return m
+	}
+
+	for _, fn := range []string{"xrate", "xincrease", "xdelta"} {
+		for _, r := range []string{"10s", "30s", "1m", "5m"} {
+			t.Run(fmt.Sprintf("%s[%s]", fn, r), func(t *testing.T) {
+				for _, field := range []string{"count", "sum"} {
+					histogramResult := exec(t, fmt.Sprintf("histogram_%s(%s(native_histogram_series[%s]))", field, fn, r))
+					floatResult := exec(t, fmt.Sprintf("%s(native_histogram_%s[%s])", fn, field, r))
+					testutil.Assert(t, len(floatResult) > 0, "expected non-empty result")
+					testutil.WithGoCmp(comparer).Equals(t, &promql.Result{Value: floatResult}, &promql.Result{Value: histogramResult})
+				}
+			})
+		}
+	}
 }
 
 func TestXFunctionsWhenDisabled(t *testing.T) {
@@ -3035,6 +3265,74 @@ min without () (
 			queryTime: time.Unix(160, 0),
 			query:     `label_replace(http_requests_total, "foo", "$1", "bar", ".*")`,
 		},
+		{
+			name: "timestamp",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x8 _ _ 20+1x10`,
+			query: "timestamp(http_requests_total)",
+		},
+		{
+			name: "timestamp with @ modifier and offset",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x8 _ _ 20+1x10`,
+			query: "timestamp(http_requests_total @ 200 offset 1m)",
+		},
+		{
+			name: "predict_linear",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20`,
+			query: "predict_linear(http_requests_total[2m], 300)",
+		},
+		{
+			name: "holt_winters",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x8 20 15 30+3x20`,
+			query: "holt_winters(http_requests_total[5m], 0.5, 0.5)",
+		},
+		{
+			name: "quantile_over_time with non-constant argument",
+			load: `load 30s
+						http_requests_total{pod="nginx-1"} 1+1x15
+						http_requests_total{pod="nginx-2"} 1+2x18
+						quantile 0.1+0.05x15`,
+			query: "quantile_over_time(scalar(quantile), http_requests_total[2m])",
+		},
+		{
+			name: "count_values",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="2"} 2
+						http_requests_total{pod="nginx-4", series="2"} 1.5`,
+			query: `count_values("value", http_requests_total)`,
+		},
+		{
+			name: "count_values by",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="2"} 2
+						http_requests_total{pod="nginx-4", series="2"} 1.5`,
+			query: `count_values by (series) ("value", http_requests_total)`,
+		},
+		{
+			name: "count_values overriding an existing label",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1
+						http_requests_total{pod="nginx-2", series="1"} 2
+						http_requests_total{pod="nginx-3", series="2"} 2`,
+			query: `count_values without (pod) ("series", http_requests_total)`,
+		},
+		{
+			name: "count_values with invalid label name",
+			load: `load 30s
+						http_requests_total{pod="nginx-1", series="1"} 1`,
+			query: `count_values("invalid-label", http_requests_total)`,
+		},
 		{
 			name: "topk",
 			load: `load 30s
@@ -4176,17 +4474,19 @@ func TestFallback(t *testing.T) {
 	step := time.Second * 30
 
 	cases := []struct {
-		name  string
-		query string
+		name   string
+		query  string
+		reason string
 	}{
 		{
-			// TODO(fpetkovski): Update this expression once we add support for predict_linear.
-			name:  "unsupported function",
-			query: `predict_linear(http_requests_total{pod="nginx-1"}[5m], 10)`,
+			name:   "unsupported function",
+			query:  `histogram_stddev(http_requests_total)`,
+			reason: "function histogram_stddev",
 		},
 		{
-			name:  "unsupported function with scalar",
-			query: `quantile_over_time(scalar(sum(http_requests_total)), http_requests_total[2m])`,
+			name:   "subquery",
+			query:  `max_over_time(http_requests_total[1m:30s])`,
+			reason: "subquery",
 		},
 	}
 
@@ -4204,48 +4504,545 @@ func TestFallback(t *testing.T) {
 					opts := promql.EngineOpts{
 						Timeout:    2 * time.Second,
 						MaxSamples: math.MaxInt64,
+						Reg:        prometheus.NewRegistry(),
 					}
 					newEngine := engine.New(engine.Opts{DisableFallback: disableFallback, EngineOpts: opts})
 					q1, err := newEngine.NewRangeQuery(context.Background(), storage, nil, tcase.query, start, end, step)
 					if disableFallback {
 						testutil.NotOk(t, err)
-					} else {
-						testutil.Ok(t, err)
-						newResult := q1.Exec(context.Background())
-						testutil.Ok(t, newResult.Err)
+						return
 					}
+					testutil.Ok(t, err)
+					newResult := q1.Exec(context.Background())
+					testutil.Ok(t, newResult.Err)
+					testutil.Equals(t, 0, len(newResult.Warnings))
+
+					q2, err := newEngine.NewInstantQuery(context.Background(), storage, engine.QueryOpts{ReportFallback: true}, tcase.query, end)
+					testutil.Ok(t, err)
+					newResult = q2.Exec(context.Background())
+					testutil.Ok(t, newResult.Err)
+					testutil.Equals(t, []string{"PromQL info: query was executed by the fallback engine: " + tcase.reason}, newResult.Warnings.AsStrings("", 0))
+
+					metrics, err := opts.Reg.(*prometheus.Registry).Gather()
+					testutil.Ok(t, err)
+					var reasons []string
+					for _, m := range metrics {
+						if m.GetName() != "thanos_engine_fallback_queries_total" {
+							continue
+						}
+						for _, metric := range m.GetMetric() {
+							testutil.Equals(t, 2.0, metric.GetCounter().GetValue())
+							for _, l := range metric.GetLabel() {
+								reasons = append(reasons, l.GetValue())
+							}
+						}
+					}
+					testutil.Equals(t, []string{tcase.reason}, reasons)
 				})
 			}
 		})
 	}
 }
 
+type testQueryLogger struct {
+	entries []map[string]interface{}
+	closed  bool
+}
+
+func (l *testQueryLogger) Log(kv ...interface{}) error {
+	entry := make(map[string]interface{}, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		entry[kv[i].(string)] = kv[i+1]
+	}
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+func (l *testQueryLogger) Close() error {
+	l.closed = true
+	return nil
+}
+
+func TestQueryLogger(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x4
+				http_requests_total{pod="nginx-2"} 1+2x2`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 2 * time.Second, MaxSamples: math.MaxInt64}
+	ng := engine.New(engine.Opts{EngineOpts: opts})
+	logger := &testQueryLogger{}
+	ng.SetQueryLogger(logger)
+
+	ctx := context.WithValue(context.Background(), promql.QueryOrigin{}, map[string]interface{}{"origin": "test"})
+	q, err := ng.NewRangeQuery(ctx, storage, nil, `sum(http_requests_total)`, time.Unix(0, 0), time.Unix(120, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	testutil.Ok(t, q.Exec(ctx).Err)
+
+	q, err = ng.NewInstantQuery(ctx, storage, nil, `histogram_stddev(http_requests_total)`, time.Unix(60, 0))
+	testutil.Ok(t, err)
+	testutil.Ok(t, q.Exec(ctx).Err)
+
+	testutil.Equals(t, 2, len(logger.entries))
+
+	entry := logger.entries[0]
+	testutil.Equals(t, map[string]interface{}{
+		"query": `sum(http_requests_total)`,
+		"start": "1970-01-01T00:00:00.000Z",
+		"end":   "1970-01-01T00:02:00.000Z",
+		"step":  int64(30),
+	}, entry["params"])
+	testutil.Equals(t, false, entry["fallback"])
+	testutil.Equals(t, "test", entry["origin"])
+	queryStats, ok := entry["stats"].(stats.QueryStats)
+	testutil.Assert(t, ok, "expected query stats in log entry")
+	testutil.Equals(t, int64(10), queryStats.Builtin().Samples.TotalQueryableSamples)
+	_, ok = entry["error"]
+	testutil.Assert(t, !ok, "unexpected error in log entry")
+
+	entry = logger.entries[1]
+	testutil.Equals(t, map[string]interface{}{
+		"query": `histogram_stddev(http_requests_total)`,
+		"start": "1970-01-01T00:01:00.000Z",
+		"end":   "1970-01-01T00:01:00.000Z",
+		"step":  int64(0),
+	}, entry["params"])
+	testutil.Equals(t, true, entry["fallback"])
+	testutil.Equals(t, "function histogram_stddev", entry["fallbackReason"])
+
+	ng.SetQueryLogger(nil)
+	testutil.Assert(t, logger.closed, "expected the previous logger to be closed")
+}
+
+func TestDryRun(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1", code="200"} 1+1x40
+				http_requests_total{pod="nginx-1", code="500"} 1+1x40
+				http_requests_total{pod="nginx-2", code="200"} 1+2x40
+				other_metric{pod="nginx-1"} 1+2x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := promql.EngineOpts{Timeout: 2 * time.Second, MaxSamples: math.MaxInt64}
+	ng := engine.New(engine.Opts{EngineOpts: opts, Parallelism: 2})
+	ctx := context.Background()
+
+	t.Run("range query", func(t *testing.T) {
+		estimate, err := ng.DryRunRangeQuery(ctx, storage, nil, `sum by (pod) (rate(http_requests_total[1m])) / on (pod) other_metric`, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+		testutil.Ok(t, err)
+
+		testutil.Equals(t, 1, estimate.Series)
+		testutil.Equals(t, int64(21), estimate.Steps)
+		testutil.Equals(t, int64(21), estimate.EstimatedSamples)
+
+		series, samples := estimate.Selected()
+		testutil.Equals(t, 4, series)
+		testutil.Equals(t, int64(4*21), samples)
+	})
+
+	t.Run("instant query", func(t *testing.T) {
+		estimate, err := ng.DryRunInstantQuery(ctx, storage, nil, `http_requests_total{code="200"}`, time.Unix(600, 0))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2, estimate.Series)
+		testutil.Equals(t, int64(2), estimate.EstimatedSamples)
+	})
+
+	t.Run("range selector", func(t *testing.T) {
+		opts := engine.QueryOpts{SampleInterval: 15 * time.Second}
+		estimate, err := ng.DryRunInstantQuery(ctx, storage, opts, `rate(http_requests_total[1h])`, time.Unix(600, 0))
+		testutil.Ok(t, err)
+
+		series, samples := estimate.Selected()
+		testutil.Equals(t, 3, series)
+		testutil.Equals(t, int64(3*240), samples)
+	})
+
+	t.Run("subquery", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: opts, EnableSubqueries: true})
+		estimate, err := ng.DryRunInstantQuery(ctx, storage, nil, `max_over_time(other_metric[5m:1m])`, time.Unix(600, 0))
+		testutil.Ok(t, err)
+
+		series, samples := estimate.Selected()
+		testutil.Equals(t, 1, series)
+		testutil.Equals(t, int64(6), samples)
+	})
+
+	t.Run("count_values", func(t *testing.T) {
+		_, err := ng.DryRunInstantQuery(ctx, storage, nil, `count_values("value", http_requests_total)`, time.Unix(600, 0))
+		testutil.Assert(t, errors.Is(err, engine.ErrDryRunNotSupported), "unexpected error %v", err)
+	})
+
+	t.Run("fallback query", func(t *testing.T) {
+		_, err := ng.DryRunInstantQuery(ctx, storage, nil, `histogram_stddev(http_requests_total)`, time.Unix(600, 0))
+		testutil.Assert(t, errors.Is(err, engine.ErrDryRunNotSupported), "unexpected error %v", err)
+	})
+}
+
+func TestOperatorMetrics(t *testing.T) {
+	load := `load 30s
+				http_requests_total{pod="nginx-1"} 1+1x40
+				http_requests_total{pod="nginx-2"} 1+2x40
+				http_requests_total{pod="nginx-3"} 1+3x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	// histograms returns the number of observations and their sum for each histogram series of the metric.
+	histograms := func(t *testing.T, reg *prometheus.Registry, name string) map[string][2]float64 {
+		families, err := reg.Gather()
+		testutil.Ok(t, err)
+		result := make(map[string][2]float64)
+		for _, f := range families {
+			if f.GetName() != name {
+				continue
+			}
+			for _, m := range f.GetMetric() {
+				result[m.GetLabel()[0].GetValue()] = [2]float64{float64(m.GetHistogram().GetSampleCount()), m.GetHistogram().GetSampleSum()}
+			}
+		}
+		return result
+	}
+
+	ctx := context.Background()
+	opts := promql.EngineOpts{Timeout: 2 * time.Second, MaxSamples: math.MaxInt64}
+
+	t.Run("local engine", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		opts := opts
+		opts.Reg = reg
+		ng := engine.New(engine.Opts{EngineOpts: opts, EnableOperatorMetrics: true, Parallelism: 2})
+
+		q, err := ng.NewRangeQuery(ctx, storage, nil, `sum(rate(http_requests_total[1m]))`, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		testutil.Ok(t, q.Exec(ctx).Err)
+
+		executionTimes := histograms(t, reg, "thanos_engine_operator_execution_duration_seconds")
+		for _, operator := range []string{"concurrencyOperator", "aggregate", "coalesce", "matrixSelector"} {
+			testutil.Assert(t, executionTimes[operator][0] > 0, "expected execution time for %s", operator)
+		}
+		testutil.Equals(t, map[string][2]float64{"matrixSelector": {1, 3}}, histograms(t, reg, "thanos_engine_selector_series"))
+
+		families, err := reg.Gather()
+		testutil.Ok(t, err)
+		var poolBuffers float64
+		for _, f := range families {
+			if f.GetName() == "thanos_engine_vector_pool_buffers_total" {
+				for _, m := range f.GetMetric() {
+					poolBuffers += m.GetCounter().GetValue()
+				}
+			}
+		}
+		testutil.Assert(t, poolBuffers > 0, "expected vector pool usage to be recorded")
+	})
+
+	t.Run("distributed engine", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		distOpts := opts
+		distOpts.Reg = reg
+		// The remote engine collects telemetry, so the operators of remote queries are analyzed.
+		remote := engine.NewRemoteEngine(engine.Opts{EngineOpts: opts, EnableAnalysis: true}, storage, math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")})
+		ng := engine.NewDistributedEngine(engine.Opts{EngineOpts: distOpts, EnableOperatorMetrics: true}, api.NewStaticEndpoints([]api.RemoteEngine{remote}))
+
+		q, err := ng.NewRangeQuery(ctx, nil, nil, `sum(http_requests_total)`, time.Unix(0, 0), time.Unix(600, 0), 30*time.Second)
+		testutil.Ok(t, err)
+		testutil.Ok(t, q.Exec(ctx).Err)
+
+		latencies := histograms(t, reg, "thanos_engine_remote_execution_duration_seconds")
+		testutil.Equals(t, float64(1), latencies[`{region="east"}`][0])
+		testutil.Assert(t, latencies[`{region="east"}`][1] > 0, "expected remote execution latency")
+		// Selectors of the remote query are not executed by the distributed engine.
+		testutil.Equals(t, map[string][2]float64{}, histograms(t, reg, "thanos_engine_selector_series"))
+	})
+}
+
 func TestQueryStats(t *testing.T) {
 	start := time.Unix(0, 0)
 	end := time.Unix(120, 0)
 	step := time.Second * 30
 
-	query := `http_requests_total{pod="nginx-1"}`
 	load := `load 30s
-				http_requests_total{pod="nginx-1"} 1+1x1
-				http_requests_total{pod="nginx-2"} 1+2x1`
+				http_requests_total{pod="nginx-1"} 1+1x4
+				http_requests_total{pod="nginx-2"} 1+2x2`
 	opts := promql.EngineOpts{
-		Timeout:    2 * time.Second,
-		MaxSamples: math.MaxInt64,
+		Timeout:              2 * time.Second,
+		MaxSamples:           math.MaxInt64,
+		EnablePerStepStats:   true,
+		EnableAtModifier:     true,
+		EnableNegativeOffset: true,
 	}
 
 	storage := promql.LoadedStorage(t, load)
 	defer storage.Close()
 
+	cases := []struct {
+		name  string
+		query string
+	}{
+		{name: "selector", query: `http_requests_total{pod="nginx-1"}`},
+		{name: "selector with offset", query: `http_requests_total offset 30s`},
+		{name: "range function", query: `rate(http_requests_total[1m])`},
+		{name: "aggregation", query: `sum(http_requests_total)`},
+		{name: "binary operation", query: `http_requests_total * on (pod) http_requests_total`},
+		{name: "range function with scalar argument", query: `quantile_over_time(scalar(http_requests_total{pod="nginx-2"}) / 10, http_requests_total[1m])`},
+	}
+
 	ctx := context.Background()
-	newEngine := engine.New(engine.Opts{DisableFallback: true, EngineOpts: opts})
-	q, err := newEngine.NewRangeQuery(ctx, storage, nil, query, start, end, step)
-	testutil.Ok(t, err)
-	stats.NewQueryStats(q.Stats())
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			for _, perStepStats := range []bool{false, true} {
+				t.Run(fmt.Sprintf("perStepStats=%t", perStepStats), func(t *testing.T) {
+					newEngine := engine.New(engine.Opts{DisableFallback: true, EngineOpts: opts, Parallelism: 4})
+					oldEngine := promql.NewEngine(opts)
+					qOpts := promql.NewPrometheusQueryOpts(perStepStats, 0)
 
-	q, err = newEngine.NewInstantQuery(ctx, storage, nil, query, end)
-	testutil.Ok(t, err)
-	stats.NewQueryStats(q.Stats())
+					newQ, err := newEngine.NewRangeQuery(ctx, storage, qOpts, tcase.query, start, end, step)
+					testutil.Ok(t, err)
+					testutil.Ok(t, newQ.Exec(ctx).Err)
+					oldQ, err := oldEngine.NewRangeQuery(ctx, storage, qOpts, tcase.query, start, end, step)
+					testutil.Ok(t, err)
+					testutil.Ok(t, oldQ.Exec(ctx).Err)
+
+					newStats, oldStats := newQ.Stats(), oldQ.Stats()
+					testutil.Equals(t, oldStats.Samples.TotalSamples, newStats.Samples.TotalSamples)
+					testutil.Equals(t, oldStats.Samples.TotalSamplesPerStep, newStats.Samples.TotalSamplesPerStep)
+					testutil.Assert(t, newStats.Samples.PeakSamples > 0, "expected peak samples to be tracked")
+					if perStepStats {
+						// Peak samples are the highest number of samples loaded for a single step.
+						var maxStepSamples int64
+						for _, s := range newStats.Samples.TotalSamplesPerStep {
+							if s > maxStepSamples {
+								maxStepSamples = s
+							}
+						}
+						testutil.Equals(t, int(maxStepSamples), newStats.Samples.PeakSamples)
+					}
+					testutil.Assert(t, newStats.Timers.GetTimer(stats.ExecTotalTime).Duration() > 0, "expected exec time to be tracked")
+					testutil.Assert(t, newStats.Timers.GetTimer(stats.EvalTotalTime).Duration() > 0, "expected eval time to be tracked")
+					testutil.Assert(t, newStats.Timers.GetTimer(stats.QueryPreparationTime).Duration() > 0, "expected preparation time to be tracked")
+					stats.NewQueryStats(newStats)
+
+					newQ, err = newEngine.NewInstantQuery(ctx, storage, qOpts, tcase.query, end)
+					testutil.Ok(t, err)
+					testutil.Ok(t, newQ.Exec(ctx).Err)
+					oldQ, err = oldEngine.NewInstantQuery(ctx, storage, qOpts, tcase.query, end)
+					testutil.Ok(t, err)
+					testutil.Ok(t, oldQ.Exec(ctx).Err)
+
+					newStats, oldStats = newQ.Stats(), oldQ.Stats()
+					testutil.Equals(t, oldStats.Samples.TotalSamples, newStats.Samples.TotalSamples)
+					testutil.Equals(t, oldStats.Samples.TotalSamplesPerStep, newStats.Samples.TotalSamplesPerStep)
+					stats.NewQueryStats(newStats)
+				})
+			}
+		})
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	start := time.Unix(0, 0)
+	end := time.Unix(120, 0)
+	step := time.Second * 30
+
+	load := `load 30s
+				http_requests_total{pod="nginx-1", series="1"} 1+1x40
+				http_requests_total{pod="nginx-1", series="2"} 1+2x40
+				http_requests_total{pod="nginx-2", series="1"} 1+3x40
+				http_requests_total{pod="nginx-2", series="2"} 1+4x40`
+
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	cases := []struct {
+		name  string
+		query string
+	}{
+		{name: "selector", query: `http_requests_total`},
+		{name: "aggregation", query: `sum by (pod) (rate(http_requests_total[1m]))`},
+		{name: "binary operation", query: `http_requests_total / on (pod, series) http_requests_total`},
+		{name: "topk", query: `topk by (pod) (1, http_requests_total)`},
+		{name: "count_values", query: `count_values by (pod) ("value", http_requests_total)`},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			opts := promql.EngineOpts{
+				Timeout:    2 * time.Second,
+				MaxSamples: math.MaxInt64,
+			}
+			ctx := context.Background()
+
+			unlimited := engine.New(engine.Opts{DisableFallback: true, EngineOpts: opts})
+			q, err := unlimited.NewRangeQuery(ctx, storage, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			expected := q.Exec(ctx)
+			testutil.Ok(t, expected.Err)
+
+			// A limit which is large enough for the query does not change its result.
+			limited := engine.New(engine.Opts{DisableFallback: true, EngineOpts: opts, MemoryLimitBytes: 64 * 1024})
+			q, err = limited.NewRangeQuery(ctx, storage, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			testutil.WithGoCmp(comparer).Equals(t, expected, q.Exec(ctx))
+
+			limited = engine.New(engine.Opts{DisableFallback: true, EngineOpts: opts, MemoryLimitBytes: 64})
+			q, err = limited.NewRangeQuery(ctx, storage, nil, tcase.query, start, end, step)
+			testutil.Ok(t, err)
+			res := q.Exec(ctx)
+			testutil.NotOk(t, res.Err)
+			testutil.Assert(t, errors.Is(res.Err, limits.ErrMemoryLimitExceeded), "unexpected error: %v", res.Err)
+			testutil.Assert(t, !errors.Is(res.Err, context.DeadlineExceeded), "memory limit should not be reported as a timeout")
+		})
+	}
+
+	// count_values keeps the counts of all steps, so over a long range it exceeds
+	// a limit which is large enough for the selector it counts the values of.
+	t.Run("count_values", func(t *testing.T) {
+		opts := promql.EngineOpts{Timeout: 2 * time.Second, MaxSamples: math.MaxInt64}
+		ctx := context.Background()
+		limited := engine.New(engine.Opts{DisableFallback: true, EngineOpts: opts, MemoryLimitBytes: 8 * 1024})
+		end := time.Unix(1200, 0)
+
+		q, err := limited.NewRangeQuery(ctx, storage, nil, `http_requests_total`, start, end, step)
+		testutil.Ok(t, err)
+		testutil.Ok(t, q.Exec(ctx).Err)
+
+		q, err = limited.NewRangeQuery(ctx, storage, nil, `count_values("value", http_requests_total)`, start, end, step)
+		testutil.Ok(t, err)
+		res := q.Exec(ctx)
+		testutil.NotOk(t, res.Err)
+		testutil.Assert(t, errors.Is(res.Err, limits.ErrMemoryLimitExceeded), "unexpected error: %v", res.Err)
+	})
+}
+
+func TestQueryQueue(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		selected []string
+		started  = make(chan struct{}, 10)
+		unblock  = make(chan struct{})
+	)
+	blockingStorage := &storage.MockQueryable{
+		MockQuerier: &storage.MockQuerier{
+			SelectMockFunction: func(sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+				mu.Lock()
+				selected = append(selected, matchers[0].Value)
+				mu.Unlock()
+				started <- struct{}{}
+				<-unblock
+				return newTestSeriesSet(storage.MockSeries([]int64{0}, []float64{1}, []string{labels.MetricName, matchers[0].Value}))
+			},
+		},
+	}
+	// waitForQueued waits until n queries are waiting in the queue.
+	waitForQueued := func(t *testing.T, reg *prometheus.Registry, n float64) {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			mfs, err := reg.Gather()
+			testutil.Ok(t, err)
+			for _, mf := range mfs {
+				if mf.GetName() == "thanos_engine_queued_queries" && mf.GetMetric()[0].GetGauge().GetValue() == n {
+					return
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %v queued queries", n)
+	}
+
+	ctx := context.Background()
+	ts := time.Unix(0, 0)
+
+	t.Run("queries are executed by priority", func(t *testing.T) {
+		selected, started, unblock = nil, make(chan struct{}, 10), make(chan struct{})
+		reg := prometheus.NewRegistry()
+		ng := engine.New(engine.Opts{
+			EngineOpts:           promql.EngineOpts{Timeout: time.Minute, Reg: reg},
+			DisableFallback:      true,
+			MaxConcurrentQueries: 1,
+		})
+
+		var wg sync.WaitGroup
+		exec := func(query string, priority int) {
+			q, err := ng.NewInstantQuery(ctx, blockingStorage, engine.QueryOpts{Priority: priority}, query, ts)
+			testutil.Ok(t, err)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				testutil.Ok(t, q.Exec(ctx).Err)
+			}()
+		}
+		exec("running", 0)
+		<-started
+		exec("low", 0)
+		waitForQueued(t, reg, 1)
+		exec("high", 10)
+		waitForQueued(t, reg, 2)
+
+		close(unblock)
+		wg.Wait()
+		testutil.Equals(t, []string{"running", "high", "low"}, selected)
+	})
+
+	t.Run("queued queries can be cancelled", func(t *testing.T) {
+		selected, started, unblock = nil, make(chan struct{}, 10), make(chan struct{})
+		reg := prometheus.NewRegistry()
+		ng := engine.New(engine.Opts{
+			EngineOpts:           promql.EngineOpts{Timeout: time.Minute, Reg: reg},
+			DisableFallback:      true,
+			MaxConcurrentQueries: 1,
+		})
+
+		running, err := ng.NewInstantQuery(ctx, blockingStorage, nil, "running", ts)
+		testutil.Ok(t, err)
+		done := make(chan *promql.Result)
+		go func() { done <- running.Exec(ctx) }()
+		<-started
+
+		queued, err := ng.NewInstantQuery(ctx, blockingStorage, nil, "queued", ts)
+		testutil.Ok(t, err)
+		queuedCtx, cancel := context.WithCancel(ctx)
+		cancelled := make(chan *promql.Result)
+		go func() { cancelled <- queued.Exec(queuedCtx) }()
+		waitForQueued(t, reg, 1)
+		cancel()
+
+		res := <-cancelled
+		testutil.NotOk(t, res.Err)
+		testutil.Assert(t, errors.Is(res.Err, context.Canceled), "unexpected error: %v", res.Err)
+
+		close(unblock)
+		testutil.Ok(t, (<-done).Err)
+
+		// The slot of the cancelled query must not be leaked.
+		next, err := ng.NewInstantQuery(ctx, blockingStorage, nil, "next", ts)
+		testutil.Ok(t, err)
+		testutil.Ok(t, next.Exec(ctx).Err)
+		testutil.Equals(t, []string{"running", "next"}, selected)
+	})
+
+	t.Run("fallback queries wait in the queue", func(t *testing.T) {
+		selected, started, unblock = nil, make(chan struct{}, 10), make(chan struct{})
+		reg := prometheus.NewRegistry()
+		ng := engine.New(engine.Opts{
+			EngineOpts:           promql.EngineOpts{Timeout: time.Minute, Reg: reg},
+			MaxConcurrentQueries: 1,
+		})
+
+		running, err := ng.NewInstantQuery(ctx, blockingStorage, nil, "running", ts)
+		testutil.Ok(t, err)
+		done := make(chan *promql.Result)
+		go func() { done <- running.Exec(ctx) }()
+		<-started
+
+		fallback, err := ng.NewInstantQuery(ctx, blockingStorage, nil, "histogram_stddev(fallback)", ts)
+		testutil.Ok(t, err)
+		fallbackDone := make(chan *promql.Result)
+		go func() { fallbackDone <- fallback.Exec(ctx) }()
+		waitForQueued(t, reg, 1)
+
+		close(unblock)
+		testutil.Ok(t, (<-done).Err)
+		testutil.Ok(t, (<-fallbackDone).Err)
+		testutil.Equals(t, []string{"running", "fallback"}, selected)
+	})
 }
 
 func storageWithMockSeries(mockSeries ...*mockSeries) *storage.MockQueryable {
@@ -4509,6 +5306,14 @@ func TestNativeHistograms(t *testing.T) {
 			name:  "delta()",
 			query: "delta(native_histogram_series[1m])",
 		},
+		{
+			name:  "timestamp()",
+			query: "timestamp(native_histogram_series)",
+		},
+		{
+			name:  "timestamp() of sum()",
+			query: "timestamp(sum(native_histogram_series))",
+		},
 		{
 			name:                   "sum()",
 			query:                  "sum(native_histogram_series)",
@@ -7,6 +7,7 @@ import (
 	"github.com/prometheus/prometheus/promql"
 
 	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/logicalplan"
 )
 
 type ExplainableQuery interface {
@@ -14,11 +15,15 @@ type ExplainableQuery interface {
 
 	Explain() *ExplainOutputNode
 	Analyze() *AnalyzeOutputNode
+	ExplainAnalyze() *ExplainAnalyzeNode
 }
 
 type AnalyzeOutputNode struct {
 	OperatorTelemetry model.OperatorTelemetry `json:"telemetry,omitempty"`
-	Children          []AnalyzeOutputNode     `json:"children,omitempty"`
+	// Stats are the statistics collected by the operator, including
+	// the usage of the vector pool owned by the operator.
+	Stats    model.OperatorStats `json:"stats"`
+	Children []AnalyzeOutputNode `json:"children,omitempty"`
 }
 
 type ExplainOutputNode struct {
@@ -26,7 +31,24 @@ type ExplainOutputNode struct {
 	Children     []ExplainOutputNode `json:"children,omitempty"`
 }
 
-var _ ExplainableQuery = &compatibilityQuery{}
+// LogicalPlanExplainer is implemented by queries which can explain their logical plan.
+type LogicalPlanExplainer interface {
+	ExplainLogicalPlan() *LogicalPlanOutput
+}
+
+// LogicalPlanOutput describes the logical plan of a query before and after
+// each of the configured optimizers ran. The unoptimized plan and the optimizers
+// are only recorded when analysis is enabled in the engine.
+type LogicalPlanOutput struct {
+	Unoptimized string                       `json:"unoptimized,omitempty"`
+	Optimized   string                       `json:"optimized"`
+	Optimizers  []logicalplan.OptimizerTrace `json:"optimizers,omitempty"`
+}
+
+var (
+	_ ExplainableQuery     = &compatibilityQuery{}
+	_ LogicalPlanExplainer = &compatibilityQuery{}
+)
 
 func analyzeVector(obsv model.ObservableVectorOperator) *AnalyzeOutputNode {
 	telemetry, obsVectors := obsv.Analyze()
@@ -36,12 +58,38 @@ func analyzeVector(obsv model.ObservableVectorOperator) *AnalyzeOutputNode {
 		children = append(children, *analyzeVector(vector))
 	}
 
+	stats := executionStats(telemetry)
+	// Operators which pass through vectors of their children share their pools,
+	// so pool usage is only reported for the operator which owns the pool.
+	if pool := obsv.GetPool(); pool != nil && !sharesPool(pool, obsVectors) {
+		stats.PoolHits, stats.PoolMisses = pool.Stats()
+	}
+
 	return &AnalyzeOutputNode{
 		OperatorTelemetry: telemetry,
+		Stats:             stats,
 		Children:          children,
 	}
 }
 
+// executionStats returns the statistics collected by the telemetry of an operator. Operators
+// of user defined expressions whose telemetry does not implement model.StatsTelemetry report none.
+func executionStats(telemetry model.OperatorTelemetry) model.OperatorStats {
+	if s, ok := telemetry.(model.StatsTelemetry); ok {
+		return s.ExecutionStats()
+	}
+	return model.OperatorStats{}
+}
+
+func sharesPool[T model.VectorOperator](pool *model.VectorPool, children []T) bool {
+	for _, c := range children {
+		if c.GetPool() == pool {
+			return true
+		}
+	}
+	return false
+}
+
 func explainVector(v model.VectorOperator) *ExplainOutputNode {
 	name, vectors := v.Explain()
 
@@ -55,3 +103,17 @@ func explainVector(v model.VectorOperator) *ExplainOutputNode {
 		Children:     children,
 	}
 }
+
+func explainLogicalPlan(plan logicalplan.Plan) *LogicalPlanOutput {
+	output := &LogicalPlanOutput{Optimized: plan.Expr().String()}
+	traced, ok := plan.(logicalplan.TracedPlan)
+	if !ok {
+		return output
+	}
+	output.Unoptimized = output.Optimized
+	output.Optimizers = traced.Trace()
+	if len(output.Optimizers) > 0 {
+		output.Unoptimized = output.Optimizers[0].Before
+	}
+	return output
+}
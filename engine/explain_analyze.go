@@ -0,0 +1,108 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+)
+
+// ExplainAnalyzeNode describes a single operator of a query together with
+// the telemetry it collected during execution.
+type ExplainAnalyzeNode struct {
+	// ID identifies the operator within the query. IDs are assigned in
+	// depth-first order starting from the root, so they are stable for the same plan.
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// Analyzed is set when telemetry was collected for the operator.
+	Analyzed bool `json:"analyzed"`
+	// ExecutionTime is the time spent in the operator, including time spent in its children.
+	ExecutionTime time.Duration `json:"executionTimeNanos"`
+	// PercentOfTotal is the execution time of the operator relative to the execution time of the root operator.
+	PercentOfTotal float64              `json:"percentOfTotal"`
+	Stats          model.OperatorStats  `json:"stats"`
+	Children       []ExplainAnalyzeNode `json:"children,omitempty"`
+}
+
+// RenderText writes the operator tree as indented text, one operator per line.
+func (n *ExplainAnalyzeNode) RenderText(w io.Writer) error {
+	var sb strings.Builder
+	n.renderText(&sb, 0)
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// RenderJSON writes the operator tree as JSON.
+func (n *ExplainAnalyzeNode) RenderJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(n)
+}
+
+func (n *ExplainAnalyzeNode) String() string {
+	var sb strings.Builder
+	n.renderText(&sb, 0)
+	return sb.String()
+}
+
+func (n *ExplainAnalyzeNode) renderText(sb *strings.Builder, depth int) {
+	if depth > 0 {
+		sb.WriteString(strings.Repeat("    ", depth-1))
+		sb.WriteString("  -> ")
+	}
+	fmt.Fprintf(sb, "[%d] %s", n.ID, n.Name)
+	if n.Analyzed {
+		fmt.Fprintf(sb,
+			" (time=%s %.2f%% series=%d samples_in=%d samples_out=%d next_calls=%d step_vectors=%d pool_hits=%d pool_misses=%d)",
+			n.ExecutionTime, n.PercentOfTotal, n.Stats.Series, n.Stats.SamplesIn, n.Stats.SamplesOut,
+			n.Stats.NextCalls, n.Stats.StepVectors, n.Stats.PoolHits, n.Stats.PoolMisses,
+		)
+		if n.Stats.RemoteExecutionTime > 0 || n.Stats.RemoteQueueTime > 0 || n.Stats.NetworkTime > 0 {
+			fmt.Fprintf(sb, " (remote_time=%s remote_queue_time=%s network_time=%s)",
+				n.Stats.RemoteExecutionTime, n.Stats.RemoteQueueTime, n.Stats.NetworkTime)
+		}
+	}
+	sb.WriteString("\n")
+	for i := range n.Children {
+		n.Children[i].renderText(sb, depth+1)
+	}
+}
+
+func explainAnalyze(root model.VectorOperator, analyzed bool) *ExplainAnalyzeNode {
+	var nextID int
+	node := explainAnalyzeOperator(root, analyzed, &nextID)
+	setPercentOfTotal(&node, node.ExecutionTime)
+	return &node
+}
+
+func explainAnalyzeOperator(op model.VectorOperator, analyzed bool, nextID *int) ExplainAnalyzeNode {
+	name, children := op.Explain()
+	node := ExplainAnalyzeNode{ID: *nextID, Name: name}
+	*nextID++
+
+	if obs, ok := op.(model.ObservableVectorOperator); ok && analyzed {
+		node.Analyzed = true
+		node.ExecutionTime = obs.ExecutionTimeTaken()
+		node.Stats = executionStats(obs)
+		if pool := op.GetPool(); pool != nil && !sharesPool(pool, children) {
+			node.Stats.PoolHits, node.Stats.PoolMisses = pool.Stats()
+		}
+	}
+	for _, c := range children {
+		node.Children = append(node.Children, explainAnalyzeOperator(c, analyzed, nextID))
+	}
+	return node
+}
+
+func setPercentOfTotal(node *ExplainAnalyzeNode, total time.Duration) {
+	if total > 0 {
+		node.PercentOfTotal = 100 * float64(node.ExecutionTime) / float64(total)
+	}
+	for i := range node.Children {
+		setPercentOfTotal(&node.Children[i], total)
+	}
+}
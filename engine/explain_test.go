@@ -4,18 +4,24 @@
 package engine_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-	"runtime"
+	"math"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/efficientgo/core/testutil"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 
+	"github.com/thanos-io/promql-engine/api"
 	"github.com/thanos-io/promql-engine/engine"
+	"github.com/thanos-io/promql-engine/logicalplan"
 )
 
 func TestQueryExplain(t *testing.T) {
@@ -29,8 +35,9 @@ func TestQueryExplain(t *testing.T) {
 	start := time.Unix(0, 0)
 	end := time.Unix(1000, 0)
 
-	// Calculate concurrencyOperators according to max available CPUs.
-	totalOperators := runtime.GOMAXPROCS(0) / 2
+	// Calculate concurrencyOperators according to the parallelism of the engine.
+	parallelism := 8
+	totalOperators := parallelism / 2
 	concurrencyOperators := []engine.ExplainOutputNode{}
 	for i := 0; i < totalOperators; i++ {
 		concurrencyOperators = append(concurrencyOperators, engine.ExplainOutputNode{
@@ -65,7 +72,7 @@ func TestQueryExplain(t *testing.T) {
 	} {
 		{
 			t.Run(tc.query, func(t *testing.T) {
-				ng := engine.New(engine.Opts{EngineOpts: opts})
+				ng := engine.New(engine.Opts{EngineOpts: opts, Parallelism: parallelism})
 				ctx := context.Background()
 
 				var (
@@ -89,6 +96,161 @@ func TestQueryExplain(t *testing.T) {
 	}
 }
 
+func TestQueryExplainParallelism(t *testing.T) {
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := storage.MockSeries(
+		[]int64{240, 270, 300, 600, 630, 660},
+		[]float64{1, 2, 3, 4, 5, 6},
+		[]string{labels.MetricName, "foo"},
+	)
+	start := time.Unix(0, 0)
+
+	ng := engine.New(engine.Opts{EngineOpts: opts, Parallelism: 8})
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name      string
+		queryOpts promql.QueryOpts
+		expected  *engine.ExplainOutputNode
+	}{
+		{
+			name: "engine parallelism",
+			expected: &engine.ExplainOutputNode{OperatorName: "[*concurrencyOperator(buff=2)]", Children: []engine.ExplainOutputNode{
+				{OperatorName: "[*aggregate] sum by ([job])", Children: []engine.ExplainOutputNode{
+					{OperatorName: "[*coalesce]", Children: []engine.ExplainOutputNode{
+						{OperatorName: "[*concurrencyOperator(buff=2)]", Children: []engine.ExplainOutputNode{{OperatorName: "[*vectorSelector] {[__name__=\"foo\"]} 0 mod 4"}}},
+						{OperatorName: "[*concurrencyOperator(buff=2)]", Children: []engine.ExplainOutputNode{{OperatorName: "[*vectorSelector] {[__name__=\"foo\"]} 1 mod 4"}}},
+						{OperatorName: "[*concurrencyOperator(buff=2)]", Children: []engine.ExplainOutputNode{{OperatorName: "[*vectorSelector] {[__name__=\"foo\"]} 2 mod 4"}}},
+						{OperatorName: "[*concurrencyOperator(buff=2)]", Children: []engine.ExplainOutputNode{{OperatorName: "[*vectorSelector] {[__name__=\"foo\"]} 3 mod 4"}}},
+					}},
+				}},
+			}},
+		},
+		{
+			name:      "query parallelism",
+			queryOpts: engine.QueryOpts{Parallelism: 4},
+			expected: &engine.ExplainOutputNode{OperatorName: "[*concurrencyOperator(buff=2)]", Children: []engine.ExplainOutputNode{
+				{OperatorName: "[*aggregate] sum by ([job])", Children: []engine.ExplainOutputNode{
+					{OperatorName: "[*coalesce]", Children: []engine.ExplainOutputNode{
+						{OperatorName: "[*concurrencyOperator(buff=2)]", Children: []engine.ExplainOutputNode{{OperatorName: "[*vectorSelector] {[__name__=\"foo\"]} 0 mod 2"}}},
+						{OperatorName: "[*concurrencyOperator(buff=2)]", Children: []engine.ExplainOutputNode{{OperatorName: "[*vectorSelector] {[__name__=\"foo\"]} 1 mod 2"}}},
+					}},
+				}},
+			}},
+		},
+		{
+			name:      "no parallelism",
+			queryOpts: engine.QueryOpts{Parallelism: 1},
+			expected: &engine.ExplainOutputNode{OperatorName: "[*aggregate] sum by ([job])", Children: []engine.ExplainOutputNode{
+				{OperatorName: "[*coalesce]", Children: []engine.ExplainOutputNode{
+					{OperatorName: "[*vectorSelector] {[__name__=\"foo\"]} 0 mod 1"},
+				}},
+			}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := ng.NewInstantQuery(ctx, storageWithSeries(series), tc.queryOpts, "sum(foo) by (job)", start)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, query.(engine.ExplainableQuery).Explain())
+			testutil.Ok(t, query.Exec(ctx).Err)
+		})
+	}
+}
+
+func TestQueryExplainLogicalPlan(t *testing.T) {
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := storage.MockSeries(
+		[]int64{240, 270, 300, 600, 630, 660},
+		[]float64{1, 2, 3, 4, 5, 6},
+		[]string{labels.MetricName, "foo"},
+	)
+	start := time.Unix(0, 0)
+	end := time.Unix(1000, 0)
+
+	for _, tc := range []struct {
+		name       string
+		optimizers []logicalplan.Optimizer
+		expected   *engine.LogicalPlanOutput
+	}{
+		{
+			name:       "no optimizers",
+			optimizers: logicalplan.NoOptimizers,
+			expected: &engine.LogicalPlanOutput{
+				Unoptimized: `sum by (job) (foo{job="a"}) / on (job) sum by (job) (foo)`,
+				Optimized:   `sum by (job) (foo{job="a"}) / on (job) sum by (job) (foo)`,
+				Optimizers:  []logicalplan.OptimizerTrace{},
+			},
+		},
+		{
+			name: "default optimizers",
+			expected: &engine.LogicalPlanOutput{
+				Unoptimized: `sum by (job) (foo{job="a"}) / on (job) sum by (job) (foo)`,
+				Optimized:   `sum by (job) (filter([job="a"], foo)) / on (job) sum by (job) (foo)`,
+				Optimizers: []logicalplan.OptimizerTrace{
+					{
+						Optimizer: "logicalplan.SortMatchers",
+						Before:    `sum by (job) (foo{job="a"}) / on (job) sum by (job) (foo)`,
+						After:     `sum by (job) (foo{job="a"}) / on (job) sum by (job) (foo)`,
+					},
+					{
+						Optimizer: "logicalplan.MergeSelectsOptimizer",
+						Before:    `sum by (job) (foo{job="a"}) / on (job) sum by (job) (foo)`,
+						After:     `sum by (job) (filter([job="a"], foo)) / on (job) sum by (job) (foo)`,
+						Rewrites: []logicalplan.Rewrite{
+							{Before: `foo{job="a"}`, After: `filter([job="a"], foo)`},
+						},
+					},
+				},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ng := engine.New(engine.Opts{EngineOpts: opts, LogicalOptimizers: tc.optimizers, EnableAnalysis: true})
+			ctx := context.Background()
+			qry := `sum by (job) (foo{job="a"}) / on (job) sum by (job) (foo)`
+
+			query, err := ng.NewInstantQuery(ctx, storageWithSeries(series), nil, qry, start)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, query.(engine.LogicalPlanExplainer).ExplainLogicalPlan())
+
+			query, err = ng.NewRangeQuery(ctx, storageWithSeries(series), nil, qry, start, end, 30*time.Second)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.expected, query.(engine.LogicalPlanExplainer).ExplainLogicalPlan())
+
+			// Optimizers are only traced when analysis is enabled.
+			ng = engine.New(engine.Opts{EngineOpts: opts, LogicalOptimizers: tc.optimizers})
+			query, err = ng.NewInstantQuery(ctx, storageWithSeries(series), nil, qry, start)
+			testutil.Ok(t, err)
+			testutil.Equals(t, &engine.LogicalPlanOutput{Optimized: tc.expected.Optimized}, query.(engine.LogicalPlanExplainer).ExplainLogicalPlan())
+		})
+	}
+}
+
+func TestQueryFromPlanLogicalPlan(t *testing.T) {
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	series := storage.MockSeries(
+		[]int64{240, 270, 300, 600, 630, 660},
+		[]float64{1, 2, 3, 4, 5, 6},
+		[]string{labels.MetricName, "foo"},
+	)
+	start := time.Unix(0, 0)
+	end := time.Unix(1000, 0)
+
+	ng := engine.New(engine.Opts{EngineOpts: opts})
+	ctx := context.Background()
+	plan, err := parser.ParseExpr(`sum by (job) (foo{pod="a", job="b"}) / on (job) sum by (job) (foo{job="b"})`)
+	testutil.Ok(t, err)
+	expected := `sum by (job) (filter([pod="a"], foo{job="b"})) / on (job) sum by (job) (foo{job="b"})`
+
+	query, err := ng.NewInstantQueryFromPlan(ctx, storageWithSeries(series), nil, plan, start)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, query.(engine.LogicalPlanExplainer).ExplainLogicalPlan().Optimized)
+
+	query, err = ng.NewRangeQueryFromPlan(ctx, storageWithSeries(series), nil, plan, start, end, 30*time.Second)
+	testutil.Ok(t, err)
+	testutil.Equals(t, expected, query.(engine.LogicalPlanExplainer).ExplainLogicalPlan().Optimized)
+}
+
 func assertExecutionTimeNonZero(t *testing.T, got *engine.AnalyzeOutputNode) bool {
 	if got != nil {
 		if got.OperatorTelemetry.ExecutionTimeTaken() <= 0 {
@@ -162,3 +324,194 @@ func TestQueryAnalyze(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryAnalyzeStats(t *testing.T) {
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	load := `load 30s
+		foo{pod="a"} 1+1x40
+		foo{pod="b"} 1+2x40
+		foo{pod="c"} 1+3x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	start := time.Unix(0, 0)
+	end := time.Unix(1000, 0)
+
+	ng := engine.New(engine.Opts{EngineOpts: opts, EnableAnalysis: true, Parallelism: 4})
+	ctx := context.Background()
+	query, err := ng.NewRangeQuery(ctx, storage, nil, "sum(foo)", start, end, 30*time.Second)
+	testutil.Ok(t, err)
+
+	result := query.Exec(ctx)
+	testutil.Ok(t, result.Err)
+	matrix, err := result.Matrix()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(matrix))
+
+	analysis := query.(engine.ExplainableQuery).Analyze()
+	testutil.Equals(t, 1, analysis.Stats.Series)
+	testutil.Equals(t, int64(len(matrix[0].Floats)), analysis.Stats.SamplesOut)
+
+	var (
+		poolMisses    int64
+		selectorsSeen int
+		walk          func(node engine.AnalyzeOutputNode)
+	)
+	walk = func(node engine.AnalyzeOutputNode) {
+		poolMisses += node.Stats.PoolMisses
+		testutil.Assert(t, node.Stats.NextCalls > 0, "expected next calls for %s", node.OperatorTelemetry.Name())
+		testutil.Assert(t, node.Stats.StepVectors >= node.Stats.NextCalls, "expected at least one step vector per next call for %s", node.OperatorTelemetry.Name())
+		if len(node.Children) == 0 {
+			selectorsSeen++
+			testutil.Equals(t, "[*vectorSelector]", node.OperatorTelemetry.Name())
+			testutil.Equals(t, node.Stats.SamplesOut, node.Stats.SamplesIn)
+			return
+		}
+
+		var childSamples int64
+		for _, c := range node.Children {
+			childSamples += c.Stats.SamplesOut
+			walk(c)
+		}
+		testutil.Equals(t, childSamples, node.Stats.SamplesIn, "samples in of %s", node.OperatorTelemetry.Name())
+	}
+	walk(*analysis)
+
+	// The selector is sharded by the parallelism of the query.
+	testutil.Equals(t, 2, selectorsSeen)
+	testutil.Assert(t, poolMisses > 0, "expected buffers to be allocated from pools")
+}
+
+func TestQueryExplainAnalyze(t *testing.T) {
+	opts := promql.EngineOpts{Timeout: 1 * time.Hour}
+	load := `load 30s
+		foo{job="a"} 1+1x40
+		foo{job="b"} 1+2x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	start := time.Unix(0, 0)
+	end := time.Unix(1000, 0)
+	ctx := context.Background()
+
+	t.Run("without analysis", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: opts, Parallelism: 2})
+		query, err := ng.NewRangeQuery(ctx, storage, nil, "sum(foo) by (job)", start, end, 30*time.Second)
+		testutil.Ok(t, err)
+
+		var buf bytes.Buffer
+		testutil.Ok(t, query.(engine.ExplainableQuery).ExplainAnalyze().RenderText(&buf))
+		testutil.Equals(t, `[0] [*concurrencyOperator(buff=2)]
+  -> [1] [*aggregate] sum by ([job])
+      -> [2] [*coalesce]
+          -> [3] [*concurrencyOperator(buff=2)]
+              -> [4] [*vectorSelector] {[__name__="foo"]} 0 mod 1
+`, buf.String())
+	})
+
+	t.Run("with analysis", func(t *testing.T) {
+		ng := engine.New(engine.Opts{EngineOpts: opts, Parallelism: 4, EnableAnalysis: true})
+		query, err := ng.NewRangeQuery(ctx, storage, nil, "sum(foo) by (job)", start, end, 30*time.Second)
+		testutil.Ok(t, err)
+		testutil.Ok(t, query.Exec(ctx).Err)
+
+		node := query.(engine.ExplainableQuery).ExplainAnalyze()
+		testutil.Equals(t, 100.0, node.PercentOfTotal)
+
+		var (
+			ids  []int
+			walk func(n engine.ExplainAnalyzeNode)
+		)
+		walk = func(n engine.ExplainAnalyzeNode) {
+			ids = append(ids, n.ID)
+			testutil.Assert(t, n.Analyzed, "expected %s to be analyzed", n.Name)
+			testutil.Assert(t, n.ExecutionTime > 0, "expected non-zero execution time for %s", n.Name)
+			testutil.Assert(t, n.PercentOfTotal > 0, "expected non-zero percent of total for %s", n.Name)
+			for _, c := range n.Children {
+				walk(c)
+			}
+		}
+		walk(*node)
+		testutil.Equals(t, []int{0, 1, 2, 3, 4, 5, 6}, ids)
+
+		text := node.String()
+		testutil.Assert(t, strings.HasPrefix(text, "[0] [*concurrencyOperator(buff=2)] (time="), "%s", text)
+		testutil.Assert(t, strings.Contains(text, "100.00% series=2 samples_in=68 samples_out=68 next_calls=4 step_vectors=34"), "%s", text)
+
+		var buf bytes.Buffer
+		testutil.Ok(t, node.RenderJSON(&buf))
+		var decoded engine.ExplainAnalyzeNode
+		testutil.Ok(t, json.Unmarshal(buf.Bytes(), &decoded))
+		testutil.Equals(t, *node, decoded)
+	})
+}
+
+func TestDistributedExplainAnalyze(t *testing.T) {
+	load := `load 30s
+		foo{job="a"} 1+1x40
+		foo{job="b"} 1+2x40`
+	storage := promql.LoadedStorage(t, load)
+	defer storage.Close()
+
+	opts := engine.Opts{
+		EngineOpts:     promql.EngineOpts{Timeout: 1 * time.Hour},
+		Parallelism:    2,
+		EnableAnalysis: true,
+	}
+	remote := engine.NewRemoteEngine(opts, storage, math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")})
+	ng := engine.NewDistributedEngine(opts, api.NewStaticEndpoints([]api.RemoteEngine{remote}))
+
+	ctx := context.Background()
+	query, err := ng.NewRangeQuery(ctx, nil, nil, "sum by (job) (foo)", time.Unix(0, 0), time.Unix(1000, 0), 30*time.Second)
+	testutil.Ok(t, err)
+	logicalPlan := query.(engine.LogicalPlanExplainer).ExplainLogicalPlan()
+	testutil.Equals(t, "logicalplan.PassthroughOptimizer", logicalPlan.Optimizers[0].Optimizer)
+	testutil.Equals(t, []logicalplan.EngineDecision{{
+		Query:           "sum by (job) (foo)",
+		EngineLabelSets: []string{`{region="east"}`},
+		EngineMinT:      math.MinInt64,
+		EngineMaxT:      math.MaxInt64,
+		Selected:        true,
+		Reason:          logicalplan.EngineSelected,
+		QueryRangeStart: time.Unix(0, 0),
+	}}, logicalPlan.Optimizers[0].EngineDecisions)
+
+	explain := query.(engine.ExplainableQuery).Explain()
+	testutil.Equals(t, &engine.ExplainOutputNode{
+		OperatorName: "[*concurrencyOperator(buff=2)]",
+		Children: []engine.ExplainOutputNode{{
+			OperatorName: "[*remoteExec] sum by (job) (foo) (0, 1000)",
+			Children: []engine.ExplainOutputNode{{
+				OperatorName: "[*concurrencyOperator(buff=2)]",
+				Children: []engine.ExplainOutputNode{{
+					OperatorName: "[*aggregate] sum by ([job])",
+					Children: []engine.ExplainOutputNode{{
+						OperatorName: "[*coalesce]",
+						Children: []engine.ExplainOutputNode{{
+							OperatorName: "[*concurrencyOperator(buff=2)]",
+							Children:     []engine.ExplainOutputNode{{OperatorName: `[*vectorSelector] {[__name__="foo"]} 0 mod 1`}},
+						}},
+					}},
+				}},
+			}},
+		}},
+	}, explain)
+
+	testutil.Ok(t, query.Exec(ctx).Err)
+
+	node := query.(engine.ExplainableQuery).ExplainAnalyze()
+	testutil.Equals(t, 1, len(node.Children))
+	remoteExec := node.Children[0]
+	testutil.Assert(t, strings.HasPrefix(remoteExec.Name, "[*remoteExec]"), "unexpected operator %s", remoteExec.Name)
+	testutil.Assert(t, remoteExec.Stats.RemoteExecutionTime > 0, "expected remote execution time")
+	testutil.Assert(t, remoteExec.ExecutionTime >= remoteExec.Stats.RemoteExecutionTime+remoteExec.Stats.NetworkTime, "expected remote time to be part of the operator time")
+	testutil.Equals(t, 1, len(remoteExec.Children))
+	testutil.Equals(t, "[*concurrencyOperator(buff=2)]", remoteExec.Children[0].Name)
+	testutil.Equals(t, 2, remoteExec.Children[0].Stats.Series)
+	testutil.Assert(t, strings.Contains(node.String(), "remote_time="), "%s", node.String())
+
+	analysis := query.(engine.ExplainableQuery).Analyze()
+	testutil.Equals(t, 1, len(analysis.Children))
+	testutil.Equals(t, 1, len(analysis.Children[0].Children))
+	testutil.Equals(t, "[*concurrencyOperator]", analysis.Children[0].Children[0].OperatorTelemetry.Name())
+}
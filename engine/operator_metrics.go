@@ -0,0 +1,112 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/remote"
+)
+
+// operatorMetrics are metrics about the operators of executed queries.
+// They are computed from the same telemetry which is returned by Analyze.
+type operatorMetrics struct {
+	executionTime  *prometheus.HistogramVec
+	selectorSeries *prometheus.HistogramVec
+	remoteLatency  *prometheus.HistogramVec
+	poolBuffers    *prometheus.CounterVec
+}
+
+func newOperatorMetrics(reg prometheus.Registerer) *operatorMetrics {
+	return &operatorMetrics{
+		executionTime: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "operator_execution_duration_seconds",
+				Help:      "Time spent in operators while executing a query, including time spent in their children.",
+				Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+			}, []string{"operator"},
+		),
+		selectorSeries: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "selector_series",
+				Help:      "Number of series returned by a single selector shard.",
+				Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+			}, []string{"operator"},
+		),
+		remoteLatency: promauto.With(reg).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "remote_execution_duration_seconds",
+				Help:      "Time it took remote engines to return the result of a remote execution, including network and queueing time.",
+				Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+			}, []string{"engine"},
+		),
+		poolBuffers: promauto.With(reg).NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "vector_pool_buffers_total",
+				Help:      "Number of buffers taken from vector pools, by whether they were reused or newly allocated.",
+			}, []string{"operator", "result"},
+		),
+	}
+}
+
+// observe records the telemetry of the operators of an executed query.
+func (m *operatorMetrics) observe(root model.ObservableVectorOperator) {
+	m.observeNode(analyzeVector(root))
+}
+
+func (m *operatorMetrics) observeNode(node *AnalyzeOutputNode) {
+	operator := operatorType(node.OperatorTelemetry.Name())
+	m.executionTime.WithLabelValues(operator).Observe(node.OperatorTelemetry.ExecutionTimeTaken().Seconds())
+	switch operator {
+	case "vectorSelector", "matrixSelector":
+		m.selectorSeries.WithLabelValues(operator).Observe(float64(node.Stats.Series))
+	}
+	if node.Stats.PoolHits > 0 {
+		m.poolBuffers.WithLabelValues(operator, "hit").Add(float64(node.Stats.PoolHits))
+	}
+	if node.Stats.PoolMisses > 0 {
+		m.poolBuffers.WithLabelValues(operator, "miss").Add(float64(node.Stats.PoolMisses))
+	}
+	if r, ok := node.OperatorTelemetry.(*remote.Execution); ok {
+		latency := node.Stats.RemoteExecutionTime + node.Stats.RemoteQueueTime + node.Stats.NetworkTime
+		m.remoteLatency.WithLabelValues(engineLabel(r)).Observe(latency.Seconds())
+		// The operators of the remote query are executed by the remote engine,
+		// which records them in its own metrics.
+		return
+	}
+	for i := range node.Children {
+		m.observeNode(&node.Children[i])
+	}
+}
+
+// operatorType returns the type of an operator from its telemetry name, for example
+// vectorSelector for [*vectorSelector].
+func operatorType(name string) string {
+	name = strings.Trim(strings.TrimSpace(name), "[*]")
+	if name == "" {
+		return "unknown"
+	}
+	return name
+}
+
+func engineLabel(r *remote.Execution) string {
+	lsets := r.EngineLabels()
+	parts := make([]string, 0, len(lsets))
+	for _, lset := range lsets {
+		parts = append(parts, lset.String())
+	}
+	return strings.Join(parts, ",")
+}
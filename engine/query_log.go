@@ -0,0 +1,68 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/util/stats"
+)
+
+// queryParams are the parameters of a query which are written to the query log.
+type queryParams struct {
+	query      string
+	start, end time.Time
+	step       time.Duration
+}
+
+// logValue returns the parameters in the same format as the Prometheus query log.
+func (p queryParams) logValue() map[string]interface{} {
+	return map[string]interface{}{
+		"query": p.query,
+		"start": formatDate(p.start),
+		"end":   formatDate(p.end),
+		// The step provided by the user is in seconds.
+		"step": int64(p.step / time.Second),
+	}
+}
+
+// logQuery writes an executed query to the query log, if one is set. fallbackReason
+// is the reason the query was executed by the fallback engine, or empty if it was not.
+func (e *compatibilityEngine) logQuery(ctx context.Context, params queryParams, res *promql.Result, qstats *stats.Statistics, fallbackReason string) {
+	e.queryLoggerLock.RLock()
+	defer e.queryLoggerLock.RUnlock()
+
+	l := e.queryLogger
+	if l == nil {
+		return
+	}
+
+	f := []interface{}{"params", params.logValue()}
+	if res.Err != nil {
+		f = append(f, "error", res.Err)
+	}
+	f = append(f, "stats", stats.NewQueryStats(qstats))
+	if len(res.Warnings) > 0 {
+		f = append(f, "annotations", res.Warnings.AsStrings(params.query, 0))
+	}
+	f = append(f, "fallback", fallbackReason != "")
+	if fallbackReason != "" {
+		f = append(f, "fallbackReason", fallbackReason)
+	}
+	if origin := ctx.Value(promql.QueryOrigin{}); origin != nil {
+		for k, v := range origin.(map[string]interface{}) {
+			f = append(f, k, v)
+		}
+	}
+	if err := l.Log(f...); err != nil {
+		level.Error(e.logger).Log("msg", "can't log query", "err", err)
+	}
+}
+
+func formatDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+}
@@ -0,0 +1,184 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package engine
+
+import (
+	"context"
+	"sync"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/util/annotations"
+	"github.com/prometheus/prometheus/util/stats"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/remote"
+)
+
+var _ remote.StreamingQuery = &streamingQuery{}
+
+// streamingQuery is a query whose result can be streamed to remote executions.
+type streamingQuery struct {
+	*compatibilityQuery
+}
+
+// streamable returns a query which can stream its result if the engine does not limit the number
+// of concurrent queries. A stream holds a slot in the admission queue until it is read completely,
+// so a distributed query with several remote executions against the same engine could wait for its
+// own slots. Remote executions of queries which cannot stream execute them before reading the result.
+func (e *compatibilityEngine) streamable(q *compatibilityQuery) promql.Query {
+	if e.queue != nil {
+		return q
+	}
+	return &streamingQuery{compatibilityQuery: q}
+}
+
+// Stream executes the query and returns its result as a stream of the step vectors produced
+// by its operators. Unlike Exec, the result is not materialised, which allows remote executions
+// to process the result of a remote query while it is being evaluated.
+func (sq *streamingQuery) Stream(ctx context.Context) (remote.ResultStream, error) {
+	q := sq.compatibilityQuery
+	if _, ok := q.expr.(*parser.StringLiteral); ok {
+		return nil, errors.Newf("cannot stream result of string expression %s", q.expr)
+	}
+
+	ctx, run := q.start(ctx)
+	s := &resultStream{query: q, run: run, warns: q.warns}
+	ctx, err := q.admit(ctx, run)
+	if err != nil {
+		s.finish(err)
+		return nil, err
+	}
+	s.ctx = ctx
+
+	// Release the resources of the stream when its consumer stops reading from it.
+	// The context is also done once the stream is finished, since its cancel
+	// function is called by finish.
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.finish(ctx.Err())
+	}()
+	return s, nil
+}
+
+type resultStream struct {
+	query *compatibilityQuery
+	ctx   context.Context
+	run   *queryRun
+
+	mu       sync.Mutex
+	finished bool
+	err      error
+	warns    annotations.Annotations
+	// returned are the vectors returned by the last call to Next.
+	// They are recycled on the next call.
+	returned []model.StepVector
+}
+
+func (s *resultStream) Series() (_ []labels.Labels, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.finishOnError(&err)
+	defer recoverEngine(s.query.engine.logger, s.query.expr, &err)
+	if s.finished {
+		return nil, s.err
+	}
+
+	prepareSpanTimer, _ := s.query.timers.GetSpanTimer(s.ctx, stats.QueryPreparationTime)
+	series, err := s.query.exec.Series(s.ctx)
+	prepareSpanTimer.Finish()
+	if err == nil {
+		err = s.query.memoryTracker.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Scalars are returned as a single series without labels, same as in results of range queries.
+	if len(series) == 0 && s.query.expr.Type() == parser.ValueTypeScalar {
+		series = []labels.Labels{labels.EmptyLabels()}
+	}
+
+	innerEvalSpanTimer, _ := s.query.timers.GetSpanTimer(s.ctx, stats.InnerEvalTime)
+	s.run.onFinish(func(*promql.Result) { innerEvalSpanTimer.Finish() })
+	return series, nil
+}
+
+func (s *resultStream) Next() (_ []model.StepVector, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.finishOnError(&err)
+	defer recoverEngine(s.query.engine.logger, s.query.expr, &err)
+	s.recycle()
+	if s.finished {
+		return nil, s.err
+	}
+
+	select {
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	default:
+	}
+	r, err := s.query.exec.Next(s.ctx)
+	if err == nil {
+		// Buffers are allocated from pools which cannot fail, so we check the limit after each batch.
+		err = s.query.memoryTracker.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		s.finish(nil)
+		return nil, nil
+	}
+	s.returned = r
+	return r, nil
+}
+
+func (s *resultStream) Warnings() annotations.Annotations {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.warns
+}
+
+func (s *resultStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recycle()
+	s.finish(nil)
+}
+
+// finishOnError finishes the stream when reading from it failed, including when its operators panicked.
+func (s *resultStream) finishOnError(errp *error) {
+	if *errp != nil {
+		s.finish(*errp)
+	}
+}
+
+func (s *resultStream) recycle() {
+	if s.returned == nil {
+		return
+	}
+	pool := s.query.exec.GetPool()
+	for _, vector := range s.returned {
+		pool.PutStepVector(vector)
+	}
+	pool.PutVectors(s.returned)
+	s.returned = nil
+}
+
+// finish finishes the execution of the query. It has to be called with the lock held.
+func (s *resultStream) finish(err error) {
+	if s.finished {
+		return
+	}
+	s.finished = true
+	s.err = err
+	res := &promql.Result{Err: err, Warnings: s.warns}
+	s.run.finish(res)
+	s.warns = res.Warnings
+}
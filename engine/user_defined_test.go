@@ -37,6 +37,7 @@ load 30s
 	newEngine := engine.New(engine.Opts{
 		EngineOpts:      opts,
 		DisableFallback: true,
+		EnableAnalysis:  true,
 		LogicalOptimizers: []logicalplan.Optimizer{
 			&injectVectorSelector{},
 		},
@@ -57,6 +58,17 @@ load 30s
 	mat, err := result.Matrix()
 	testutil.Ok(t, err)
 	testutil.Equals(t, expected, mat)
+
+	// Operators of user defined expressions only implement model.OperatorTelemetry, so they report no stats.
+	analysis := qry.(engine.ExplainableQuery).Analyze()
+	testutil.Assert(t, analysis != nil, "expected analysis")
+	leaf := *analysis
+	for len(leaf.Children) > 0 {
+		leaf = leaf.Children[0]
+	}
+	testutil.Equals(t, "vectorSelectorOperator", leaf.OperatorTelemetry.Name())
+	testutil.Equals(t, 0, leaf.Stats.Series)
+	testutil.Equals(t, int64(0), leaf.Stats.SamplesOut)
 }
 
 type injectVectorSelector struct{}
@@ -80,6 +92,8 @@ type logicalVectorSelector struct {
 
 func (c logicalVectorSelector) MakeExecutionOperator(vectors *model.VectorPool, _ *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
 	return &vectorSelectorOperator{
+		OperatorTelemetry: &userTelemetry{name: "vectorSelectorOperator"},
+
 		stepsBatch: opts.StepsBatch,
 		vectors:    vectors,
 
@@ -91,6 +105,8 @@ func (c logicalVectorSelector) MakeExecutionOperator(vectors *model.VectorPool,
 }
 
 type vectorSelectorOperator struct {
+	model.OperatorTelemetry
+
 	stepsBatch int
 	vectors    *model.VectorPool
 
@@ -129,3 +145,21 @@ func (c *vectorSelectorOperator) GetPool() *model.VectorPool {
 func (c *vectorSelectorOperator) Explain() (me string, next []model.VectorOperator) {
 	return "vectorSelectorOperator", nil
 }
+
+func (c *vectorSelectorOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
+	return c, nil
+}
+
+// userTelemetry implements only the methods of model.OperatorTelemetry.
+type userTelemetry struct {
+	name          string
+	executionTime time.Duration
+}
+
+func (u *userTelemetry) AddExecutionTimeTaken(t time.Duration) { u.executionTime += t }
+
+func (u *userTelemetry) ExecutionTimeTaken() time.Duration { return u.executionTime }
+
+func (u *userTelemetry) SetName(name string) { u.name = name }
+
+func (u *userTelemetry) Name() string { return u.name }
@@ -0,0 +1,307 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package aggregate
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/efficientgo/core/errors"
+	prommodel "github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"golang.org/x/exp/slices"
+
+	"github.com/thanos-io/promql-engine/execution/limits"
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/query"
+)
+
+// countValuesOperator counts the number of samples with the same value in each group.
+// Output series depend on the values of the input samples, so the operator
+// has to evaluate all steps of its input before it can return its series.
+type countValuesOperator struct {
+	model.StatsTelemetry
+
+	pool  *model.VectorPool
+	next  model.VectorOperator
+	param string
+
+	by       bool
+	grouping []string
+
+	stepsBatch int
+	curStep    int
+
+	// ts, ids and counts hold the output of every step.
+	ts     []int64
+	ids    [][]uint64
+	counts [][]float64
+
+	series []labels.Labels
+	once   sync.Once
+
+	memoryTracker *limits.MemoryTracker
+}
+
+const (
+	// countValuesStepSize is the size of the timestamp, output IDs and counts of a step.
+	countValuesStepSize = int64(unsafe.Sizeof(int64(0)) + unsafe.Sizeof([]uint64(nil)) + unsafe.Sizeof([]float64(nil)))
+	// countValuesEntrySize is the size of the output ID and count of an output series in a step,
+	// including the entry of the map which counts the samples.
+	countValuesEntrySize = int64(unsafe.Sizeof(uint64(0))+unsafe.Sizeof(float64(0))) + 2*int64(unsafe.Sizeof(uint64(0))+unsafe.Sizeof(int(0)))
+)
+
+func NewCountValues(pool *model.VectorPool, next model.VectorOperator, param string, by bool, grouping []string, opts *query.Options) model.VectorOperator {
+	// Grouping labels need to be sorted in order for metric hashing to work.
+	// https://github.com/prometheus/prometheus/blob/8ed39fdab1ead382a354e45ded999eb3610f8d5f/model/labels/labels.go#L162-L181
+	slices.Sort(grouping)
+	op := &countValuesOperator{
+		pool:       pool,
+		next:       next,
+		param:      param,
+		stepsBatch: opts.StepsBatch,
+		by:         by,
+		grouping:   grouping,
+
+		memoryTracker: opts.MemoryTracker,
+	}
+	op.StatsTelemetry = &model.NoopTelemetry{}
+	if opts.EnableAnalysis {
+		op.StatsTelemetry = &model.TrackedTelemetry{}
+	}
+	return op
+}
+
+func (c *countValuesOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
+	c.SetName("[*countValuesOperator]")
+	next := make([]model.ObservableVectorOperator, 0, 1)
+	if obsnext, ok := c.next.(model.ObservableVectorOperator); ok {
+		next = append(next, obsnext)
+	}
+	return c, next
+}
+
+func (c *countValuesOperator) Explain() (me string, next []model.VectorOperator) {
+	if c.by {
+		return fmt.Sprintf("[*countValuesOperator] by (%v) %q", c.grouping, c.param), []model.VectorOperator{c.next}
+	}
+	return fmt.Sprintf("[*countValuesOperator] without (%v) %q", c.grouping, c.param), []model.VectorOperator{c.next}
+}
+
+// EvaluatesInputForSeries marks the operator as evaluating its input when its series are loaded,
+// since the series of count_values depend on the values of its input.
+func (c *countValuesOperator) EvaluatesInputForSeries() {}
+
+func (c *countValuesOperator) GetPool() *model.VectorPool {
+	return c.pool
+}
+
+func (c *countValuesOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	c.once.Do(func() { err = c.initSeriesOnce(ctx) })
+	return c.series, err
+}
+
+func (c *countValuesOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	c.once.Do(func() { err = c.initSeriesOnce(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	defer func() { c.AddExecutionTimeTaken(time.Since(start)) }()
+
+	if c.curStep >= len(c.ts) {
+		return nil, nil
+	}
+
+	batch := c.pool.GetVectorBatch()
+	for i := 0; i < c.stepsBatch; i++ {
+		if c.curStep >= len(c.ts) {
+			break
+		}
+		sv := c.pool.GetStepVector(c.ts[c.curStep])
+		for j := range c.ids[c.curStep] {
+			sv.AppendSample(c.pool, c.ids[c.curStep][j], c.counts[c.curStep][j])
+		}
+		batch = append(batch, sv)
+		c.curStep++
+	}
+	c.AddNextCall(batch)
+	return batch, nil
+}
+
+func (c *countValuesOperator) initSeriesOnce(ctx context.Context) error {
+	if !prommodel.LabelName(c.param).IsValid() {
+		return errors.Newf("invalid label name %q", c.param)
+	}
+
+	nextSeries, err := c.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The value label overrides any existing label with the same name, so it
+	// is always excluded when computing the group of an input series.
+	var (
+		grouping    []string
+		addValue    = true
+		groupingSet = make(map[string]struct{})
+	)
+	for _, lbl := range c.grouping {
+		if lbl == c.param {
+			// Dropping the value label in a without clause drops it from the output as well.
+			addValue = c.by
+			continue
+		}
+		grouping = append(grouping, lbl)
+	}
+	if !c.by {
+		grouping = append(grouping, c.param)
+		slices.Sort(grouping)
+	}
+	for _, lbl := range grouping {
+		groupingSet[lbl] = struct{}{}
+	}
+
+	if err := c.memoryTracker.Reserve(int64(len(nextSeries)) * inputCacheEntrySize); err != nil {
+		return err
+	}
+	var (
+		inputGroups  = make([]int, len(nextSeries))
+		groupLabels  = make([]labels.Labels, 0)
+		groupsByHash = make(map[uint64]int)
+		hashingBuf   = make([]byte, 1024)
+		builder      labels.ScratchBuilder
+	)
+	for i, s := range nextSeries {
+		hash, _, lbls := hashMetric(builder, s, !c.by, grouping, groupingSet, hashingBuf)
+		group, ok := groupsByHash[hash]
+		if !ok {
+			if err := c.memoryTracker.Reserve(limits.LabelsSize(lbls)); err != nil {
+				return err
+			}
+			group = len(groupLabels)
+			groupsByHash[hash] = group
+			groupLabels = append(groupLabels, lbls)
+		}
+		inputGroups[i] = group
+	}
+
+	var (
+		// outputIDs maps a group and a formatted sample value to an output series.
+		outputIDs = make([]map[string]uint64, len(groupLabels))
+		series    = make([]labels.Labels, 0)
+		lb        = labels.NewBuilder(labels.EmptyLabels())
+	)
+	for i := range outputIDs {
+		outputIDs[i] = make(map[string]uint64)
+	}
+	outputID := func(group int, value string) (uint64, error) {
+		if !addValue {
+			// All values of a group are counted in a single series.
+			value = ""
+		}
+		if id, ok := outputIDs[group][value]; ok {
+			return id, nil
+		}
+		lb.Reset(groupLabels[group])
+		if addValue {
+			lb.Set(c.param, value)
+		}
+		lbls := lb.Labels()
+		if err := c.memoryTracker.Reserve(outputSeriesSize + limits.LabelsSize(lbls) + int64(len(value))); err != nil {
+			return 0, err
+		}
+		id := uint64(len(series))
+		series = append(series, lbls)
+		outputIDs[group][value] = id
+		return id, nil
+	}
+
+	var (
+		ts = make([]int64, 0)
+		// Inputs can return multiple batches for the same steps, so each step has
+		// to be looked up by its timestamp.
+		stepsByTs  = make(map[int64]int)
+		stepIDs    = make([][]uint64, 0)
+		stepCounts = make([]map[uint64]int, 0)
+	)
+	for {
+		in, err := c.next.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if in == nil {
+			break
+		}
+		c.AddSamplesIn(model.CountSamples(in))
+		for _, vector := range in {
+			step, ok := stepsByTs[vector.T]
+			if !ok {
+				if err := c.memoryTracker.Reserve(countValuesStepSize); err != nil {
+					return err
+				}
+				step = len(ts)
+				stepsByTs[vector.T] = step
+				ts = append(ts, vector.T)
+				stepIDs = append(stepIDs, make([]uint64, 0))
+				stepCounts = append(stepCounts, make(map[uint64]int))
+			}
+			count := func(sampleID uint64, v float64) error {
+				id, err := outputID(inputGroups[sampleID], strconv.FormatFloat(v, 'f', -1, 64))
+				if err != nil {
+					return err
+				}
+				if _, ok := stepCounts[step][id]; !ok {
+					if err := c.memoryTracker.Reserve(countValuesEntrySize); err != nil {
+						return err
+					}
+					stepIDs[step] = append(stepIDs[step], id)
+				}
+				stepCounts[step][id]++
+				return nil
+			}
+			for i, sampleID := range vector.SampleIDs {
+				if err := count(sampleID, vector.Samples[i]); err != nil {
+					return err
+				}
+			}
+			// Prometheus uses the float value of histogram samples, which is always zero.
+			for _, sampleID := range vector.HistogramIDs {
+				if err := count(sampleID, 0); err != nil {
+					return err
+				}
+			}
+			c.next.GetPool().PutStepVector(vector)
+		}
+		c.next.GetPool().PutVectors(in)
+	}
+
+	counts := make([][]float64, len(ts))
+	for step, ids := range stepIDs {
+		counts[step] = make([]float64, len(ids))
+		for i, id := range ids {
+			counts[step][i] = float64(stepCounts[step][id])
+		}
+	}
+
+	c.ts = ts
+	c.ids = stepIDs
+	c.counts = counts
+	c.series = series
+	c.SetSeries(len(series))
+	return nil
+}
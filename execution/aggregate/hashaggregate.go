@@ -9,6 +9,7 @@ import (
 	"math"
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
@@ -16,13 +17,14 @@ import (
 
 	"github.com/prometheus/prometheus/promql/parser"
 
+	"github.com/thanos-io/promql-engine/execution/limits"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/parse"
 	"github.com/thanos-io/promql-engine/query"
 )
 
 type aggregate struct {
-	model.OperatorTelemetry
+	model.StatsTelemetry
 
 	next    model.VectorOperator
 	paramOp model.VectorOperator
@@ -40,8 +42,17 @@ type aggregate struct {
 	tables     []aggregateTable
 	series     []labels.Labels
 	stepsBatch int
+
+	memoryTracker *limits.MemoryTracker
 }
 
+const (
+	inputCacheEntrySize = int64(unsafe.Sizeof(uint64(0)))
+	outputSeriesSize    = int64(unsafe.Sizeof(model.Series{}))
+	// accumulatorSize is an approximation since accumulators differ in size.
+	accumulatorSize = int64(unsafe.Sizeof(avgAcc{}))
+)
+
 func NewHashAggregate(
 	points *model.VectorPool,
 	next model.VectorOperator,
@@ -60,7 +71,7 @@ func NewHashAggregate(
 	// https://github.com/prometheus/prometheus/blob/8ed39fdab1ead382a354e45ded999eb3610f8d5f/model/labels/labels.go#L162-L181
 	slices.Sort(labels)
 	a := &aggregate{
-		OperatorTelemetry: &model.TrackedTelemetry{},
+		StatsTelemetry: &model.TrackedTelemetry{},
 
 		next:        next,
 		paramOp:     paramOp,
@@ -70,6 +81,8 @@ func NewHashAggregate(
 		aggregation: aggregation,
 		labels:      labels,
 		stepsBatch:  opts.StepsBatch,
+
+		memoryTracker: opts.MemoryTracker,
 	}
 
 	return a, nil
@@ -158,6 +171,7 @@ func (a *aggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 		if next == nil {
 			break
 		}
+		a.AddSamplesIn(model.CountSamples(next))
 		// Keep aggregating samples as long as timestamps of batches are equal.
 		currentTs := a.tables[0].timestamp()
 		if currentTs == math.MinInt64 || next[0].T == currentTs {
@@ -179,6 +193,7 @@ func (a *aggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 		}
 		result = append(result, a.tables[i].toVector(a.vectorPool))
 	}
+	a.AddNextCall(result)
 	return result, nil
 }
 
@@ -207,6 +222,7 @@ func (a *aggregate) initializeTables(ctx context.Context) error {
 	}
 	a.tables = tables
 	a.series = series
+	a.SetSeries(len(series))
 	a.vectorPool.SetStepSize(len(a.series))
 
 	return nil
@@ -230,6 +246,9 @@ func (a *aggregate) initializeScalarTables(ctx context.Context) ([]aggregateTabl
 	if err != nil {
 		return nil, nil, err
 	}
+	if err := a.memoryTracker.Reserve(int64(len(series)) * inputCacheEntrySize); err != nil {
+		return nil, nil, err
+	}
 	var (
 		// inputCache is an index from input seriesID to output seriesID.
 		inputCache = make([]uint64, len(series))
@@ -256,6 +275,10 @@ func (a *aggregate) initializeScalarTables(ctx context.Context) ([]aggregateTabl
 			}
 			outputMap[hash] = output
 			outputCache = append(outputCache, output)
+			// Each output series has one accumulator for every step in the batch.
+			if err := a.memoryTracker.Reserve(outputSeriesSize + limits.LabelsSize(lbls) + int64(a.stepsBatch)*accumulatorSize); err != nil {
+				return nil, nil, err
+			}
 		}
 
 		inputCache[i] = output.ID
@@ -11,6 +11,7 @@ import (
 	"sort"
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
@@ -18,6 +19,7 @@ import (
 
 	"github.com/prometheus/prometheus/promql/parser"
 
+	"github.com/thanos-io/promql-engine/execution/limits"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/query"
 )
@@ -39,9 +41,16 @@ type kAggregate struct {
 	inputToHeap []*samplesHeap
 	heaps       []*samplesHeap
 	compare     func(float64, float64) bool
-	model.OperatorTelemetry
+	model.StatsTelemetry
+
+	memoryTracker *limits.MemoryTracker
 }
 
+const (
+	heapSize      = int64(unsafe.Sizeof(samplesHeap{}))
+	heapEntrySize = int64(unsafe.Sizeof(entry{}))
+)
+
 func NewKHashAggregate(
 	points *model.VectorPool,
 	next model.VectorOperator,
@@ -75,10 +84,12 @@ func NewKHashAggregate(
 		paramOp:     paramOp,
 		compare:     compare,
 		params:      make([]float64, opts.StepsBatch),
+
+		memoryTracker: opts.MemoryTracker,
 	}
-	a.OperatorTelemetry = &model.NoopTelemetry{}
+	a.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		a.OperatorTelemetry = &model.TrackedTelemetry{}
+		a.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 	return a, nil
 }
@@ -117,6 +128,7 @@ func (a *kAggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, err
 	}
 
+	a.AddSamplesIn(model.CountSamples(in))
 	result := a.vectorPool.GetVectorBatch()
 	for i, vector := range in {
 		// Skip steps where the argument is less than or equal to 0.
@@ -124,11 +136,14 @@ func (a *kAggregate) Next(ctx context.Context) ([]model.StepVector, error) {
 			result = append(result, a.GetPool().GetStepVector(vector.T))
 			continue
 		}
-		a.aggregate(vector.T, &result, int(a.params[i]), vector.SampleIDs, vector.Samples)
+		if err := a.aggregate(vector.T, &result, int(a.params[i]), vector.SampleIDs, vector.Samples); err != nil {
+			return nil, err
+		}
 		a.next.GetPool().PutStepVector(vector)
 	}
 	a.next.GetPool().PutVectors(in)
 	a.AddExecutionTimeTaken(time.Since(start))
+	a.AddNextCall(result)
 
 	return result, nil
 }
@@ -183,10 +198,16 @@ func (a *kAggregate) init(ctx context.Context) error {
 	for _, lblName := range a.labels {
 		labelsMap[lblName] = struct{}{}
 	}
+	if err := a.memoryTracker.Reserve(int64(len(series)) * inputCacheEntrySize); err != nil {
+		return err
+	}
 	for i := 0; i < len(series); i++ {
 		hash, _, _ := hashMetric(builder, series[i], !a.by, a.labels, labelsMap, hashingBuf)
 		h, ok := heapsHash[hash]
 		if !ok {
+			if err := a.memoryTracker.Reserve(heapSize); err != nil {
+				return err
+			}
 			h = &samplesHeap{compare: a.compare}
 			heapsHash[hash] = h
 			a.heaps = append(a.heaps, h)
@@ -195,15 +216,21 @@ func (a *kAggregate) init(ctx context.Context) error {
 	}
 	a.vectorPool.SetStepSize(len(series))
 	a.series = series
+	a.SetSeries(len(series))
 	return nil
 }
 
-func (a *kAggregate) aggregate(t int64, result *[]model.StepVector, k int, sampleIDs []uint64, samples []float64) {
+func (a *kAggregate) aggregate(t int64, result *[]model.StepVector, k int, sampleIDs []uint64, samples []float64) error {
 	for i, sId := range sampleIDs {
 		h := a.inputToHeap[sId]
 		switch {
 		case h.Len() < k:
+			// Heaps are reused between steps, so only their growth is charged.
+			before := cap(h.entries)
 			heap.Push(h, &entry{sId: sId, total: samples[i]})
+			if err := a.memoryTracker.Reserve(int64(cap(h.entries)-before) * heapEntrySize); err != nil {
+				return err
+			}
 
 		case h.compare(h.entries[0].total, samples[i]) || (math.IsNaN(h.entries[0].total) && !math.IsNaN(samples[i])):
 			h.entries[0].sId = sId
@@ -228,6 +255,7 @@ func (a *kAggregate) aggregate(t int64, result *[]model.StepVector, k int, sampl
 		h.entries = h.entries[:0]
 	}
 	*result = append(*result, s)
+	return nil
 }
 
 type entry struct {
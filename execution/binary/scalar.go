@@ -45,7 +45,7 @@ type scalarOperator struct {
 
 	// Keep the result if both sides are scalars.
 	bothScalars bool
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func NewScalar(
@@ -82,9 +82,9 @@ func NewScalar(
 		returnBool:    returnBool,
 		bothScalars:   scalarSide == ScalarSideBoth,
 	}
-	o.OperatorTelemetry = &model.NoopTelemetry{}
+	o.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		o.OperatorTelemetry = &model.TrackedTelemetry{}
+		o.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 	return o, nil
 
@@ -140,6 +140,7 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, err
 	}
 
+	o.AddSamplesIn(model.CountSamples(in) + model.CountSamples(scalarIn))
 	out := o.pool.GetVectorBatch()
 	for v, vector := range in {
 		step := o.pool.GetStepVector(vector.T)
@@ -182,6 +183,7 @@ func (o *scalarOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	o.next.GetPool().PutVectors(in)
 	o.scalar.GetPool().PutVectors(scalarIn)
 	o.AddExecutionTimeTaken(time.Since(start))
+	o.AddNextCall(out)
 
 	return out, nil
 }
@@ -210,6 +212,7 @@ func (o *scalarOperator) loadSeries(ctx context.Context) error {
 	}
 
 	o.series = series
+	o.SetSeries(len(series))
 	return nil
 }
 
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"time"
+	"unsafe"
 
 	"golang.org/x/exp/slices"
 
@@ -19,6 +21,7 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 
+	"github.com/thanos-io/promql-engine/execution/limits"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/query"
 )
@@ -29,6 +32,15 @@ type joinBucket struct {
 	val      float64
 }
 
+const (
+	// joinEntrySize approximates the bytes needed to index one input series:
+	// its join bucket, a pointer to it and its signature.
+	joinEntrySize = int64(unsafe.Sizeof(joinBucket{})) + 3*int64(unsafe.Sizeof(uint64(0)))
+	// outputEntrySize approximates the bytes needed for one output series
+	// and its entry in the output map.
+	outputEntrySize = int64(unsafe.Sizeof(labels.Labels{})) + 2*int64(unsafe.Sizeof(uint64(0)))
+)
+
 // vectorOperator evaluates an expression between two step vectors.
 type vectorOperator struct {
 	pool *model.VectorPool
@@ -55,7 +67,9 @@ type vectorOperator struct {
 	// If true then 1/0 needs to be returned instead of the value.
 	returnBool bool
 
-	model.OperatorTelemetry
+	memoryTracker *limits.MemoryTracker
+
+	model.StatsTelemetry
 }
 
 func NewVectorOperator(
@@ -75,11 +89,13 @@ func NewVectorOperator(
 		opType:     opType,
 		returnBool: returnBool,
 		sigFunc:    signatureFunc(matching.On, matching.MatchingLabels...),
+
+		memoryTracker: opts.MemoryTracker,
 	}
 
-	o.OperatorTelemetry = &model.NoopTelemetry{}
+	o.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		o.OperatorTelemetry = &model.TrackedTelemetry{}
+		o.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 	return o, nil
 }
@@ -116,6 +132,8 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, ctx.Err()
 	default:
 	}
+	start := time.Now()
+	defer func() { o.AddExecutionTimeTaken(time.Since(start)) }()
 
 	// Some operators do not call Series of all their children.
 	if err := o.initOnce(ctx); err != nil {
@@ -149,6 +167,7 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, nil
 	}
 
+	o.AddSamplesIn(model.CountSamples(lhs) + model.CountSamples(rhs))
 	batch := o.pool.GetVectorBatch()
 	for i, vector := range lhs {
 		if i < len(rhs) {
@@ -163,6 +182,7 @@ func (o *vectorOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	}
 	o.lhs.GetPool().PutVectors(lhs)
 	o.rhs.GetPool().PutVectors(rhs)
+	o.AddNextCall(batch)
 
 	return batch, nil
 }
@@ -203,9 +223,7 @@ func (o *vectorOperator) init(ctx context.Context) error {
 		highCardSide, lowCardSide = lowCardSide, highCardSide
 	}
 
-	o.initJoinTables(highCardSide, lowCardSide)
-
-	return nil
+	return o.initJoinTables(highCardSide, lowCardSide)
 }
 
 func (o *vectorOperator) execBinaryOperation(lhs, rhs model.StepVector) (model.StepVector, error) {
@@ -355,7 +373,11 @@ func (o *vectorOperator) outputSeriesID(hc, lc uint64) uint64 {
 	return res
 }
 
-func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Labels) {
+func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Labels) error {
+	// Every input series is indexed by its signature and references a join bucket.
+	if err := o.memoryTracker.Reserve(int64(len(highCardSide)+len(lowCardSide)) * joinEntrySize); err != nil {
+		return err
+	}
 	var (
 		joinBucketsByHash     = make(map[uint64]*joinBucket)
 		lcJoinBuckets         = make([]*joinBucket, len(lowCardSide))
@@ -433,10 +455,20 @@ func (o *vectorOperator) initJoinTables(highCardSide, lowCardSide []labels.Label
 			}
 		}
 	}
+	var outputSize int64
+	for _, s := range h.ls {
+		outputSize += outputEntrySize + limits.LabelsSize(s)
+	}
+	if err := o.memoryTracker.Reserve(outputSize); err != nil {
+		return err
+	}
+
 	o.series = h.ls
+	o.SetSeries(len(h.ls))
 	o.outputMap = outputMap
 	o.lcJoinBuckets = lcJoinBuckets
 	o.hcJoinBuckets = hcJoinBuckets
+	return nil
 }
 
 type joinHelper struct {
@@ -46,7 +46,7 @@ type coalesce struct {
 	inVectors [][]model.StepVector
 	// sampleOffsets holds per-operator offsets needed to map an input sample ID to an output sample ID.
 	sampleOffsets []uint64
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func NewCoalesce(pool *model.VectorPool, opts *query.Options, batchSize int64, operators ...model.VectorOperator) model.VectorOperator {
@@ -57,9 +57,9 @@ func NewCoalesce(pool *model.VectorPool, opts *query.Options, batchSize int64, o
 		inVectors:     make([][]model.StepVector, len(operators)),
 		batchSize:     batchSize,
 	}
-	c.OperatorTelemetry = &model.NoopTelemetry{}
+	c.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		c.OperatorTelemetry = &model.TrackedTelemetry{}
+		c.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 	return c
 }
@@ -160,6 +160,7 @@ func (c *coalesce) Next(ctx context.Context) ([]model.StepVector, error) {
 			continue
 		}
 
+		c.AddSamplesIn(model.CountSamples(vectors))
 		if len(vectors) > 0 && out == nil {
 			out = c.pool.GetVectorBatch()
 			for i := 0; i < len(vectors); i++ {
@@ -179,6 +180,7 @@ func (c *coalesce) Next(ctx context.Context) ([]model.StepVector, error) {
 	if out == nil {
 		return nil, nil
 	}
+	c.AddNextCall(out)
 
 	return out, nil
 }
@@ -231,5 +233,6 @@ func (c *coalesce) loadSeries(ctx context.Context) error {
 		c.batchSize = int64(len(c.series))
 	}
 	c.pool.SetStepSize(int(c.batchSize))
+	c.SetSeries(len(c.series))
 	return nil
 }
@@ -24,7 +24,7 @@ type concurrencyOperator struct {
 	next       model.VectorOperator
 	buffer     chan maybeStepVector
 	bufferSize int
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func NewConcurrent(next model.VectorOperator, bufferSize int) model.VectorOperator {
@@ -33,7 +33,7 @@ func NewConcurrent(next model.VectorOperator, bufferSize int) model.VectorOperat
 		buffer:     make(chan maybeStepVector, bufferSize),
 		bufferSize: bufferSize,
 	}
-	c.OperatorTelemetry = &model.TrackedTelemetry{}
+	c.StatsTelemetry = &model.TrackedTelemetry{}
 	return c
 }
 
@@ -51,7 +51,12 @@ func (c *concurrencyOperator) Explain() (me string, next []model.VectorOperator)
 }
 
 func (c *concurrencyOperator) Series(ctx context.Context) ([]labels.Labels, error) {
-	return c.next.Series(ctx)
+	series, err := c.next.Series(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.SetSeries(len(series))
+	return series, nil
 }
 
 func (c *concurrencyOperator) GetPool() *model.VectorPool {
@@ -79,6 +84,8 @@ func (c *concurrencyOperator) Next(ctx context.Context) ([]model.StepVector, err
 		return nil, r.err
 	}
 	c.AddExecutionTimeTaken(time.Since(start))
+	c.AddSamplesIn(model.CountSamples(r.stepVector))
+	c.AddNextCall(r.stepVector)
 
 	return r.stepVector, nil
 }
@@ -38,7 +38,7 @@ type dedupOperator struct {
 	// outputIndex is a slice that is used as an index from input sample ID to output sample ID.
 	outputIndex []uint64
 	dedupCache  dedupCache
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func NewDedupOperator(pool *model.VectorPool, next model.VectorOperator) model.VectorOperator {
@@ -46,7 +46,7 @@ func NewDedupOperator(pool *model.VectorPool, next model.VectorOperator) model.V
 		next: next,
 		pool: pool,
 	}
-	d.OperatorTelemetry = &model.TrackedTelemetry{}
+	d.StatsTelemetry = &model.TrackedTelemetry{}
 	return d
 }
 
@@ -74,6 +74,7 @@ func (d *dedupOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	if in == nil {
 		return nil, nil
 	}
+	d.AddSamplesIn(model.CountSamples(in))
 
 	result := d.pool.GetVectorBatch()
 	for _, vector := range in {
@@ -106,6 +107,7 @@ func (d *dedupOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 		result = append(result, out)
 	}
 	d.AddExecutionTimeTaken(time.Since(start))
+	d.AddNextCall(result)
 
 	return result, nil
 }
@@ -153,6 +155,7 @@ func (d *dedupOperator) loadSeries(ctx context.Context) error {
 		outputSeriesID := outputIndex[hash]
 		d.outputIndex[inputSeriesID] = outputSeriesID
 	}
+	d.SetSeries(len(d.series))
 	d.dedupCache = make(dedupCache, len(outputIndex))
 	for i := range d.dedupCache {
 		d.dedupCache[i].t = -1
@@ -17,7 +17,7 @@
 package execution
 
 import (
-	"runtime"
+	"fmt"
 	"sort"
 	"time"
 
@@ -28,6 +28,7 @@ import (
 
 	"github.com/prometheus/prometheus/promql/parser"
 
+	"github.com/thanos-io/promql-engine/api"
 	"github.com/thanos-io/promql-engine/execution/aggregate"
 	"github.com/thanos-io/promql-engine/execution/binary"
 	"github.com/thanos-io/promql-engine/execution/exchange"
@@ -47,7 +48,7 @@ import (
 // New creates new physical query execution for a given query expression which represents logical plan.
 // TODO(bwplotka): Add definition (could be parameters for each execution operator) we can optimize - it would represent physical plan.
 func New(expr parser.Expr, queryable storage.Queryable, opts *query.Options) (model.VectorOperator, error) {
-	selectorPool := engstore.NewSelectorPool(queryable)
+	selectorPool := engstore.NewSelectorPool(queryable, opts.MemoryTracker)
 	hints := storage.SelectHints{
 		Start: opts.Start.UnixMilli(),
 		End:   opts.End.UnixMilli(),
@@ -60,27 +61,23 @@ func New(expr parser.Expr, queryable storage.Queryable, opts *query.Options) (mo
 func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
 	switch e := expr.(type) {
 	case *parser.NumberLiteral:
-		return scan.NewNumberLiteralSelector(model.NewVectorPool(opts.StepsBatch), opts, e.Val), nil
+		return traced(scan.NewNumberLiteralSelector(newVectorPool(opts), opts, e.Val), opts), nil
 
 	case *parser.VectorSelector:
-		start, end := getTimeRangesForVectorSelector(e, opts, 0)
-		hints.Start = start
-		hints.End = end
-		filter := storage.GetSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, hints)
-		return newShardedVectorSelector(filter, opts, e.Offset, 0)
+		return newVectorSelector(e, storage, opts, hints, false)
 
 	case *logicalplan.VectorSelector:
-		start, end := getTimeRangesForVectorSelector(e.VectorSelector, opts, 0)
-		hints.Start = start
-		hints.End = end
-		selector := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, e.Filters, hints)
-		return newShardedVectorSelector(selector, opts, e.Offset, e.BatchSize)
+		return newVectorSelector(e, storage, opts, hints, false)
 
 	case *parser.Call:
 		hints.Func = e.Func.Name
 		hints.Grouping = nil
 		hints.By = false
 
+		if e.Func.Name == "timestamp" {
+			return newTimestampFunction(e, storage, opts, hints)
+		}
+
 		if e.Func.Name == "absent_over_time" {
 			return newAbsentOverTimeOperator(e, storage, opts, hints)
 		}
@@ -91,7 +88,7 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			switch t := e.Args[i].(type) {
 			case *parser.SubqueryExpr:
 				if !opts.EnableSubqueries {
-					return nil, parse.ErrNotImplemented
+					return nil, parse.WithReason(parse.ErrNotImplemented, "subquery")
 				}
 				return newSubqueryFunction(e, t, storage, opts, hints)
 			case *parser.MatrixSelector:
@@ -118,17 +115,25 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			}
 		}
 
+		if e.Op == parser.COUNT_VALUES {
+			param, err := unwrapStringVal(e.Param)
+			if err != nil {
+				return nil, err
+			}
+			return newConcurrent(traced(aggregate.NewCountValues(newVectorPool(opts), next, param, !e.Without, e.Grouping, opts), opts), opts), nil
+		}
+
 		if e.Op == parser.TOPK || e.Op == parser.BOTTOMK {
-			next, err = aggregate.NewKHashAggregate(model.NewVectorPool(opts.StepsBatch), next, paramOp, e.Op, !e.Without, e.Grouping, opts)
+			next, err = aggregate.NewKHashAggregate(newVectorPool(opts), next, paramOp, e.Op, !e.Without, e.Grouping, opts)
 		} else {
-			next, err = aggregate.NewHashAggregate(model.NewVectorPool(opts.StepsBatch), next, paramOp, e.Op, !e.Without, e.Grouping, opts)
+			next, err = aggregate.NewHashAggregate(newVectorPool(opts), next, paramOp, e.Op, !e.Without, e.Grouping, opts)
 		}
 
 		if err != nil {
 			return nil, err
 		}
 
-		return exchange.NewConcurrent(next, 2), nil
+		return newConcurrent(traced(next, opts), opts), nil
 
 	case *parser.BinaryExpr:
 		if e.LHS.Type() == parser.ValueTypeScalar || e.RHS.Type() == parser.ValueTypeScalar {
@@ -149,23 +154,31 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		case parser.ADD:
 			return next, nil
 		case parser.SUB:
-			return unary.NewUnaryNegation(next, opts.StepsBatch)
+			negation, err := unary.NewUnaryNegation(next, opts.StepsBatch)
+			if err != nil {
+				return nil, err
+			}
+			return traced(negation, opts), nil
 		default:
 			// This shouldn't happen as Op was validated when parsing already
 			// https://github.com/prometheus/prometheus/blob/v2.38.0/promql/parser/parse.go#L573.
-			return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
+			return nil, parse.WithReason(errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e), "unary operation "+e.Op.String())
 		}
 
 	case *parser.StepInvariantExpr:
 		switch t := e.Expr.(type) {
 		case *parser.NumberLiteral:
-			return scan.NewNumberLiteralSelector(model.NewVectorPool(opts.StepsBatch), opts, t.Val), nil
+			return traced(scan.NewNumberLiteralSelector(newVectorPool(opts), opts, t.Val), opts), nil
 		}
 		next, err := newOperator(e.Expr, storage, opts.WithEndTime(opts.Start), hints)
 		if err != nil {
 			return nil, err
 		}
-		return step_invariant.NewStepInvariantOperator(model.NewVectorPoolWithSize(opts.StepsBatch, 1), next, e.Expr, opts)
+		next, err = step_invariant.NewStepInvariantOperator(newVectorPoolWithSize(opts, 1), next, e.Expr, opts)
+		if err != nil {
+			return nil, err
+		}
+		return traced(next, opts), nil
 
 	case logicalplan.Deduplicate:
 		// The Deduplicate operator will deduplicate samples using a last-sample-wins strategy.
@@ -184,13 +197,12 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 			}
 			operators[i] = operator
 		}
-		coalesce := exchange.NewCoalesce(model.NewVectorPool(opts.StepsBatch), opts, 0, operators...)
-		dedup := exchange.NewDedupOperator(model.NewVectorPool(opts.StepsBatch), coalesce)
-		return exchange.NewConcurrent(dedup, 2), nil
+		coalesce := traced(exchange.NewCoalesce(newVectorPool(opts), opts, 0, operators...), opts)
+		dedup := traced(exchange.NewDedupOperator(newVectorPool(opts), coalesce), opts)
+		return newConcurrent(dedup, opts), nil
 
 	case logicalplan.RemoteExecution:
-		// Create a new remote query scoped to the calculated start time.
-		qry, err := e.Engine.NewRangeQuery(opts.Context, promql.NewPrometheusQueryOpts(false, opts.LookbackDelta), e.Query, e.QueryRangeStart, opts.End, opts.Step)
+		qry, err := newRemoteQuery(e, opts)
 		if err != nil {
 			return nil, err
 		}
@@ -200,14 +212,18 @@ func newOperator(expr parser.Expr, storage *engstore.SelectorPool, opts *query.O
 		// We need to set the lookback for the selector to 0 since the remote query already applies one lookback.
 		selectorOpts := *opts
 		selectorOpts.LookbackDelta = 0
-		remoteExec := remote.NewExecution(qry, model.NewVectorPool(opts.StepsBatch), e.QueryRangeStart, &selectorOpts)
-		return exchange.NewConcurrent(remoteExec, 2), nil
+		remoteExec := remote.NewExecution(qry, newVectorPool(opts), e.QueryRangeStart, e.Engine.LabelSets(), &selectorOpts)
+		return newConcurrent(traced(remoteExec, opts), opts), nil
 	case logicalplan.Noop:
-		return noop.NewOperator(), nil
+		return traced(noop.NewOperator(), opts), nil
 	case logicalplan.UserDefinedExpr:
-		return e.MakeExecutionOperator(model.NewVectorPool(opts.StepsBatch), storage, opts, hints)
+		op, err := e.MakeExecutionOperator(newVectorPool(opts), storage, opts, hints)
+		if err != nil {
+			return nil, err
+		}
+		return traced(op, opts), nil
 	default:
-		return nil, errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e)
+		return nil, parse.WithReason(errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e), fmt.Sprintf("expression %T", e))
 	}
 }
 
@@ -218,7 +234,7 @@ func unpackVectorSelector(t *parser.MatrixSelector) (int64, *parser.VectorSelect
 	case *logicalplan.VectorSelector:
 		return t.BatchSize, t.VectorSelector, t.Filters, nil
 	default:
-		return 0, nil, nil, parse.ErrNotSupportedExpr
+		return 0, nil, nil, parse.WithReason(parse.ErrNotSupportedExpr, fmt.Sprintf("matrix selector of %T", t))
 	}
 }
 
@@ -229,6 +245,7 @@ func newRangeVectorFunction(e *parser.Call, t *parser.MatrixSelector, storage *e
 	if err != nil {
 		return nil, err
 	}
+	paramHints := hints
 
 	milliSecondRange := t.Range.Milliseconds()
 	if function.IsExtFunction(e.Func.Name) {
@@ -241,26 +258,21 @@ func newRangeVectorFunction(e *parser.Call, t *parser.MatrixSelector, storage *e
 	hints.Range = milliSecondRange
 	filter := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), vs.LabelMatchers, filters, hints)
 
-	numShards := runtime.GOMAXPROCS(0) / 2
-	if numShards < 1 {
-		numShards = 1
-	}
-	var arg float64
-	if e.Func.Name == "quantile_over_time" {
-		constVal, err := unwrapConstVal(e.Args[0])
-		if err != nil {
-			return nil, err
-		}
-		arg = constVal
+	numShards := opts.NumShards()
+	// Scalar arguments are evaluated once and shared by all shards.
+	paramOps, err := newScalarArgOperators(e, storage, opts, paramHints)
+	if err != nil {
+		return nil, err
 	}
+	params := scan.NewScalarParams(paramOps, opts.NumSteps(), numShards)
 
 	operators := make([]model.VectorOperator, 0, numShards)
 	for i := 0; i < numShards; i++ {
 		operator, err := scan.NewMatrixSelector(
-			model.NewVectorPool(opts.StepsBatch),
+			newVectorPool(opts),
 			filter,
 			e.Func.Name,
-			arg,
+			params,
 			opts,
 			t.Range,
 			vs.Offset,
@@ -271,20 +283,20 @@ func newRangeVectorFunction(e *parser.Call, t *parser.MatrixSelector, storage *e
 		if err != nil {
 			return nil, err
 		}
-		operators = append(operators, exchange.NewConcurrent(operator, 2))
+		operators = append(operators, newConcurrent(traced(operator, opts), opts))
 	}
 
-	return exchange.NewCoalesce(model.NewVectorPool(opts.StepsBatch), opts, batchSize*int64(numShards), operators...), nil
+	return traced(exchange.NewCoalesce(newVectorPool(opts), opts, batchSize*int64(numShards), operators...), opts), nil
 }
 
 func newSubqueryFunction(e *parser.Call, t *parser.SubqueryExpr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
 	// TODO: We dont implement ext functions
 	if parse.IsExtFunction(e.Func.Name) {
-		return nil, parse.ErrNotImplemented
+		return nil, parse.WithReason(parse.ErrNotImplemented, "function "+e.Func.Name+" with subquery")
 	}
-	// TODO: only instant queries for now.
-	if !opts.IsInstantQuery() {
-		return nil, parse.ErrNotImplemented
+	paramOps, err := newScalarArgOperators(e, storage, opts, hints)
+	if err != nil {
+		return nil, err
 	}
 	nOpts := query.NestedOptionsForSubquery(opts, t)
 
@@ -296,7 +308,27 @@ func newSubqueryFunction(e *parser.Call, t *parser.SubqueryExpr, storage *engsto
 	if err != nil {
 		return nil, err
 	}
-	return scan.NewSubqueryOperator(model.NewVectorPool(opts.StepsBatch), inner, opts, e, t)
+	subquery, err := scan.NewSubqueryOperator(newVectorPool(opts), inner, opts, e, t, paramOps)
+	if err != nil {
+		return nil, err
+	}
+	return traced(subquery, opts), nil
+}
+
+// newScalarArgOperators creates operators for the scalar arguments of a range function, in the order of the arguments.
+func newScalarArgOperators(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) ([]model.VectorOperator, error) {
+	var paramOps []model.VectorOperator
+	for _, arg := range e.Args {
+		if arg.Type() != parser.ValueTypeScalar {
+			continue
+		}
+		paramOp, err := newOperator(arg, storage, opts, hints)
+		if err != nil {
+			return nil, err
+		}
+		paramOps = append(paramOps, paramOp)
+	}
+	return paramOps, nil
 }
 
 func newInstantVectorFunction(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
@@ -313,23 +345,93 @@ func newInstantVectorFunction(e *parser.Call, storage *engstore.SelectorPool, op
 		nextOperators = append(nextOperators, next)
 	}
 
-	return function.NewFunctionOperator(e, nextOperators, opts.StepsBatch, opts)
+	return newFunctionOperator(e, nextOperators, opts)
+}
+
+// newVectorSelector creates an operator for a *parser.VectorSelector or a *logicalplan.VectorSelector.
+// If selectTimestamp is set, the operator returns the timestamps of samples instead of their values.
+func newVectorSelector(expr parser.Expr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints, selectTimestamp bool) (model.VectorOperator, error) {
+	switch e := expr.(type) {
+	case *parser.VectorSelector:
+		start, end := getTimeRangesForVectorSelector(e, opts, 0)
+		hints.Start = start
+		hints.End = end
+		filter := storage.GetSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, hints)
+		return newShardedVectorSelector(filter, opts, e.Offset, 0, selectTimestamp)
+	case *logicalplan.VectorSelector:
+		start, end := getTimeRangesForVectorSelector(e.VectorSelector, opts, 0)
+		hints.Start = start
+		hints.End = end
+		selector := storage.GetFilteredSelector(start, end, opts.Step.Milliseconds(), e.LabelMatchers, e.Filters, hints)
+		return newShardedVectorSelector(selector, opts, e.Offset, e.BatchSize, selectTimestamp)
+	default:
+		return nil, parse.WithReason(errors.Wrapf(parse.ErrNotSupportedExpr, "got: %s", e), fmt.Sprintf("vector selector %T", e))
+	}
+}
+
+func newTimestampFunction(e *parser.Call, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
+	next, selectsTimestamps, err := newTimestampArg(e.Args[0], storage, opts, hints)
+	if err != nil {
+		return nil, err
+	}
+	return traced(function.NewTimestampFunctionOperator(next, selectsTimestamps, opts), opts), nil
+}
+
+// newTimestampArg creates the operator for the argument of the timestamp function.
+// Prometheus returns the timestamps of the samples when the argument is a vector selector,
+// including step invariant selectors with an @ modifier, so those selectors are created
+// to return timestamps instead of values. The returned boolean reports whether that was the case.
+func newTimestampArg(expr parser.Expr, storage *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, bool, error) {
+	switch e := expr.(type) {
+	case *parser.ParenExpr:
+		return newTimestampArg(e.Expr, storage, opts, hints)
+	case *parser.VectorSelector:
+		next, err := newVectorSelector(offsetForTimestamp(e, opts), storage, opts, hints, true)
+		return next, true, err
+	case *logicalplan.VectorSelector:
+		vs := *e
+		vs.VectorSelector = offsetForTimestamp(e.VectorSelector, opts)
+		next, err := newVectorSelector(&vs, storage, opts, hints, true)
+		return next, true, err
+	case *parser.StepInvariantExpr:
+		next, selectsTimestamps, err := newTimestampArg(e.Expr, storage, opts.WithEndTime(opts.Start), hints)
+		if err != nil {
+			return nil, false, err
+		}
+		next, err = step_invariant.NewStepInvariantOperator(newVectorPoolWithSize(opts, 1), next, e.Expr, opts)
+		if err != nil {
+			return nil, false, err
+		}
+		return traced(next, opts), selectsTimestamps, nil
+	default:
+		next, err := newOperator(e, storage, opts, hints)
+		return next, false, err
+	}
 }
 
-func newShardedVectorSelector(selector engstore.SeriesSelector, opts *query.Options, offset time.Duration, batchSize int64) (model.VectorOperator, error) {
-	numShards := runtime.GOMAXPROCS(0) / 2
-	if numShards < 1 {
-		numShards = 1
+// offsetForTimestamp returns a copy of the selector which selects samples at the time of its @ modifier.
+// Prometheus ignores the offset of the selector in this case, but it still uses it for the time range of the select.
+// See https://github.com/prometheus/prometheus/issues/8433.
+func offsetForTimestamp(vs *parser.VectorSelector, opts *query.Options) *parser.VectorSelector {
+	if vs.Timestamp == nil {
+		return vs
 	}
+	result := *vs
+	result.Offset = time.Duration(opts.Start.UnixMilli()-*vs.Timestamp) * time.Millisecond
+	return &result
+}
+
+func newShardedVectorSelector(selector engstore.SeriesSelector, opts *query.Options, offset time.Duration, batchSize int64, selectTimestamp bool) (model.VectorOperator, error) {
+	numShards := opts.NumShards()
 	operators := make([]model.VectorOperator, 0, numShards)
 	for i := 0; i < numShards; i++ {
-		operator := exchange.NewConcurrent(
+		operator := newConcurrent(traced(
 			scan.NewVectorSelector(
-				model.NewVectorPool(opts.StepsBatch), selector, opts, offset, batchSize, i, numShards), 2)
+				newVectorPool(opts), selector, opts, offset, batchSize, selectTimestamp, i, numShards), opts), opts)
 		operators = append(operators, operator)
 	}
 
-	return exchange.NewCoalesce(model.NewVectorPool(opts.StepsBatch), opts, batchSize*int64(numShards), operators...), nil
+	return traced(exchange.NewCoalesce(newVectorPool(opts), opts, batchSize*int64(numShards), operators...), opts), nil
 }
 
 func newAbsentOverTimeOperator(call *parser.Call, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
@@ -346,7 +448,7 @@ func newAbsentOverTimeOperator(call *parser.Call, selectorPool *engstore.Selecto
 			Func: &parser.Function{Name: "absent"},
 			Args: []parser.Expr{matrixCall},
 		}
-		return function.NewFunctionOperator(f, []model.VectorOperator{argOp}, opts.StepsBatch, opts)
+		return newFunctionOperator(f, []model.VectorOperator{argOp}, opts)
 	case *parser.MatrixSelector:
 		matrixCall := &parser.Call{
 			Func: &parser.Function{Name: "last_over_time"},
@@ -370,9 +472,9 @@ func newAbsentOverTimeOperator(call *parser.Call, selectorPool *engstore.Selecto
 				Range:          arg.Range,
 			}},
 		}
-		return function.NewFunctionOperator(f, []model.VectorOperator{argOp}, opts.StepsBatch, opts)
+		return newFunctionOperator(f, []model.VectorOperator{argOp}, opts)
 	default:
-		return nil, parse.ErrNotSupportedExpr
+		return nil, parse.WithReason(parse.ErrNotSupportedExpr, fmt.Sprintf("function absent_over_time with %T", arg))
 	}
 }
 
@@ -385,7 +487,11 @@ func newVectorBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 	if err != nil {
 		return nil, err
 	}
-	return binary.NewVectorOperator(model.NewVectorPool(opts.StepsBatch), leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, opts)
+	op, err := binary.NewVectorOperator(newVectorPool(opts), leftOperator, rightOperator, e.VectorMatching, e.Op, e.ReturnBool, opts)
+	if err != nil {
+		return nil, err
+	}
+	return traced(op, opts), nil
 }
 
 func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.SelectorPool, opts *query.Options, hints storage.SelectHints) (model.VectorOperator, error) {
@@ -406,7 +512,39 @@ func newScalarBinaryOperator(e *parser.BinaryExpr, selectorPool *engstore.Select
 		scalarSide = binary.ScalarSideLeft
 	}
 
-	return binary.NewScalar(model.NewVectorPoolWithSize(opts.StepsBatch, 1), lhs, rhs, e.Op, scalarSide, e.ReturnBool, opts)
+	op, err := binary.NewScalar(newVectorPoolWithSize(opts, 1), lhs, rhs, e.Op, scalarSide, e.ReturnBool, opts)
+	if err != nil {
+		return nil, err
+	}
+	return traced(op, opts), nil
+}
+
+// newConcurrent runs the operator in a separate goroutine if the parallelism budget of the query allows it.
+func newConcurrent(next model.VectorOperator, opts *query.Options) model.VectorOperator {
+	if !opts.IsConcurrent() {
+		return next
+	}
+	return traced(exchange.NewConcurrent(next, 2), opts)
+}
+
+func newFunctionOperator(e *parser.Call, nextOperators []model.VectorOperator, opts *query.Options) (model.VectorOperator, error) {
+	op, err := function.NewFunctionOperator(e, nextOperators, opts.StepsBatch, opts)
+	if err != nil {
+		return nil, err
+	}
+	return traced(op, opts), nil
+}
+
+func newVectorPool(opts *query.Options) *model.VectorPool {
+	pool := model.NewVectorPool(opts.StepsBatch)
+	pool.SetMemoryTracker(opts.MemoryTracker)
+	return pool
+}
+
+func newVectorPoolWithSize(opts *query.Options, size int) *model.VectorPool {
+	pool := model.NewVectorPoolWithSize(opts.StepsBatch, size)
+	pool.SetMemoryTracker(opts.MemoryTracker)
+	return pool
 }
 
 // Copy from https://github.com/prometheus/prometheus/blob/v2.39.1/promql/engine.go#L791.
@@ -426,13 +564,37 @@ func getTimeRangesForVectorSelector(n *parser.VectorSelector, opts *query.Option
 	return start - offset, end - offset
 }
 
-func unwrapConstVal(e parser.Expr) (float64, error) {
+func unwrapStringVal(e parser.Expr) (string, error) {
 	switch c := e.(type) {
-	case *parser.NumberLiteral:
+	case *parser.StringLiteral:
 		return c.Val, nil
+	case *parser.ParenExpr:
+		return unwrapStringVal(c.Expr)
 	case *parser.StepInvariantExpr:
-		return unwrapConstVal(c.Expr)
+		return unwrapStringVal(c.Expr)
 	}
 
-	return 0, errors.Wrap(parse.ErrNotSupportedExpr, "matrix selector argument must be a constant")
+	return "", parse.WithReason(errors.Wrap(parse.ErrNotSupportedExpr, "aggregation parameter must be a string literal"), "count_values with non literal parameter")
+}
+
+// newRemoteQuery creates the query executed by a remote engine. Engines which can execute logical
+// plans receive the plan of the remote execution instead of the query string. Instant evaluations use
+// instant queries when the engine supports them, everything else is executed as a range query scoped
+// to the calculated start time.
+func newRemoteQuery(e logicalplan.RemoteExecution, opts *query.Options) (promql.Query, error) {
+	if e.Engine == nil {
+		return nil, errors.Newf("no engine to execute remote query %s", e.Query)
+	}
+	qOpts := promql.NewPrometheusQueryOpts(false, opts.LookbackDelta)
+	instant := opts.IsInstantQuery() && e.QueryRangeStart.Equal(opts.End)
+	if planEngine, ok := e.Engine.(api.RemotePlanEngine); ok && e.Plan != nil {
+		if instant {
+			return planEngine.NewInstantQueryFromPlan(opts.Context, qOpts, e.RemotePlan(), opts.End)
+		}
+		return planEngine.NewRangeQueryFromPlan(opts.Context, qOpts, e.RemotePlan(), e.QueryRangeStart, opts.End, opts.Step)
+	}
+	if instantEngine, ok := e.Engine.(api.RemoteInstantEngine); ok && instant {
+		return instantEngine.NewInstantQuery(opts.Context, qOpts, e.Query, opts.End)
+	}
+	return e.Engine.NewRangeQuery(opts.Context, qOpts, e.Query, e.QueryRangeStart, opts.End, opts.Step)
 }
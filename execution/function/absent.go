@@ -21,7 +21,7 @@ type absentOperator struct {
 	series   []labels.Labels
 	pool     *model.VectorPool
 	next     model.VectorOperator
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func (o *absentOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
@@ -45,6 +45,7 @@ func (o *absentOperator) Series(_ context.Context) ([]labels.Labels, error) {
 func (o *absentOperator) loadSeries() {
 	o.once.Do(func() {
 		o.pool.SetStepSize(1)
+		o.SetSeries(1)
 
 		// https://github.com/prometheus/prometheus/blob/main/promql/functions.go#L1385
 		var lm []*labels.Matcher
@@ -95,6 +96,7 @@ func (o *absentOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	if len(vectors) == 0 {
 		return nil, nil
 	}
+	o.AddSamplesIn(model.CountSamples(vectors))
 
 	result := o.GetPool().GetVectorBatch()
 	for i := range vectors {
@@ -107,5 +109,6 @@ func (o *absentOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	}
 	o.next.GetPool().PutVectors(vectors)
 	o.AddExecutionTimeTaken(time.Since(start))
+	o.AddNextCall(result)
 	return result, nil
 }
@@ -263,8 +263,8 @@ func IsExtFunction(functionName string) bool {
 func UnknownFunctionError(name string) error {
 	msg := fmt.Sprintf("unknown function: %s", name)
 	if _, ok := parser.Functions[name]; ok {
-		return errors.Wrap(parse.ErrNotImplemented, msg)
+		return parse.WithReason(errors.Wrap(parse.ErrNotImplemented, msg), parse.FunctionReason(name))
 	}
 
-	return errors.Wrap(parse.ErrNotSupportedExpr, msg)
+	return parse.WithReason(errors.Wrap(parse.ErrNotSupportedExpr, msg), parse.FunctionReason(name))
 }
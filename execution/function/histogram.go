@@ -47,7 +47,7 @@ type histogramOperator struct {
 
 	// seriesBuckets are the buckets for each individual conventional histogram series.
 	seriesBuckets []buckets
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func (o *histogramOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
@@ -116,9 +116,15 @@ func (o *histogramOperator) Next(ctx context.Context) ([]model.StepVector, error
 		o.scalarOp.GetPool().PutStepVector(scalar)
 	}
 	o.scalarOp.GetPool().PutVectors(scalars)
-	o.AddExecutionTimeTaken(time.Since(start))
+	o.AddSamplesIn(model.CountSamples(vectors))
 
-	return o.processInputSeries(vectors)
+	out, err := o.processInputSeries(vectors)
+	if err != nil {
+		return nil, err
+	}
+	o.AddExecutionTimeTaken(time.Since(start))
+	o.AddNextCall(out)
+	return out, nil
 }
 
 func (o *histogramOperator) processInputSeries(vectors []model.StepVector) ([]model.StepVector, error) {
@@ -228,6 +234,7 @@ func (o *histogramOperator) loadSeries(ctx context.Context) error {
 		}
 	}
 	o.seriesBuckets = make([]buckets, len(o.series))
+	o.SetSeries(len(o.series))
 	o.pool.SetStepSize(len(o.series))
 	return nil
 }
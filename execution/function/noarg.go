@@ -26,7 +26,7 @@ type noArgFunctionOperator struct {
 	vectorPool  *model.VectorPool
 	series      []labels.Labels
 	sampleIDs   []uint64
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func (o *noArgFunctionOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
@@ -61,6 +61,7 @@ func (o *noArgFunctionOperator) Next(_ context.Context) ([]model.StepVector, err
 		o.currentStep += o.step
 	}
 	o.AddExecutionTimeTaken(time.Since(start))
+	o.AddNextCall(ret)
 
 	return ret, nil
 }
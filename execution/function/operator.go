@@ -32,51 +32,59 @@ type functionOperator struct {
 
 	call         functionCall
 	scalarPoints [][]float64
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
-func SetTelemetry(opts *query.Options) model.OperatorTelemetry {
+func SetTelemetry(opts *query.Options) model.StatsTelemetry {
 	if opts.EnableAnalysis {
 		return &model.TrackedTelemetry{}
 	}
 	return &model.NoopTelemetry{}
 }
 
+func newVectorPool(stepsBatch int, opts *query.Options) *model.VectorPool {
+	pool := model.NewVectorPool(stepsBatch)
+	pool.SetMemoryTracker(opts.MemoryTracker)
+	return pool
+}
+
 func NewFunctionOperator(funcExpr *parser.Call, nextOps []model.VectorOperator, stepsBatch int, opts *query.Options) (model.VectorOperator, error) {
 	// Some functions need to be handled in special operators
 
 	switch funcExpr.Func.Name {
 	case "scalar":
+		pool := newVectorPool(stepsBatch, opts)
+		pool.SetStepSize(1)
 		return &scalarFunctionOperator{
-			next:              nextOps[0],
-			pool:              model.NewVectorPoolWithSize(stepsBatch, 1),
-			OperatorTelemetry: SetTelemetry(opts),
+			next:           nextOps[0],
+			pool:           pool,
+			StatsTelemetry: SetTelemetry(opts),
 		}, nil
 
 	case "label_join", "label_replace":
 		return &relabelFunctionOperator{
-			next:              nextOps[0],
-			funcExpr:          funcExpr,
-			OperatorTelemetry: SetTelemetry(opts),
+			next:           nextOps[0],
+			funcExpr:       funcExpr,
+			StatsTelemetry: SetTelemetry(opts),
 		}, nil
 
 	case "absent":
 		return &absentOperator{
-			next:              nextOps[0],
-			pool:              model.NewVectorPool(stepsBatch),
-			funcExpr:          funcExpr,
-			OperatorTelemetry: SetTelemetry(opts),
+			next:           nextOps[0],
+			pool:           newVectorPool(stepsBatch, opts),
+			funcExpr:       funcExpr,
+			StatsTelemetry: SetTelemetry(opts),
 		}, nil
 
 	case "histogram_quantile":
 		return &histogramOperator{
-			pool:              model.NewVectorPool(stepsBatch),
-			funcArgs:          funcExpr.Args,
-			once:              sync.Once{},
-			scalarOp:          nextOps[0],
-			vectorOp:          nextOps[1],
-			scalarPoints:      make([]float64, stepsBatch),
-			OperatorTelemetry: SetTelemetry(opts),
+			pool:           newVectorPool(stepsBatch, opts),
+			funcArgs:       funcExpr.Args,
+			once:           sync.Once{},
+			scalarOp:       nextOps[0],
+			vectorOp:       nextOps[1],
+			scalarPoints:   make([]float64, stepsBatch),
+			StatsTelemetry: SetTelemetry(opts),
 		}, nil
 	}
 
@@ -108,7 +116,7 @@ func newNoArgsFunctionOperator(funcExpr *parser.Call, stepsBatch int, opts *quer
 		stepsBatch:  stepsBatch,
 		funcExpr:    funcExpr,
 		call:        call,
-		vectorPool:  model.NewVectorPool(stepsBatch),
+		vectorPool:  newVectorPool(stepsBatch, opts),
 	}
 	switch funcExpr.Func.Name {
 	case "pi", "time":
@@ -118,10 +126,11 @@ func newNoArgsFunctionOperator(funcExpr *parser.Call, stepsBatch int, opts *quer
 		op.series = []labels.Labels{{}}
 		op.sampleIDs = []uint64{0}
 	}
-	op.OperatorTelemetry = &model.NoopTelemetry{}
+	op.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		op.OperatorTelemetry = &model.TrackedTelemetry{}
+		op.StatsTelemetry = &model.TrackedTelemetry{}
 	}
+	op.SetSeries(len(op.series))
 
 	return op, nil
 }
@@ -150,9 +159,9 @@ func newInstantVectorFunctionOperator(funcExpr *parser.Call, nextOps []model.Vec
 			break
 		}
 	}
-	f.OperatorTelemetry = &model.NoopTelemetry{}
+	f.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		f.OperatorTelemetry = &model.TrackedTelemetry{}
+		f.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 
 	// Check selector type.
@@ -160,7 +169,7 @@ func newInstantVectorFunctionOperator(funcExpr *parser.Call, nextOps []model.Vec
 	case parser.ValueTypeVector, parser.ValueTypeScalar:
 		return f, nil
 	default:
-		return nil, errors.Wrapf(parse.ErrNotImplemented, "got %s:", funcExpr.String())
+		return nil, parse.WithReason(errors.Wrapf(parse.ErrNotImplemented, "got %s:", funcExpr.String()), parse.FunctionReason(funcExpr.Func.Name))
 	}
 }
 
@@ -212,6 +221,7 @@ func (o *functionOperator) Next(ctx context.Context) ([]model.StepVector, error)
 	if len(vectors) == 0 {
 		return nil, nil
 	}
+	o.AddSamplesIn(model.CountSamples(vectors))
 	scalarIndex := 0
 	for i := range o.nextOps {
 		if i == o.vectorIndex {
@@ -262,6 +272,7 @@ func (o *functionOperator) Next(ctx context.Context) ([]model.StepVector, error)
 	}
 
 	o.AddExecutionTimeTaken(time.Since(start))
+	o.AddNextCall(vectors)
 
 	return vectors, nil
 }
@@ -271,6 +282,7 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 	o.once.Do(func() {
 		if o.funcExpr.Func.Name == "vector" {
 			o.series = []labels.Labels{labels.New()}
+			o.SetSeries(len(o.series))
 			return
 		}
 
@@ -286,6 +298,7 @@ func (o *functionOperator) loadSeries(ctx context.Context) error {
 			lbls, _ := extlabels.DropMetricName(s, b)
 			o.series[i] = lbls
 		}
+		o.SetSeries(len(o.series))
 	})
 
 	return err
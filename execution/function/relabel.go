@@ -24,7 +24,7 @@ type relabelFunctionOperator struct {
 	funcExpr *parser.Call
 	once     sync.Once
 	series   []labels.Labels
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func (o *relabelFunctionOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
@@ -54,7 +54,12 @@ func (o *relabelFunctionOperator) Next(ctx context.Context) ([]model.StepVector,
 	start := time.Now()
 	next, err := o.next.Next(ctx)
 	o.AddExecutionTimeTaken(time.Since(start))
-	return next, err
+	if err != nil {
+		return nil, err
+	}
+	o.AddSamplesIn(model.CountSamples(next))
+	o.AddNextCall(next)
+	return next, nil
 }
 
 func (o *relabelFunctionOperator) loadSeries(ctx context.Context) (err error) {
@@ -72,7 +77,11 @@ func (o *relabelFunctionOperator) loadSeries(ctx context.Context) (err error) {
 	default:
 		err = errors.Newf("invalid function name for relabel operator: %s", o.funcExpr.Func.Name)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	o.SetSeries(len(o.series))
+	return nil
 }
 
 func unwrap(expr parser.Expr) (string, error) {
@@ -16,7 +16,7 @@ import (
 type scalarFunctionOperator struct {
 	pool *model.VectorPool
 	next model.VectorOperator
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func (o *scalarFunctionOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
@@ -54,6 +54,7 @@ func (o *scalarFunctionOperator) Next(ctx context.Context) ([]model.StepVector,
 	if len(in) == 0 {
 		return nil, nil
 	}
+	o.AddSamplesIn(model.CountSamples(in))
 
 	result := o.GetPool().GetVectorBatch()
 	for _, vector := range in {
@@ -68,6 +69,7 @@ func (o *scalarFunctionOperator) Next(ctx context.Context) ([]model.StepVector,
 	}
 	o.next.GetPool().PutVectors(in)
 	o.AddExecutionTimeTaken(time.Since(start))
+	o.AddNextCall(result)
 
 	return result, nil
 }
@@ -0,0 +1,119 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package function
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/extlabels"
+	"github.com/thanos-io/promql-engine/query"
+)
+
+// timestampFunctionOperator implements the timestamp() function.
+// When the input is a vector selector which returns the timestamps of its samples
+// instead of their values, those timestamps are used as they are. For any other
+// input the result is the timestamp of the step, same as in Prometheus.
+type timestampFunctionOperator struct {
+	next              model.VectorOperator
+	selectsTimestamps bool
+
+	once   sync.Once
+	series []labels.Labels
+	model.StatsTelemetry
+}
+
+// NewTimestampFunctionOperator creates an operator for the timestamp() function.
+// selectsTimestamps must be set when the input operator returns sample timestamps in seconds as sample values.
+func NewTimestampFunctionOperator(next model.VectorOperator, selectsTimestamps bool, opts *query.Options) model.VectorOperator {
+	return &timestampFunctionOperator{
+		next:              next,
+		selectsTimestamps: selectsTimestamps,
+		StatsTelemetry:    SetTelemetry(opts),
+	}
+}
+
+func (o *timestampFunctionOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
+	o.SetName("[*timestampFunctionOperator]")
+	next := make([]model.ObservableVectorOperator, 0, 1)
+	if obsnext, ok := o.next.(model.ObservableVectorOperator); ok {
+		next = append(next, obsnext)
+	}
+	return o, next
+}
+
+func (o *timestampFunctionOperator) Explain() (me string, next []model.VectorOperator) {
+	return "[*timestampFunctionOperator]", []model.VectorOperator{o.next}
+}
+
+func (o *timestampFunctionOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	return o.series, err
+}
+
+func (o *timestampFunctionOperator) GetPool() *model.VectorPool {
+	return o.next.GetPool()
+}
+
+func (o *timestampFunctionOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var err error
+	o.once.Do(func() { err = o.loadSeries(ctx) })
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	defer func() { o.AddExecutionTimeTaken(time.Since(start)) }()
+
+	in, err := o.next.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o.AddSamplesIn(model.CountSamples(in))
+	if o.selectsTimestamps {
+		o.AddNextCall(in)
+		return in, nil
+	}
+
+	for i := range in {
+		ts := float64(in[i].T) / 1000
+		for j := range in[i].Samples {
+			in[i].Samples[j] = ts
+		}
+		// Histograms are converted to float samples since the result is always a float.
+		for _, id := range in[i].HistogramIDs {
+			in[i].AppendSample(o.GetPool(), id, ts)
+		}
+		in[i].HistogramIDs = in[i].HistogramIDs[:0]
+		in[i].Histograms = in[i].Histograms[:0]
+	}
+	o.AddNextCall(in)
+	return in, nil
+}
+
+func (o *timestampFunctionOperator) loadSeries(ctx context.Context) error {
+	series, err := o.next.Series(ctx)
+	if err != nil {
+		return err
+	}
+
+	o.series = make([]labels.Labels, len(series))
+	b := labels.ScratchBuilder{}
+	for i, s := range series {
+		o.series[i], _ = extlabels.DropMetricName(s, b)
+	}
+	o.SetSeries(len(o.series))
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package limits
+
+import (
+	"sync/atomic"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// ErrMemoryLimitExceeded is returned when a query allocates more memory than its budget allows.
+var ErrMemoryLimitExceeded = errors.New("query memory limit exceeded")
+
+// MemoryTracker accounts for bytes allocated by operators of a single query.
+// A nil *MemoryTracker is valid and tracks nothing.
+type MemoryTracker struct {
+	limit int64
+	used  atomic.Int64
+	peak  atomic.Int64
+	err   atomic.Pointer[error]
+}
+
+// NewMemoryTracker creates a tracker which fails reservations once more than
+// limit bytes are in use. A limit of zero or less disables the limit, but
+// usage is still tracked.
+func NewMemoryTracker(limit int64) *MemoryTracker {
+	return &MemoryTracker{limit: limit}
+}
+
+// Reserve charges the given number of bytes against the budget. It returns an error
+// wrapping ErrMemoryLimitExceeded if the budget is exceeded. Once exceeded, the error
+// is also retained and can be retrieved with Err.
+func (t *MemoryTracker) Reserve(bytes int64) error {
+	if t == nil || bytes <= 0 {
+		return nil
+	}
+	used := t.used.Add(bytes)
+	for {
+		peak := t.peak.Load()
+		if used <= peak || t.peak.CompareAndSwap(peak, used) {
+			break
+		}
+	}
+	if t.limit <= 0 || used <= t.limit {
+		return nil
+	}
+
+	err := errors.Wrapf(ErrMemoryLimitExceeded, "requested %d bytes with %d bytes in use, limit is %d bytes", bytes, used-bytes, t.limit)
+	t.err.CompareAndSwap(nil, &err)
+	return *t.err.Load()
+}
+
+// Release returns the given number of bytes to the budget. Callers must only
+// release bytes which they reserved before.
+func (t *MemoryTracker) Release(bytes int64) {
+	if t == nil || bytes <= 0 {
+		return
+	}
+	t.used.Add(-bytes)
+}
+
+// Err returns the error from the first reservation which exceeded the limit, if any.
+func (t *MemoryTracker) Err() error {
+	if t == nil {
+		return nil
+	}
+	if err := t.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Used returns the number of bytes currently in use.
+func (t *MemoryTracker) Used() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.used.Load()
+}
+
+// Peak returns the highest number of bytes that were in use at the same time.
+func (t *MemoryTracker) Peak() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.peak.Load()
+}
+
+// Limit returns the configured limit in bytes.
+func (t *MemoryTracker) Limit() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.limit
+}
+
+// LabelsSize returns an approximation of the number of bytes used by a label set.
+func LabelsSize(lbls labels.Labels) int64 {
+	var size int64
+	lbls.Range(func(l labels.Label) {
+		size += int64(len(l.Name) + len(l.Value))
+	})
+	return size
+}
@@ -0,0 +1,69 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package limits_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+
+	"github.com/thanos-io/promql-engine/execution/limits"
+)
+
+func TestMemoryTracker(t *testing.T) {
+	tracker := limits.NewMemoryTracker(100)
+	testutil.Ok(t, tracker.Reserve(60))
+	testutil.Ok(t, tracker.Reserve(40))
+	testutil.Equals(t, int64(100), tracker.Used())
+	testutil.Ok(t, tracker.Err())
+
+	tracker.Release(50)
+	testutil.Equals(t, int64(50), tracker.Used())
+	testutil.Equals(t, int64(100), tracker.Peak())
+
+	err := tracker.Reserve(51)
+	testutil.Assert(t, errors.Is(err, limits.ErrMemoryLimitExceeded), "unexpected error: %v", err)
+	testutil.Equals(t, int64(101), tracker.Used())
+	testutil.Equals(t, int64(101), tracker.Peak())
+
+	// The first error is retained, even after memory is released.
+	tracker.Release(101)
+	testutil.Equals(t, int64(0), tracker.Used())
+	testutil.Equals(t, err, tracker.Err())
+	testutil.Equals(t, err, tracker.Reserve(200))
+}
+
+func TestMemoryTrackerWithoutLimit(t *testing.T) {
+	tracker := limits.NewMemoryTracker(0)
+	testutil.Ok(t, tracker.Reserve(1<<40))
+	testutil.Equals(t, int64(1<<40), tracker.Peak())
+	testutil.Ok(t, tracker.Err())
+
+	var nilTracker *limits.MemoryTracker
+	testutil.Ok(t, nilTracker.Reserve(100))
+	nilTracker.Release(100)
+	testutil.Equals(t, int64(0), nilTracker.Used())
+	testutil.Ok(t, nilTracker.Err())
+}
+
+func TestMemoryTrackerConcurrent(t *testing.T) {
+	tracker := limits.NewMemoryTracker(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				testutil.Ok(t, tracker.Reserve(10))
+				tracker.Release(10)
+			}
+		}()
+	}
+	wg.Wait()
+	testutil.Equals(t, int64(0), tracker.Used())
+	testutil.Assert(t, tracker.Peak() >= 10 && tracker.Peak() <= 80, "unexpected peak %d", tracker.Peak())
+}
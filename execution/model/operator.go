@@ -10,11 +10,40 @@ import (
 	"github.com/prometheus/prometheus/model/labels"
 )
 
+// OperatorStats are statistics collected by an operator during execution.
+type OperatorStats struct {
+	// Series is the number of series returned by the operator.
+	Series int `json:"series"`
+	// SamplesIn is the number of samples consumed by the operator,
+	// either from its child operators or from storage.
+	SamplesIn int64 `json:"samplesIn"`
+	// SamplesOut is the number of samples returned by the operator.
+	SamplesOut int64 `json:"samplesOut"`
+	// NextCalls is the number of calls to Next which returned a batch of step vectors.
+	NextCalls int64 `json:"nextCalls"`
+	// StepVectors is the number of step vectors returned by the operator.
+	StepVectors int64 `json:"stepVectors"`
+	// PoolHits and PoolMisses are the number of buffers taken from the pool
+	// owned by the operator which were reused and newly allocated.
+	PoolHits   int64 `json:"poolHits"`
+	PoolMisses int64 `json:"poolMisses"`
+
+	// RemoteExecutionTime, RemoteQueueTime and NetworkTime split the time spent on
+	// the query of a remote execution. They are the time the remote engine spent evaluating
+	// the query, the time the query waited in the queue of the remote engine and the
+	// remaining time of the call, which is spent on the network. They are only set for remote executions.
+	RemoteExecutionTime time.Duration `json:"remoteExecutionTimeNanos,omitempty"`
+	RemoteQueueTime     time.Duration `json:"remoteQueueTimeNanos,omitempty"`
+	NetworkTime         time.Duration `json:"networkTimeNanos,omitempty"`
+}
+
 type NoopTelemetry struct{}
 
 type TrackedTelemetry struct {
 	name          string
 	ExecutionTime time.Duration
+
+	stats OperatorStats
 }
 
 func (ti *NoopTelemetry) AddExecutionTimeTaken(t time.Duration) {}
@@ -23,6 +52,37 @@ func (ti *TrackedTelemetry) AddExecutionTimeTaken(t time.Duration) {
 	ti.ExecutionTime += t
 }
 
+func (ti *NoopTelemetry) SetSeries(n int) {}
+
+func (ti *TrackedTelemetry) SetSeries(n int) {
+	ti.stats.Series = n
+}
+
+func (ti *NoopTelemetry) AddSamplesIn(n int64) {}
+
+func (ti *TrackedTelemetry) AddSamplesIn(n int64) {
+	ti.stats.SamplesIn += n
+}
+
+func (ti *NoopTelemetry) AddNextCall(out []StepVector) {}
+
+func (ti *TrackedTelemetry) AddNextCall(out []StepVector) {
+	if out == nil {
+		return
+	}
+	ti.stats.NextCalls++
+	ti.stats.StepVectors += int64(len(out))
+	ti.stats.SamplesOut += CountSamples(out)
+}
+
+func (ti *NoopTelemetry) ExecutionStats() OperatorStats {
+	return OperatorStats{}
+}
+
+func (ti *TrackedTelemetry) ExecutionStats() OperatorStats {
+	return ti.stats
+}
+
 func (ti *TrackedTelemetry) Name() string {
 	return ti.name
 }
@@ -44,6 +104,30 @@ type OperatorTelemetry interface {
 	Name() string
 }
 
+// StatsTelemetry is an optional interface for telemetry which also collects OperatorStats.
+// It is implemented by the telemetry of the operators of this engine. Operators of user defined
+// expressions only need to implement OperatorTelemetry, and report no statistics.
+type StatsTelemetry interface {
+	OperatorTelemetry
+
+	// SetSeries records the number of series returned by the operator.
+	SetSeries(int)
+	// AddSamplesIn records samples consumed by the operator.
+	AddSamplesIn(int64)
+	// AddNextCall records a call to Next which returned the given batch of step vectors.
+	AddNextCall([]StepVector)
+	ExecutionStats() OperatorStats
+}
+
+// CountSamples returns the number of float and histogram samples in the given step vectors.
+func CountSamples(vectors []StepVector) int64 {
+	var n int64
+	for i := range vectors {
+		n += int64(len(vectors[i].Samples) + len(vectors[i].Histograms))
+	}
+	return n
+}
+
 func (ti *NoopTelemetry) ExecutionTimeTaken() time.Duration {
 	return time.Duration(0)
 }
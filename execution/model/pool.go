@@ -5,17 +5,38 @@ package model
 
 import (
 	"sync"
+	"sync/atomic"
+	"unsafe"
 
 	"github.com/prometheus/prometheus/model/histogram"
+
+	"github.com/thanos-io/promql-engine/execution/limits"
+)
+
+const (
+	stepVectorSize = int64(unsafe.Sizeof(StepVector{}))
+	sampleSize     = int64(unsafe.Sizeof(float64(0)))
+	sampleIDSize   = int64(unsafe.Sizeof(uint64(0)))
+	histogramSize  = int64(unsafe.Sizeof(&histogram.FloatHistogram{}))
 )
 
 type VectorPool struct {
-	vectors sync.Pool
+	vectors    sync.Pool
+	stepsBatch int
 
 	stepSize   int
 	samples    sync.Pool
 	sampleIDs  sync.Pool
 	histograms sync.Pool
+
+	// memoryTracker is charged for buffers handed out by the pool
+	// and credited when they are returned.
+	memoryTracker *limits.MemoryTracker
+
+	// gets counts buffers taken from the pool and misses
+	// the ones which had to be allocated.
+	gets   atomic.Int64
+	misses atomic.Int64
 }
 
 func NewVectorPoolWithSize(stepsBatch, size int) *VectorPool {
@@ -25,27 +46,31 @@ func NewVectorPoolWithSize(stepsBatch, size int) *VectorPool {
 }
 
 func NewVectorPool(stepsBatch int) *VectorPool {
-	pool := &VectorPool{}
+	pool := &VectorPool{stepsBatch: stepsBatch}
 	pool.vectors = sync.Pool{
 		New: func() any {
+			pool.misses.Add(1)
 			sv := make([]StepVector, 0, stepsBatch)
 			return &sv
 		},
 	}
 	pool.samples = sync.Pool{
 		New: func() any {
+			pool.misses.Add(1)
 			samples := make([]float64, 0, pool.stepSize)
 			return &samples
 		},
 	}
 	pool.sampleIDs = sync.Pool{
 		New: func() any {
+			pool.misses.Add(1)
 			sampleIDs := make([]uint64, 0, pool.stepSize)
 			return &sampleIDs
 		},
 	}
 	pool.histograms = sync.Pool{
 		New: func() any {
+			pool.misses.Add(1)
 			histograms := make([]*histogram.FloatHistogram, pool.stepSize)[:0]
 			return &histograms
 		},
@@ -55,10 +80,13 @@ func NewVectorPool(stepsBatch int) *VectorPool {
 }
 
 func (p *VectorPool) GetVectorBatch() []StepVector {
+	p.gets.Add(1)
+	p.reserve(int64(p.stepsBatch) * stepVectorSize)
 	return *p.vectors.Get().(*[]StepVector)
 }
 
 func (p *VectorPool) PutVectors(vector []StepVector) {
+	p.memoryTracker.Release(int64(p.stepsBatch) * stepVectorSize)
 	vector = vector[:0]
 	p.vectors.Put(&vector)
 }
@@ -68,14 +96,17 @@ func (p *VectorPool) GetStepVector(t int64) StepVector {
 }
 
 func (p *VectorPool) getSampleBuffers() ([]uint64, []float64) {
+	p.gets.Add(2)
 	return *p.sampleIDs.Get().(*[]uint64), *p.samples.Get().(*[]float64)
 }
 
 func (p *VectorPool) getHistogramBuffers() ([]uint64, []*histogram.FloatHistogram) {
+	p.gets.Add(2)
 	return *p.sampleIDs.Get().(*[]uint64), *p.histograms.Get().(*[]*histogram.FloatHistogram)
 }
 
 func (p *VectorPool) PutStepVector(v StepVector) {
+	v.release()
 	if v.SampleIDs != nil {
 		v.SampleIDs = v.SampleIDs[:0]
 		p.sampleIDs.Put(&v.SampleIDs)
@@ -93,6 +124,26 @@ func (p *VectorPool) PutStepVector(v StepVector) {
 	}
 }
 
+// reserve charges the memory tracker of the pool. Buffers are always handed out, even
+// when the limit is exceeded, since the error is retained by the tracker and surfaced
+// by the engine after each batch.
+func (p *VectorPool) reserve(bytes int64) {
+	_ = p.memoryTracker.Reserve(bytes)
+}
+
 func (p *VectorPool) SetStepSize(n int) {
 	p.stepSize = n
 }
+
+// SetMemoryTracker sets the tracker which is charged for buffers allocated from the pool.
+// Allocations never fail; exceeding the limit is retained by the tracker and surfaced by the engine.
+func (p *VectorPool) SetMemoryTracker(t *limits.MemoryTracker) {
+	p.memoryTracker = t
+}
+
+// Stats returns the number of buffers taken from the pool which were reused
+// from previously returned ones and the number of buffers which were allocated.
+func (p *VectorPool) Stats() (hits, misses int64) {
+	gets, misses := p.gets.Load(), p.misses.Load()
+	return gets - misses, misses
+}
@@ -0,0 +1,76 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package model_test
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/histogram"
+
+	"github.com/thanos-io/promql-engine/execution/limits"
+	"github.com/thanos-io/promql-engine/execution/model"
+)
+
+func TestVectorPoolMemoryTracking(t *testing.T) {
+	tracker := limits.NewMemoryTracker(0)
+	pool := model.NewVectorPoolWithSize(10, 2)
+	pool.SetMemoryTracker(tracker)
+
+	vectors := pool.GetVectorBatch()
+	batchSize := tracker.Used()
+	testutil.Assert(t, batchSize > 0, "vector batch should be tracked")
+
+	// Buffers grow beyond the step size of the pool while appending.
+	for i := 0; i < 3; i++ {
+		vector := pool.GetStepVector(int64(i))
+		for j := 0; j < 100; j++ {
+			vector.AppendSample(pool, uint64(j), float64(j))
+			vector.AppendHistogram(pool, uint64(j), &histogram.FloatHistogram{})
+		}
+		vectors = append(vectors, vector)
+	}
+	testutil.Assert(t, tracker.Used() >= batchSize+3*100*(8+8+8+8), "grown buffers should be tracked, got %d bytes", tracker.Used())
+
+	for _, vector := range vectors {
+		pool.PutStepVector(vector)
+	}
+	pool.PutVectors(vectors)
+	testutil.Equals(t, int64(0), tracker.Used())
+
+	// Buffers reused from the pool are tracked again.
+	vectors = pool.GetVectorBatch()
+	vector := pool.GetStepVector(0)
+	vector.AppendSamples(pool, []uint64{0, 1}, []float64{0, 1})
+	testutil.Assert(t, tracker.Used() > batchSize, "reused buffers should be tracked")
+	pool.PutStepVector(vector)
+	pool.PutVectors(vectors)
+	testutil.Equals(t, int64(0), tracker.Used())
+}
+
+func TestVectorPoolForeignVectors(t *testing.T) {
+	tracker := limits.NewMemoryTracker(0)
+	pool := model.NewVectorPool(10)
+	pool.SetMemoryTracker(tracker)
+
+	// Vectors with buffers which were not taken from the pool do not release memory they did not reserve.
+	vector := pool.GetStepVector(0)
+	vector.Samples = []float64{1}
+	vector.SampleIDs = []uint64{0}
+	pool.PutStepVector(vector)
+	testutil.Equals(t, int64(0), tracker.Used())
+
+	// Vectors of pools without a tracker can be returned to pools with a tracker and vice versa.
+	untracked := model.NewVectorPool(10)
+	vector = untracked.GetStepVector(0)
+	vector.AppendSample(untracked, 0, 1)
+	pool.PutStepVector(vector)
+	testutil.Equals(t, int64(0), tracker.Used())
+
+	vector = pool.GetStepVector(0)
+	vector.AppendSample(pool, 0, 1)
+	testutil.Assert(t, tracker.Used() > 0, "samples should be tracked")
+	untracked.PutStepVector(vector)
+	testutil.Equals(t, int64(0), tracker.Used())
+}
@@ -6,6 +6,8 @@ package model
 import (
 	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-io/promql-engine/execution/limits"
 )
 
 type Series struct {
@@ -22,25 +24,34 @@ type StepVector struct {
 
 	HistogramIDs []uint64
 	Histograms   []*histogram.FloatHistogram
+
+	// reserved is the number of bytes charged to tracker for the buffers of the vector.
+	// They are released when the vector is returned to any pool.
+	reserved int64
+	tracker  *limits.MemoryTracker
 }
 
 func (s *StepVector) AppendSample(pool *VectorPool, id uint64, val float64) {
+	before := s.samplesSize()
 	if s.Samples == nil {
 		s.SampleIDs, s.Samples = pool.getSampleBuffers()
 	}
 	s.SampleIDs = append(s.SampleIDs, id)
 	s.Samples = append(s.Samples, val)
+	s.reserve(pool, s.samplesSize()-before)
 }
 
 func (s *StepVector) AppendSamples(pool *VectorPool, ids []uint64, vals []float64) {
 	if len(ids) == 0 && len(vals) == 0 {
 		return
 	}
+	before := s.samplesSize()
 	if s.Samples == nil {
 		s.SampleIDs, s.Samples = pool.getSampleBuffers()
 	}
 	s.SampleIDs = append(s.SampleIDs, ids...)
 	s.Samples = append(s.Samples, vals...)
+	s.reserve(pool, s.samplesSize()-before)
 }
 
 func (s *StepVector) RemoveSample(index int) {
@@ -49,25 +60,58 @@ func (s *StepVector) RemoveSample(index int) {
 }
 
 func (s *StepVector) AppendHistogram(pool *VectorPool, histogramID uint64, h *histogram.FloatHistogram) {
+	before := s.histogramsSize()
 	if s.Histograms == nil {
 		s.HistogramIDs, s.Histograms = pool.getHistogramBuffers()
 	}
 	s.HistogramIDs = append(s.HistogramIDs, histogramID)
 	s.Histograms = append(s.Histograms, h)
+	s.reserve(pool, s.histogramsSize()-before)
 }
 
 func (s *StepVector) AppendHistograms(pool *VectorPool, histogramIDs []uint64, hs []*histogram.FloatHistogram) {
 	if len(histogramIDs) == 0 && len(hs) == 0 {
 		return
 	}
+	before := s.histogramsSize()
 	if s.Histograms == nil {
 		s.HistogramIDs, s.Histograms = pool.getHistogramBuffers()
 	}
 	s.HistogramIDs = append(s.HistogramIDs, histogramIDs...)
 	s.Histograms = append(s.Histograms, hs...)
+	s.reserve(pool, s.histogramsSize()-before)
 }
 
 func (s *StepVector) RemoveHistogram(index int) {
 	s.Histograms = append(s.Histograms[:index], s.Histograms[index+1:]...)
 	s.HistogramIDs = append(s.HistogramIDs[:index], s.HistogramIDs[index+1:]...)
 }
+
+// samplesSize and histogramsSize return the capacity of the sample and histogram buffers in bytes.
+func (s *StepVector) samplesSize() int64 {
+	return int64(cap(s.SampleIDs))*sampleIDSize + int64(cap(s.Samples))*sampleSize
+}
+
+func (s *StepVector) histogramsSize() int64 {
+	return int64(cap(s.HistogramIDs))*sampleIDSize + int64(cap(s.Histograms))*histogramSize
+}
+
+// reserve charges the memory tracker of the pool for buffers which were taken
+// from the pool or grew while appending to them.
+func (s *StepVector) reserve(pool *VectorPool, bytes int64) {
+	if bytes <= 0 || pool.memoryTracker == nil {
+		return
+	}
+	if s.tracker == nil {
+		s.tracker = pool.memoryTracker
+	}
+	s.reserved += bytes
+	// The error is retained by the tracker, see VectorPool.reserve.
+	_ = s.tracker.Reserve(bytes)
+}
+
+// release returns the bytes reserved for the buffers of the vector.
+func (s *StepVector) release() {
+	s.tracker.Release(s.reserved)
+	s.reserved, s.tracker = 0, nil
+}
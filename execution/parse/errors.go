@@ -15,7 +15,43 @@ var ErrNotSupportedExpr = errors.New("unsupported expression")
 func UnsupportedOperationErr(op parser.ItemType) error {
 	t := parser.ItemTypeStr[op]
 	msg := fmt.Sprintf("operation not supported: %s", t)
-	return errors.Wrap(ErrNotSupportedExpr, msg)
+	return WithReason(errors.Wrap(ErrNotSupportedExpr, msg), "operation "+t)
 }
 
 var ErrNotImplemented = errors.New("expression not implemented")
+
+// UnknownReason is the reason of errors which were not annotated with WithReason.
+const UnknownReason = "unknown"
+
+// reasonError is an error caused by a feature which the engine does not support.
+type reasonError struct {
+	error
+	reason string
+}
+
+func (e *reasonError) Unwrap() error { return e.error }
+
+// WithReason annotates err with a short description of the feature which caused it,
+// for example "function predict_linear". Reasons are used as metric labels, so they
+// have to come from a bounded set and must never contain parts of the query.
+func WithReason(err error, reason string) error {
+	return &reasonError{error: err, reason: reason}
+}
+
+// Reason returns the reason err was annotated with, or UnknownReason if there is none.
+func Reason(err error) string {
+	var rerr *reasonError
+	if errors.As(err, &rerr) {
+		return rerr.reason
+	}
+	return UnknownReason
+}
+
+// FunctionReason returns the reason for errors caused by the function with the given name.
+// Names which are not known to the parser are reported together to keep the reasons bounded.
+func FunctionReason(name string) string {
+	if _, ok := parser.Functions[name]; !ok && !IsExtFunction(name) {
+		return "unknown function"
+	}
+	return "function " + name
+}
@@ -34,8 +34,8 @@ func IsExtFunction(functionName string) bool {
 func UnknownFunctionError(name string) error {
 	msg := fmt.Sprintf("unknown function: %s", name)
 	if _, ok := parser.Functions[name]; ok {
-		return errors.Wrap(ErrNotImplemented, msg)
+		return WithReason(errors.Wrap(ErrNotImplemented, msg), FunctionReason(name))
 	}
 
-	return errors.Wrap(ErrNotSupportedExpr, msg)
+	return WithReason(errors.Wrap(ErrNotSupportedExpr, msg), FunctionReason(name))
 }
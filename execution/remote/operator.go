@@ -11,67 +11,158 @@ import (
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/util/stats"
 
+	"github.com/thanos-io/promql-engine/api"
 	"github.com/thanos-io/promql-engine/execution/model"
 	"github.com/thanos-io/promql-engine/execution/scan"
 	engstore "github.com/thanos-io/promql-engine/execution/storage"
 	"github.com/thanos-io/promql-engine/execution/warnings"
 	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/tracing"
 )
 
+// operatorQuery is implemented by queries which are executed by vector operators, such as the
+// queries of engine.NewRemoteEngine. The operators of such queries are attached to the remote
+// execution, so that they show up when a distributed query is explained and analyzed.
+type operatorQuery interface {
+	RootOperator() model.VectorOperator
+}
+
+// remoteResult is the result of a remote query, which is either
+// read from a stream or materialised by executing the query.
+type remoteResult interface {
+	Series(ctx context.Context) ([]labels.Labels, error)
+	Next(ctx context.Context) ([]model.StepVector, error)
+	GetPool() *model.VectorPool
+	Close()
+}
+
 type Execution struct {
-	storage         *storageAdapter
+	result          remoteResult
+	timings         *remoteTimings
 	query           promql.Query
 	opts            *query.Options
 	queryRangeStart time.Time
-	vectorSelector  model.VectorOperator
-	model.OperatorTelemetry
+	engineLabels    []labels.Labels
+	model.StatsTelemetry
 }
 
-func NewExecution(query promql.Query, pool *model.VectorPool, queryRangeStart time.Time, opts *query.Options) *Execution {
-	storage := newStorageFromQuery(query, opts)
+// NewExecution creates an operator which executes the query in a remote engine.
+// engineLabels are the label sets of the remote engine.
+// Results of queries which implement StreamingQuery are consumed incrementally
+// from their stream, results of other queries are materialised before the first step is returned.
+func NewExecution(query promql.Query, pool *model.VectorPool, queryRangeStart time.Time, engineLabels []labels.Labels, opts *query.Options) *Execution {
 	e := &Execution{
-		storage:         storage,
 		query:           query,
 		opts:            opts,
 		queryRangeStart: queryRangeStart,
-		vectorSelector:  scan.NewVectorSelector(pool, storage, opts, 0, 0, 0, 1),
+		engineLabels:    engineLabels,
+	}
+	if streamingQuery, ok := query.(StreamingQuery); ok {
+		stream := newStreamSelector(streamingQuery, pool, opts)
+		e.result, e.timings = stream, &stream.timings
+	} else {
+		storage := newStorageFromQuery(query, opts)
+		e.result, e.timings = &materialisedResult{
+			VectorOperator: scan.NewVectorSelector(pool, storage, opts, 0, 0, false, 0, 1),
+			storage:        storage,
+		}, &storage.timings
 	}
-	e.OperatorTelemetry = &model.NoopTelemetry{}
+	e.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		e.OperatorTelemetry = &model.TrackedTelemetry{}
+		e.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 	return e
 }
 
 func (e *Execution) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
 	e.SetName("[*remoteExec]")
+	if obs, ok := e.remoteRoot().(model.ObservableVectorOperator); ok {
+		return e, []model.ObservableVectorOperator{obs}
+	}
 	return e, nil
 }
 
+// EngineLabels returns the label sets of the remote engine which executes the query.
+func (e *Execution) EngineLabels() []labels.Labels {
+	return e.engineLabels
+}
+
+// ExecutionStats returns the statistics of the remote execution together with the
+// time spent on the remote query, split into execution, queueing and network time.
+func (e *Execution) ExecutionStats() model.OperatorStats {
+	stats := e.StatsTelemetry.ExecutionStats()
+	if e.opts.EnableAnalysis {
+		stats.RemoteExecutionTime = e.timings.evalTime
+		stats.RemoteQueueTime = e.timings.queueTime
+		stats.NetworkTime = e.timings.networkTime
+	}
+	return stats
+}
+
+// remoteRoot returns the root operator of the remote query, or nil if the query is not executed by operators.
+func (e *Execution) remoteRoot() model.VectorOperator {
+	if q, ok := e.query.(operatorQuery); ok {
+		return q.RootOperator()
+	}
+	return nil
+}
+
+// EvaluatesInputForSeries marks the operator as executing the remote query when its series are loaded.
+func (e *Execution) EvaluatesInputForSeries() {}
+
 func (e *Execution) Series(ctx context.Context) ([]labels.Labels, error) {
-	return e.vectorSelector.Series(ctx)
+	// The remote query is executed when series are loaded, so the time is accounted to the operator.
+	start := time.Now()
+	series, err := e.result.Series(ctx)
+	e.AddExecutionTimeTaken(time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+	e.SetSeries(len(series))
+	return series, nil
 }
 
 func (e *Execution) Next(ctx context.Context) ([]model.StepVector, error) {
 	start := time.Now()
-	next, err := e.vectorSelector.Next(ctx)
+	next, err := e.result.Next(ctx)
 	e.AddExecutionTimeTaken(time.Since(start))
 	if next == nil {
 		// Closing the storage prematurely can lead to results from the query
 		// engine to be recycled. Because of this, we close the storage only
 		// when we are done with processing all samples returned by the query.
-		e.storage.Close()
+		e.result.Close()
 	}
-	return next, err
+	if err != nil {
+		return nil, err
+	}
+	// Samples returned by the remote engine are passed through as they are.
+	e.AddSamplesIn(model.CountSamples(next))
+	e.AddNextCall(next)
+	return next, nil
 }
 
 func (e *Execution) GetPool() *model.VectorPool {
-	return e.vectorSelector.GetPool()
+	return e.result.GetPool()
 }
 
 func (e *Execution) Explain() (me string, next []model.VectorOperator) {
-	return fmt.Sprintf("[*remoteExec] %s (%d, %d)", e.query, e.opts.Start.Unix(), e.opts.End.Unix()), nil
+	me = fmt.Sprintf("[*remoteExec] %s (%d, %d)", e.query, e.opts.Start.Unix(), e.opts.End.Unix())
+	if root := e.remoteRoot(); root != nil {
+		return me, []model.VectorOperator{root}
+	}
+	return me, nil
+}
+
+// materialisedResult reads the materialised result of a remote query with a vector selector.
+type materialisedResult struct {
+	model.VectorOperator
+	storage *storageAdapter
+}
+
+func (r *materialisedResult) Close() {
+	r.storage.Close()
 }
 
 type storageAdapter struct {
@@ -81,6 +172,8 @@ type storageAdapter struct {
 	once   sync.Once
 	err    error
 	series []engstore.SignedSeries
+
+	timings remoteTimings
 }
 
 func newStorageFromQuery(query promql.Query, opts *query.Options) *storageAdapter {
@@ -102,7 +195,23 @@ func (s *storageAdapter) GetSeries(ctx context.Context, _, _ int) ([]engstore.Si
 }
 
 func (s *storageAdapter) executeQuery(ctx context.Context) {
+	// Remote engines which use the same tracer attach their spans to this one,
+	// so the whole distributed query is recorded as a single trace.
+	if s.opts.Tracer != nil {
+		var span tracing.Span
+		ctx, span = s.opts.Tracer.Start(ctx, "remote query")
+		span.SetAttribute("query", s.query.String())
+		defer span.End()
+		defer func() {
+			if s.err != nil {
+				span.RecordError(s.err)
+			}
+		}()
+	}
+
+	start := time.Now()
 	result := s.query.Exec(ctx)
+	s.timings.observe(s.query, time.Since(start))
 	warnings.AddToContext(result.Warnings, ctx)
 	if result.Err != nil {
 		s.err = result.Err
@@ -135,6 +244,49 @@ func (s *storageAdapter) executeQuery(ctx context.Context) {
 	}
 }
 
+// remoteTimings are the times it took to execute a remote query.
+type remoteTimings struct {
+	// evalTime and queueTime are the times reported by the remote query and networkTime
+	// is the remaining time of its execution.
+	evalTime    time.Duration
+	queueTime   time.Duration
+	networkTime time.Duration
+}
+
+// observe splits the time it took to execute the remote query into the time spent
+// evaluating the query, waiting in the queue of the remote engine and on the network.
+// Queries which do not report timers are accounted as network time.
+func (t *remoteTimings) observe(query promql.Query, total time.Duration) {
+	var remoteTotal time.Duration
+	if tq, ok := query.(api.TimedQuery); ok {
+		timings := tq.Timings()
+		t.evalTime, t.queueTime, remoteTotal = timings.EvalTotalTime, timings.ExecQueueTime, timings.ExecTotalTime
+	} else if qs := query.Stats(); qs != nil && qs.Timers != nil {
+		t.evalTime = timerDuration(qs.Timers, stats.EvalTotalTime)
+		t.queueTime = timerDuration(qs.Timers, stats.ExecQueueTime)
+		remoteTotal = timerDuration(qs.Timers, stats.ExecTotalTime)
+	}
+	// Timers of streamed queries cover the lifetime of the stream, which includes the time the
+	// local query spent between reading batches. Only the time spent waiting is accounted.
+	t.queueTime = minDuration(t.queueTime, total)
+	t.evalTime = minDuration(t.evalTime, total-t.queueTime)
+	if remoteTotal < total {
+		t.networkTime = total - remoteTotal
+	}
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func timerDuration(timers *stats.QueryTimers, name stats.QueryTiming) time.Duration {
+	// Timers report their duration in seconds.
+	return time.Duration(timers.GetTimer(name).Duration() * float64(time.Second))
+}
+
 func (s *storageAdapter) Close() {
 	s.query.Close()
 }
@@ -0,0 +1,219 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package remote
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/util/annotations"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/execution/warnings"
+	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/tracing"
+)
+
+// StreamingQuery is an optional interface implemented by remote queries which can stream
+// their results. Remote executions consume streams incrementally instead of materialising the
+// whole result of the query before the first step is processed.
+type StreamingQuery interface {
+	promql.Query
+	// Stream starts executing the query and returns a stream over its result.
+	// The stream is bound to the given context.
+	Stream(ctx context.Context) (ResultStream, error)
+}
+
+// ResultStream delivers the result of a query in batches of steps.
+type ResultStream interface {
+	// Series returns the labels of the series in the result. Samples refer to
+	// series by their index in the returned slice.
+	Series() ([]labels.Labels, error)
+	// Next returns the next batch of steps in ascending order of their timestamps, or nil
+	// once the stream is exhausted. The vectors are only valid until the next call to Next.
+	Next() ([]model.StepVector, error)
+	// Warnings returns the annotations collected while executing the query.
+	// They are complete once the stream is exhausted.
+	Warnings() annotations.Annotations
+	// Close releases the resources held by the stream. It can be called before the stream is exhausted.
+	Close()
+}
+
+// streamSelector reads the result of a remote query from its stream. Steps are copied into
+// vectors of the local query as they arrive, so only the current batch of the remote
+// query is held in memory instead of its whole result.
+type streamSelector struct {
+	query StreamingQuery
+	opts  *query.Options
+	pool  *model.VectorPool
+
+	once   sync.Once
+	err    error
+	series []labels.Labels
+	stream ResultStream
+	span   tracing.Span
+
+	maxt        int64
+	step        int64
+	currentStep int64
+
+	// buffer holds the last batch read from the stream and
+	// bufferIdx is the index of the first step which was not consumed yet.
+	buffer    []model.StepVector
+	bufferIdx int
+	done      bool
+
+	timings remoteTimings
+	// streamTime is the time spent waiting for the stream.
+	streamTime time.Duration
+}
+
+func newStreamSelector(query StreamingQuery, pool *model.VectorPool, opts *query.Options) *streamSelector {
+	s := &streamSelector{
+		query:       query,
+		opts:        opts,
+		pool:        pool,
+		maxt:        opts.End.UnixMilli(),
+		step:        opts.Step.Milliseconds(),
+		currentStep: opts.Start.UnixMilli(),
+	}
+	// For instant queries, set the step to a positive value
+	// so that the operator can terminate.
+	if s.step == 0 {
+		s.step = 1
+	}
+	return s
+}
+
+func (s *streamSelector) Series(ctx context.Context) ([]labels.Labels, error) {
+	s.once.Do(func() { s.err = s.openStream(ctx) })
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.series, nil
+}
+
+func (s *streamSelector) openStream(ctx context.Context) error {
+	// Remote engines which use the same tracer attach their spans to this one,
+	// so the whole distributed query is recorded as a single trace.
+	if s.opts.Tracer != nil {
+		ctx, s.span = s.opts.Tracer.Start(ctx, "remote query")
+		s.span.SetAttribute("query", s.query.String())
+	}
+
+	start := time.Now()
+	defer func() { s.streamTime += time.Since(start) }()
+
+	stream, err := s.query.Stream(ctx)
+	if err != nil {
+		s.finish(ctx, err)
+		return err
+	}
+	s.stream = stream
+	s.series, err = stream.Series()
+	if err != nil {
+		s.finish(ctx, err)
+		return err
+	}
+	s.pool.SetStepSize(len(s.series))
+	return nil
+}
+
+func (s *streamSelector) GetPool() *model.VectorPool {
+	return s.pool
+}
+
+func (s *streamSelector) Next(ctx context.Context) ([]model.StepVector, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	if _, err := s.Series(ctx); err != nil {
+		return nil, err
+	}
+	if s.currentStep > s.maxt {
+		// Read the stream until it is exhausted so that its warnings are
+		// collected. There are no steps left after the end of the query.
+		_, err := s.nextStep(ctx)
+		return nil, err
+	}
+
+	vectors := s.pool.GetVectorBatch()
+	for i := 0; i < s.opts.NumSteps() && s.currentStep <= s.maxt; i++ {
+		vector := s.pool.GetStepVector(s.currentStep)
+		remote, err := s.nextStep(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Steps which are outside the range of the remote query are left empty.
+		if remote != nil && remote.T == s.currentStep {
+			vector.AppendSamples(s.pool, remote.SampleIDs, remote.Samples)
+			vector.AppendHistograms(s.pool, remote.HistogramIDs, remote.Histograms)
+			s.bufferIdx++
+		}
+		s.opts.SampleTracker.AddSamplesAtTimestamp(vector.T, int64(len(vector.Samples)+len(vector.Histograms)))
+		vectors = append(vectors, vector)
+		s.currentStep += s.step
+	}
+	return vectors, nil
+}
+
+// nextStep returns the first step of the stream which is not before the current step,
+// or nil once the stream is exhausted.
+func (s *streamSelector) nextStep(ctx context.Context) (*model.StepVector, error) {
+	for {
+		for ; s.bufferIdx < len(s.buffer); s.bufferIdx++ {
+			if s.buffer[s.bufferIdx].T >= s.currentStep {
+				return &s.buffer[s.bufferIdx], nil
+			}
+		}
+		if s.done {
+			return nil, nil
+		}
+
+		start := time.Now()
+		batch, err := s.stream.Next()
+		s.streamTime += time.Since(start)
+		if err != nil {
+			s.finish(ctx, err)
+			return nil, err
+		}
+		if batch == nil {
+			s.finish(ctx, nil)
+			return nil, nil
+		}
+		s.buffer, s.bufferIdx = batch, 0
+	}
+}
+
+// finish is called once the stream is exhausted, failed or closed. It records the
+// timings and warnings of the remote query and releases the stream.
+func (s *streamSelector) finish(ctx context.Context, err error) {
+	s.done = true
+	s.buffer, s.bufferIdx = nil, 0
+	if s.stream != nil {
+		warnings.AddToContext(s.stream.Warnings(), ctx)
+		s.stream.Close()
+	}
+	s.timings.observe(s.query, s.streamTime)
+	if s.span != nil {
+		if err != nil {
+			s.span.RecordError(err)
+		}
+		s.span.End()
+		s.span = nil
+	}
+}
+
+// Close releases the stream if it was not exhausted yet, and closes the query.
+func (s *streamSelector) Close() {
+	if !s.done {
+		s.finish(context.Background(), nil)
+	}
+	s.query.Close()
+}
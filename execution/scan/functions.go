@@ -6,6 +6,7 @@ package scan
 import (
 	"math"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/histogram"
 
 	"github.com/thanos-io/promql-engine/execution/aggregate"
@@ -138,6 +139,21 @@ var rangeVectorFuncs = map[string]FunctionCall{
 		}
 		return deriv(f.Samples), nil, true
 	},
+	"predict_linear": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool) {
+		samples := floatSamples(f.Samples)
+		if len(samples) < 2 {
+			return 0., nil, false
+		}
+		slope, intercept := linearRegression(samples, f.StepTime)
+		return slope*f.ScalarPoints[0] + intercept, nil, true
+	},
+	"holt_winters": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool) {
+		samples := floatSamples(f.Samples)
+		if len(samples) < 2 {
+			return 0., nil, false
+		}
+		return holtWinters(samples, f.ScalarPoints[0], f.ScalarPoints[1]), nil, true
+	},
 	"irate": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool) {
 		f.Samples = filterFloatOnlySamples(f.Samples)
 		if len(f.Samples) < 2 {
@@ -188,8 +204,7 @@ var rangeVectorFuncs = map[string]FunctionCall{
 		if f.MetricAppearedTs == nil {
 			panic("BUG: we got some Samples but metric still hasn't appeared")
 		}
-		v, h := extendedRate(f.Samples, true, true, f.StepTime, f.SelectRange, f.Offset, *f.MetricAppearedTs)
-		return v, h, true
+		return extendedRate(f.Samples, true, true, f.StepTime, f.SelectRange, f.Offset, *f.MetricAppearedTs)
 	},
 	"xdelta": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool) {
 		if len(f.Samples) == 0 {
@@ -198,8 +213,7 @@ var rangeVectorFuncs = map[string]FunctionCall{
 		if f.MetricAppearedTs == nil {
 			panic("BUG: we got some Samples but metric still hasn't appeared")
 		}
-		v, h := extendedRate(f.Samples, false, false, f.StepTime, f.SelectRange, f.Offset, *f.MetricAppearedTs)
-		return v, h, true
+		return extendedRate(f.Samples, false, false, f.StepTime, f.SelectRange, f.Offset, *f.MetricAppearedTs)
 	},
 	"xincrease": func(f FunctionArgs) (float64, *histogram.FloatHistogram, bool) {
 		if len(f.Samples) == 0 {
@@ -208,8 +222,7 @@ var rangeVectorFuncs = map[string]FunctionCall{
 		if f.MetricAppearedTs == nil {
 			panic("BUG: we got some Samples but metric still hasn't appeared")
 		}
-		v, h := extendedRate(f.Samples, true, false, f.StepTime, f.SelectRange, f.Offset, *f.MetricAppearedTs)
-		return v, h, true
+		return extendedRate(f.Samples, true, false, f.StepTime, f.SelectRange, f.Offset, *f.MetricAppearedTs)
 	},
 }
 
@@ -221,6 +234,20 @@ func NewRangeVectorFunc(name string) (FunctionCall, error) {
 	return call, nil
 }
 
+// validateScalarArgs returns an error for scalar arguments which make Prometheus fail the query.
+func validateScalarArgs(name string, args []float64) error {
+	switch name {
+	case "holt_winters":
+		if sf := args[0]; sf <= 0 || sf >= 1 {
+			return errors.Newf("invalid smoothing factor. Expected: 0 < sf < 1, got: %f", sf)
+		}
+		if tf := args[1]; tf <= 0 || tf >= 1 {
+			return errors.Newf("invalid trend factor. Expected: 0 < tf < 1, got: %f", tf)
+		}
+	}
+	return nil
+}
+
 // extrapolatedRate is a utility function for rate/increase/delta.
 // It calculates the rate (allowing for counter resets if isCounter is true),
 // extrapolates if the first/last sample is close to the boundary, and returns
@@ -304,18 +331,16 @@ func extrapolatedRate(samples []Sample, isCounter, isRate bool, stepTime int64,
 // It calculates the rate (allowing for counter resets if isCounter is true),
 // taking into account the last sample before the range start, and returns
 // the result as either per-second (if isRate is true) or overall.
-func extendedRate(samples []Sample, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64, metricAppearedTs int64) (float64, *histogram.FloatHistogram) {
+func extendedRate(samples []Sample, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64, metricAppearedTs int64) (float64, *histogram.FloatHistogram, bool) {
 	var (
-		rangeStart      = stepTime - (selectRange + offset)
-		rangeEnd        = stepTime - offset
-		resultValue     float64
-		resultHistogram *histogram.FloatHistogram
+		rangeStart  = stepTime - (selectRange + offset)
+		rangeEnd    = stepTime - offset
+		resultValue float64
 	)
 
 	if samples[0].H != nil {
-		// TODO - support extended rate for histograms
-		resultHistogram = histogramRate(samples, isCounter)
-		return resultValue, resultHistogram
+		h, ok := extendedHistogramRate(samples, isCounter, isRate, stepTime, selectRange, offset, metricAppearedTs)
+		return 0, h, ok
 	}
 
 	sameVals := true
@@ -332,7 +357,7 @@ func extendedRate(samples []Sample, isCounter, isRate bool, stepTime int64, sele
 	if isCounter && !isRate && sameVals {
 		// Make sure we are not at the end of the range.
 		if stepTime-offset <= until {
-			return samples[0].F, nil
+			return samples[0].F, nil, true
 		}
 	}
 
@@ -345,7 +370,7 @@ func extendedRate(samples []Sample, isCounter, isRate bool, stepTime int64, sele
 		// If the point before the range is too far from rangeStart, drop it.
 		if float64(rangeStart-samples[0].T) > averageDurationBetweenSamples {
 			if len(samples) < 3 {
-				return resultValue, nil
+				return resultValue, nil, true
 			}
 			firstPoint = 1
 			sampledInterval = float64(samples[len(samples)-1].T - samples[1].T)
@@ -385,7 +410,93 @@ func extendedRate(samples []Sample, isCounter, isRate bool, stepTime int64, sele
 		resultValue = resultValue / float64(selectRange/1000)
 	}
 
-	return resultValue, nil
+	return resultValue, nil, true
+}
+
+// extendedHistogramRate is the native histogram variant of extendedRate. It requires
+// samples[0] to be a histogram and returns false if any other sample is a float.
+// Counter resets are handled the same way as in histogramRate.
+func extendedHistogramRate(samples []Sample, isCounter, isRate bool, stepTime int64, selectRange int64, offset int64, metricAppearedTs int64) (*histogram.FloatHistogram, bool) {
+	var (
+		rangeStart = stepTime - (selectRange + offset)
+		rangeEnd   = stepTime - offset
+		sameVals   = true
+	)
+	for i := range samples {
+		if samples[i].H == nil {
+			// The range contains a mix of histograms and floats.
+			return nil, false
+		}
+		if i > 0 && !samples[i-1].H.Equals(samples[i].H) {
+			sameVals = false
+		}
+	}
+
+	// This effectively injects a "zero" series for xincrease if we only have one sample.
+	// Only do it for some time when the metric appears the first time.
+	until := selectRange + metricAppearedTs
+	if isCounter && !isRate && sameVals {
+		// Make sure we are not at the end of the range.
+		if stepTime-offset <= until {
+			h := samples[0].H.Copy()
+			h.CounterResetHint = histogram.GaugeType
+			return h, true
+		}
+	}
+
+	sampledInterval := float64(samples[len(samples)-1].T - samples[0].T)
+	averageDurationBetweenSamples := sampledInterval / float64(len(samples)-1)
+
+	firstPoint := 0
+	// Only do this for not xincrease
+	if !(isCounter && !isRate) {
+		// If the point before the range is too far from rangeStart, drop it.
+		if float64(rangeStart-samples[0].T) > averageDurationBetweenSamples {
+			if len(samples) < 3 {
+				return emptyHistogramRate(samples[len(samples)-1].H), true
+			}
+			firstPoint = 1
+			sampledInterval = float64(samples[len(samples)-1].T - samples[1].T)
+			averageDurationBetweenSamples = sampledInterval / float64(len(samples)-2)
+		}
+	}
+	if len(samples)-firstPoint < 2 {
+		return emptyHistogramRate(samples[len(samples)-1].H), true
+	}
+
+	resultHistogram := histogramRate(samples[firstPoint:], isCounter)
+	if resultHistogram == nil {
+		return nil, false
+	}
+
+	// Duration between last sample and boundary of range.
+	durationToEnd := float64(rangeEnd - samples[len(samples)-1].T)
+	// If the points cover the whole range (i.e. they start just before the
+	// range start and end just before the range end) adjust the value from
+	// the sampled range to the requested range.
+	// Only do this for not xincrease.
+	if !(isCounter && !isRate) {
+		if samples[firstPoint].T <= rangeStart && durationToEnd < averageDurationBetweenSamples {
+			adjustToRange := float64(selectRange / 1000)
+			resultHistogram.Mul(adjustToRange / (sampledInterval / 1000))
+		}
+	}
+
+	if isRate {
+		resultHistogram.Div(float64(selectRange / 1000))
+	}
+
+	return resultHistogram, true
+}
+
+// emptyHistogramRate returns a histogram without observations, which is the
+// histogram equivalent of the zero returned by extendedRate for floats.
+func emptyHistogramRate(h *histogram.FloatHistogram) *histogram.FloatHistogram {
+	return &histogram.FloatHistogram{
+		Schema:           h.Schema,
+		ZeroThreshold:    h.ZeroThreshold,
+		CounterResetHint: histogram.GaugeType,
+	}
 }
 
 // histogramRate is a helper function for extrapolatedRate. It requires
@@ -555,6 +666,41 @@ func deriv(points []Sample) float64 {
 	return slope
 }
 
+// holtWinters applies double exponential smoothing to the samples using
+// the smoothing factor sf and the trend factor tf.
+func holtWinters(points []Sample, sf, tf float64) float64 {
+	var s0, s1, b float64
+	// Set initial values.
+	s1 = points[0].F
+	b = points[1].F - points[0].F
+
+	// Run the smoothing operation.
+	var x, y float64
+	for i := 1; i < len(points); i++ {
+		// Scale the raw value against the smoothing factor.
+		x = sf * points[i].F
+
+		// Scale the last smoothed value with the trend at this point.
+		b = calcTrendValue(i-1, tf, s0, s1, b)
+		y = (1 - sf) * (s1 + b)
+
+		s0, s1 = s1, x+y
+	}
+	return s1
+}
+
+// calcTrendValue calculates the trend value at the given index i.
+// The argument tf is the trend factor, s0 is the computed smoothed value,
+// s1 is the computed trend factor and b is the raw input value.
+func calcTrendValue(i int, tf, s0, s1, b float64) float64 {
+	if i == 0 {
+		return b
+	}
+	x := tf * (s1 - s0)
+	y := (1 - tf) * b
+	return x + y
+}
+
 func resets(points []Sample) float64 {
 	count := 0
 	prev := points[0].F
@@ -612,6 +758,27 @@ func linearRegression(Samples []Sample, interceptTime int64) (slope, intercept f
 	return slope, intercept
 }
 
+// floatSamples returns the float samples from the input, allocating a new slice only
+// when the input contains histograms. Unlike filterFloatOnlySamples, it does not modify the input.
+func floatSamples(samples []Sample) []Sample {
+	numFloats := 0
+	for _, sample := range samples {
+		if sample.H == nil {
+			numFloats++
+		}
+	}
+	if numFloats == len(samples) {
+		return samples
+	}
+	floats := make([]Sample, 0, numFloats)
+	for _, sample := range samples {
+		if sample.H == nil {
+			floats = append(floats, sample)
+		}
+	}
+	return floats
+}
+
 func filterFloatOnlySamples(samples []Sample) []Sample {
 	i := 0
 	for _, sample := range samples {
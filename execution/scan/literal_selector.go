@@ -28,7 +28,7 @@ type numberLiteralSelector struct {
 	once        sync.Once
 
 	val float64
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func NewNumberLiteralSelector(pool *model.VectorPool, opts *query.Options, val float64) *numberLiteralSelector {
@@ -42,9 +42,9 @@ func NewNumberLiteralSelector(pool *model.VectorPool, opts *query.Options, val f
 		val:         val,
 	}
 
-	op.OperatorTelemetry = &model.NoopTelemetry{}
+	op.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		op.OperatorTelemetry = &model.TrackedTelemetry{}
+		op.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 
 	return op
@@ -99,6 +99,7 @@ func (o *numberLiteralSelector) Next(ctx context.Context) ([]model.StepVector, e
 	}
 	o.currentStep += o.step * int64(o.numSteps)
 	o.AddExecutionTimeTaken(time.Since(start))
+	o.AddNextCall(vectors)
 
 	return vectors, nil
 }
@@ -108,5 +109,6 @@ func (o *numberLiteralSelector) loadSeries() {
 	o.once.Do(func() {
 		o.series = make([]labels.Labels, 1)
 		o.vectorPool.SetStepSize(len(o.series))
+		o.SetSeries(len(o.series))
 	})
 }
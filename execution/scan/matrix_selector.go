@@ -6,10 +6,10 @@ package scan
 import (
 	"context"
 	"fmt"
+	"math"
 	"sync"
 	"time"
 
-	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/storage"
@@ -41,6 +41,13 @@ type matrixSelector struct {
 	series       []labels.Labels
 	once         sync.Once
 
+	// scalarParams are the scalar arguments of the function, shared by all shards.
+	scalarParams *ScalarParams
+	// params holds the values of the scalar arguments for the current batch of steps
+	// and paramsBatch is the index of the next batch to read.
+	params      [][]float64
+	paramsBatch int
+
 	numSteps      int
 	mint          int64
 	maxt          int64
@@ -58,17 +65,19 @@ type matrixSelector struct {
 
 	// Lookback delta for extended range functions.
 	extLookbackDelta int64
-	model.OperatorTelemetry
-}
 
-var ErrNativeHistogramsNotSupported = errors.New("native histograms are not supported in extended range functions")
+	sampleTracker *query.SampleTracker
+	// samplesPerStep is a reusable buffer for counting the samples loaded in each step of a batch.
+	samplesPerStep []int64
+	model.StatsTelemetry
+}
 
 // NewMatrixSelector creates operator which selects vector of series over time.
 func NewMatrixSelector(
 	pool *model.VectorPool,
 	selector engstore.SeriesSelector,
 	functionName string,
-	arg float64,
+	scalarParams *ScalarParams,
 	opts *query.Options,
 	selectRange, offset time.Duration,
 	batchSize int64,
@@ -84,7 +93,9 @@ func NewMatrixSelector(
 		call:         call,
 		functionName: functionName,
 		vectorPool:   pool,
-		scalarArgs:   []float64{arg},
+		scalarArgs:   make([]float64, len(scalarParams.Ops())),
+		scalarParams: scalarParams,
+		params:       newParams(len(scalarParams.Ops()), opts.NumSteps()),
 
 		numSteps:      opts.NumSteps(),
 		mint:          opts.Start.UnixMilli(),
@@ -101,10 +112,13 @@ func NewMatrixSelector(
 		numShards: numShard,
 
 		extLookbackDelta: opts.ExtLookbackDelta.Milliseconds(),
+
+		sampleTracker:  opts.SampleTracker,
+		samplesPerStep: make([]int64, opts.NumSteps()),
 	}
-	m.OperatorTelemetry = &model.NoopTelemetry{}
+	m.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		m.OperatorTelemetry = &model.TrackedTelemetry{}
+		m.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 	// For instant queries, set the step to a positive value
 	// so that the operator can terminate.
@@ -117,15 +131,44 @@ func NewMatrixSelector(
 
 func (o *matrixSelector) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
 	o.SetName("[*matrixSelector]")
-	return o, nil
+	paramOps := o.paramOps()
+	ops := make([]model.ObservableVectorOperator, 0, len(paramOps))
+	for _, paramOp := range paramOps {
+		if obsParamOp, ok := paramOp.(model.ObservableVectorOperator); ok {
+			ops = append(ops, obsParamOp)
+		}
+	}
+	return o, ops
 }
 
 func (o *matrixSelector) Explain() (me string, next []model.VectorOperator) {
 	r := time.Duration(o.selectRange) * time.Millisecond
+	if paramOps := o.paramOps(); len(paramOps) > 0 {
+		next = paramOps
+	}
 	if o.call != nil {
-		return fmt.Sprintf("[*matrixSelector] %v({%v}[%s] %v mod %v)", o.functionName, o.storage.Matchers(), r, o.shard, o.numShards), nil
+		return fmt.Sprintf("[*matrixSelector] %v({%v}[%s] %v mod %v)", o.functionName, o.storage.Matchers(), r, o.shard, o.numShards), next
+	}
+	return fmt.Sprintf("[*matrixSelector] {%v}[%s] %v mod %v", o.storage.Matchers(), r, o.shard, o.numShards), next
+}
+
+// paramOps returns the operators of the scalar arguments. They are shared by all shards,
+// so they are only explained as children of the first shard.
+func (o *matrixSelector) paramOps() []model.VectorOperator {
+	if o.shard != 0 {
+		return nil
 	}
-	return fmt.Sprintf("[*matrixSelector] {%v}[%s] %v mod %v", o.storage.Matchers(), r, o.shard, o.numShards), nil
+	return o.scalarParams.Ops()
+}
+
+// SelectRange returns the range of samples of each series which is evaluated at each step.
+// The interval between the samples is given by the data in storage, so it is zero.
+func (o *matrixSelector) SelectRange() (selectRange, interval time.Duration) {
+	r := o.selectRange
+	if o.isExtFunction {
+		r += o.extLookbackDelta
+	}
+	return time.Duration(r) * time.Millisecond, 0
 }
 
 func (o *matrixSelector) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -155,6 +198,26 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 		return nil, err
 	}
 
+	// Parameters are read once per batch of steps since the same steps
+	// are returned for every batch of series.
+	if len(o.params) > 0 && o.currentSeries == 0 {
+		if err := o.scalarParams.read(ctx, o.paramsBatch, o.params); err != nil {
+			return nil, err
+		}
+		o.paramsBatch++
+		// Arguments are only validated when the function is evaluated for at least one series.
+		if len(o.scanners) > 0 {
+			for currStep := 0; currStep < o.numSteps && o.currentStep+int64(currStep)*o.step <= o.maxt; currStep++ {
+				for i := range o.params {
+					o.scalarArgs[i] = o.params[i][currStep]
+				}
+				if err := validateScalarArgs(o.functionName, o.scalarArgs); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
 	ts := o.currentStep
 	vectors := o.vectorPool.GetVectorBatch()
 	for currStep := 0; currStep < o.numSteps && ts <= o.maxt; currStep++ {
@@ -187,9 +250,12 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 			if err != nil {
 				return nil, err
 			}
+			o.samplesPerStep[currStep] += int64(len(rangeSamples))
+			for i := range o.params {
+				o.scalarArgs[i] = o.params[i][currStep]
+			}
 
-			// TODO(saswatamcode): Handle multi-arg functions for matrixSelectors.
-			// Also, allow operator to exist independently without being nested
+			// TODO(saswatamcode): Allow operator to exist independently without being nested
 			// under parser.Call by implementing new data model.
 			// https://github.com/thanos-io/promql-engine/issues/39
 			f, h, ok := o.call(FunctionArgs{
@@ -225,13 +291,49 @@ func (o *matrixSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 			seriesTs += o.step
 		}
 	}
+	for i := range vectors {
+		o.sampleTracker.AddSamplesAtTimestamp(ts+int64(i)*o.step, o.samplesPerStep[i])
+		o.AddSamplesIn(o.samplesPerStep[i])
+		o.samplesPerStep[i] = 0
+	}
 	if o.currentSeries == int64(len(o.scanners)) {
 		o.currentStep += o.step * int64(o.numSteps)
 		o.currentSeries = 0
 	}
+	o.AddNextCall(vectors)
 	return vectors, nil
 }
 
+func newParams(numParams, numSteps int) [][]float64 {
+	params := make([][]float64, numParams)
+	for i := range params {
+		params[i] = make([]float64, numSteps)
+	}
+	return params
+}
+
+// loadParams reads the next batch of steps from each scalar argument operator.
+// Steps for which an operator returns no sample are set to NaN.
+func loadParams(ctx context.Context, paramOps []model.VectorOperator, params [][]float64) error {
+	for i, paramOp := range paramOps {
+		args, err := paramOp.Next(ctx)
+		if err != nil {
+			return err
+		}
+		for j := range params[i] {
+			params[i][j] = math.NaN()
+			if j < len(args) && len(args[j].Samples) > 0 {
+				params[i][j] = args[j].Samples[0]
+			}
+		}
+		for j := range args {
+			paramOp.GetPool().PutStepVector(args[j])
+		}
+		paramOp.GetPool().PutVectors(args)
+	}
+	return nil
+}
+
 func (o *matrixSelector) loadSeries(ctx context.Context) error {
 	var err error
 	o.once.Do(func() {
@@ -274,6 +376,7 @@ func (o *matrixSelector) loadSeries(ctx context.Context) error {
 			o.seriesBatchSize = numSeries
 		}
 		o.vectorPool.SetStepSize(int(o.seriesBatchSize))
+		o.SetSeries(len(o.series))
 	})
 	return err
 }
@@ -390,7 +493,6 @@ loop:
 // TODO(fpetkovski): Add max samples limit.
 func selectExtPoints(it *storage.BufferedSeriesIterator, mint, maxt int64, out []Sample, extLookbackDelta int64, metricAppearedTs **int64) ([]Sample, error) {
 	extMint := mint - extLookbackDelta
-	selectsNativeHistograms := false
 
 	if len(out) > 0 && out[len(out)-1].T >= mint {
 		// There is an overlap between previous and current ranges, retain common
@@ -434,7 +536,6 @@ loop:
 		case chunkenc.ValNone:
 			break loop
 		case chunkenc.ValHistogram, chunkenc.ValFloatHistogram:
-			selectsNativeHistograms = true
 			t, fh := buf.AtFloatHistogram()
 			if value.IsStaleNaN(fh.Sum) {
 				continue loop
@@ -442,8 +543,13 @@ loop:
 			if *metricAppearedTs == nil {
 				*metricAppearedTs = &t
 			}
-			if t >= mint {
+
+			// Same as for floats, keep the last histogram at or before range start.
+			if t >= mint || !appendedPointBeforeMint {
 				out = append(out, Sample{T: t, H: fh})
+				appendedPointBeforeMint = true
+			} else {
+				out[len(out)-1] = Sample{T: t, H: fh}
 			}
 		case chunkenc.ValFloat:
 			t, v := buf.At()
@@ -470,7 +576,6 @@ loop:
 	// The sought sample might also be in the range.
 	switch soughtValueType {
 	case chunkenc.ValHistogram, chunkenc.ValFloatHistogram:
-		selectsNativeHistograms = true
 		t, fh := it.AtFloatHistogram()
 		if t == maxt && !value.IsStaleNaN(fh.Sum) {
 			if *metricAppearedTs == nil {
@@ -488,9 +593,5 @@ loop:
 		}
 	}
 
-	if selectsNativeHistograms {
-		return nil, ErrNativeHistogramsNotSupported
-	}
-
 	return out, nil
 }
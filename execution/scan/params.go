@@ -0,0 +1,73 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package scan
+
+import (
+	"context"
+	"sync"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+)
+
+// ScalarParams evaluates the scalar arguments of a range function once for all shards of the function.
+// Shards read the batches of steps independently of each other, so each batch is kept until it was
+// read by every shard.
+type ScalarParams struct {
+	ops       []model.VectorOperator
+	numSteps  int
+	numShards int
+
+	mu sync.Mutex
+	// batches are the batches of steps which were not read by all shards yet,
+	// starting with the batch with the index first.
+	batches []paramsBatch
+	first   int
+}
+
+type paramsBatch struct {
+	params  [][]float64
+	readers int
+}
+
+// NewScalarParams creates scalar parameters which are read by numShards shards in batches of numSteps steps.
+func NewScalarParams(ops []model.VectorOperator, numSteps, numShards int) *ScalarParams {
+	return &ScalarParams{
+		ops:       ops,
+		numSteps:  numSteps,
+		numShards: numShards,
+	}
+}
+
+// Ops returns the operators of the scalar arguments, in the order of the arguments.
+func (p *ScalarParams) Ops() []model.VectorOperator {
+	if p == nil {
+		return nil
+	}
+	return p.ops
+}
+
+// read copies the values of the batch of steps with the given index into params.
+func (p *ScalarParams) read(ctx context.Context, batch int, params [][]float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.first+len(p.batches) <= batch {
+		b := paramsBatch{params: newParams(len(p.ops), p.numSteps), readers: p.numShards}
+		if err := loadParams(ctx, p.ops, b.params); err != nil {
+			return err
+		}
+		p.batches = append(p.batches, b)
+	}
+
+	b := &p.batches[batch-p.first]
+	for i := range params {
+		copy(params[i], b.params[i])
+	}
+	b.readers--
+	for len(p.batches) > 0 && p.batches[0].readers == 0 {
+		p.batches = p.batches[1:]
+		p.first++
+	}
+	return nil
+}
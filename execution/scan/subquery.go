@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
@@ -16,7 +17,6 @@ import (
 	"github.com/thanos-io/promql-engine/query"
 )
 
-// TODO: only instant subqueries for now.
 type subqueryOperator struct {
 	next        model.VectorOperator
 	pool        *model.VectorPool
@@ -24,38 +24,78 @@ type subqueryOperator struct {
 	mint        int64
 	maxt        int64
 	currentStep int64
+	step        int64
+	stepsBatch  int
+	scalarArgs  []float64
+
+	// paramOps return the scalar arguments of the function for each step.
+	paramOps []model.VectorOperator
+	// params holds the values returned by paramOps for the current batch of steps.
+	params [][]float64
 
 	funcExpr *parser.Call
 	subQuery *parser.SubqueryExpr
+	// subqueryStep is the step at which the inner operator is evaluated.
+	subqueryStep time.Duration
 
 	onceSeries sync.Once
 	series     []labels.Labels
-	acc        [][]Sample
+
+	// buffers hold the samples of the inner query which are inside the window of the current step.
+	// Samples are only dropped once they fall out of the window, so overlapping windows reuse them.
+	buffers [][]Sample
+	// lastVectors is the last batch returned by the inner operator and lastCollected
+	// is the index of the first vector in the batch which was not collected yet.
+	lastVectors   []model.StepVector
+	lastCollected int
 }
 
-func NewSubqueryOperator(pool *model.VectorPool, next model.VectorOperator, opts *query.Options, funcExpr *parser.Call, subQuery *parser.SubqueryExpr) (model.VectorOperator, error) {
+func NewSubqueryOperator(pool *model.VectorPool, next model.VectorOperator, opts *query.Options, funcExpr *parser.Call, subQuery *parser.SubqueryExpr, paramOps []model.VectorOperator) (model.VectorOperator, error) {
 	call, err := NewRangeVectorFunc(funcExpr.Func.Name)
 	if err != nil {
 		return nil, err
 	}
+	step := opts.Step.Milliseconds()
+	// For instant queries, set the step to a positive value
+	// so that the operator can terminate.
+	if step == 0 {
+		step = 1
+	}
 	return &subqueryOperator{
-		next:        next,
-		call:        call,
-		pool:        pool,
-		funcExpr:    funcExpr,
-		subQuery:    subQuery,
-		mint:        opts.Start.UnixMilli(),
-		maxt:        opts.End.UnixMilli(),
-		currentStep: opts.Start.UnixMilli(),
+		next:         next,
+		call:         call,
+		pool:         pool,
+		funcExpr:     funcExpr,
+		subQuery:     subQuery,
+		subqueryStep: query.NestedOptionsForSubquery(opts, subQuery).Step,
+		mint:         opts.Start.UnixMilli(),
+		maxt:         opts.End.UnixMilli(),
+		currentStep:  opts.Start.UnixMilli(),
+		step:         step,
+		stepsBatch:   opts.StepsBatch,
+		scalarArgs:   make([]float64, len(paramOps)),
+		paramOps:     paramOps,
+		params:       newParams(len(paramOps), opts.StepsBatch),
 	}, nil
 }
 
 func (o *subqueryOperator) Explain() (me string, next []model.VectorOperator) {
-	return fmt.Sprintf("[*subqueryOperator] %v()", o.funcExpr.Func.Name), []model.VectorOperator{o.next}
+	next = append(next, o.paramOps...)
+	next = append(next, o.next)
+	return fmt.Sprintf("[*subqueryOperator] %v()", o.funcExpr.Func.Name), next
 }
 
 func (o *subqueryOperator) GetPool() *model.VectorPool { return o.pool }
 
+// SelectRange returns the range of the subquery which is evaluated at each step
+// and the step at which the inner operator is evaluated.
+func (o *subqueryOperator) SelectRange() (selectRange, interval time.Duration) {
+	return o.subQuery.Range, o.subqueryStep
+}
+
+// Inner returns the operator which is evaluated at the steps of the subquery.
+func (o *subqueryOperator) Inner() model.VectorOperator { return o.next }
+
 func (o *subqueryOperator) Next(ctx context.Context) ([]model.StepVector, error) {
 	select {
 	case <-ctx.Done():
@@ -69,48 +109,102 @@ func (o *subqueryOperator) Next(ctx context.Context) ([]model.StepVector, error)
 		return nil, err
 	}
 
-ACC:
-	for {
-		vectors, err := o.next.Next(ctx)
-		if err != nil {
+	if err := loadParams(ctx, o.paramOps, o.params); err != nil {
+		return nil, err
+	}
+
+	var (
+		offset      = o.subQuery.Offset.Milliseconds()
+		selectRange = o.subQuery.Range.Milliseconds()
+	)
+	res := o.pool.GetVectorBatch()
+	for i := 0; i < o.stepsBatch && o.currentStep <= o.maxt; i++ {
+		maxt := o.currentStep - offset
+		mint := maxt - selectRange
+
+		for j := range o.params {
+			o.scalarArgs[j] = o.params[j][i]
+		}
+		if len(o.buffers) > 0 {
+			if err := validateScalarArgs(o.funcExpr.Func.Name, o.scalarArgs); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := o.collect(ctx, maxt); err != nil {
 			return nil, err
 		}
-		if len(vectors) == 0 {
-			break ACC
+		for j := range o.buffers {
+			o.buffers[j] = dropBefore(o.buffers[j], mint)
 		}
-		for _, vector := range vectors {
+
+		sv := o.pool.GetStepVector(o.currentStep)
+		for sampleId, rangeSamples := range o.buffers {
+			f, h, ok := o.call(FunctionArgs{
+				Samples:      rangeSamples,
+				StepTime:     o.currentStep,
+				SelectRange:  selectRange,
+				Offset:       offset,
+				ScalarPoints: o.scalarArgs,
+			})
+			if ok {
+				if h != nil {
+					sv.AppendHistogram(o.pool, uint64(sampleId), h)
+				} else {
+					sv.AppendSample(o.pool, uint64(sampleId), f)
+				}
+			}
+		}
+		res = append(res, sv)
+
+		o.currentStep += o.step
+	}
+	return res, nil
+}
+
+// collect appends samples from the inner operator to the buffers until
+// it reaches a step after maxt or the inner operator is exhausted.
+func (o *subqueryOperator) collect(ctx context.Context, maxt int64) error {
+	for {
+		for ; o.lastCollected < len(o.lastVectors); o.lastCollected++ {
+			vector := o.lastVectors[o.lastCollected]
+			if vector.T > maxt {
+				return nil
+			}
 			for j, s := range vector.Samples {
-				o.acc[vector.SampleIDs[j]] = append(o.acc[vector.SampleIDs[j]], Sample{T: vector.T, F: s})
+				o.buffers[vector.SampleIDs[j]] = append(o.buffers[vector.SampleIDs[j]], Sample{T: vector.T, F: s})
 			}
 			for j, s := range vector.Histograms {
-				o.acc[vector.HistogramIDs[j]] = append(o.acc[vector.HistogramIDs[j]], Sample{T: vector.T, H: s})
+				o.buffers[vector.HistogramIDs[j]] = append(o.buffers[vector.HistogramIDs[j]], Sample{T: vector.T, H: s})
 			}
 			o.next.GetPool().PutStepVector(vector)
 		}
-		o.next.GetPool().PutVectors(vectors)
-	}
+		if o.lastVectors != nil {
+			o.next.GetPool().PutVectors(o.lastVectors)
+			o.lastVectors = nil
+		}
 
-	res := o.pool.GetVectorBatch()
-	sv := o.pool.GetStepVector(o.currentStep)
-	for sampleId, rangeSamples := range o.acc {
-		f, h, ok := o.call(FunctionArgs{
-			Samples:     rangeSamples,
-			StepTime:    o.currentStep,
-			SelectRange: o.subQuery.Range.Milliseconds(),
-			Offset:      o.subQuery.Offset.Milliseconds(),
-		})
-		if ok {
-			if h != nil {
-				sv.AppendHistogram(o.pool, uint64(sampleId), h)
-			} else {
-				sv.AppendSample(o.pool, uint64(sampleId), f)
-			}
+		vectors, err := o.next.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if len(vectors) == 0 {
+			return nil
 		}
+		o.lastVectors, o.lastCollected = vectors, 0
 	}
-	res = append(res, sv)
+}
 
-	o.currentStep++
-	return res, nil
+// dropBefore removes samples older than mint while reusing the underlying array.
+func dropBefore(samples []Sample, mint int64) []Sample {
+	drop := 0
+	for drop < len(samples) && samples[drop].T < mint {
+		drop++
+	}
+	if drop == 0 {
+		return samples
+	}
+	return samples[:copy(samples, samples[drop:])]
 }
 
 func (o *subqueryOperator) Series(ctx context.Context) ([]labels.Labels, error) {
@@ -130,7 +224,7 @@ func (o *subqueryOperator) initSeries(ctx context.Context) error {
 		}
 
 		o.series = make([]labels.Labels, len(series))
-		o.acc = make([][]Sample, len(series))
+		o.buffers = make([][]Sample, len(series))
 		var b labels.ScratchBuilder
 		for i, s := range series {
 			lbls := s
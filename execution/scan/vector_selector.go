@@ -30,7 +30,7 @@ type vectorScanner struct {
 }
 
 type vectorSelector struct {
-	model.OperatorTelemetry
+	model.StatsTelemetry
 
 	storage  engstore.SeriesSelector
 	scanners []vectorScanner
@@ -52,6 +52,11 @@ type vectorSelector struct {
 
 	shard     int
 	numShards int
+
+	// selectTimestamp makes the operator return the timestamps of samples in seconds instead of their values.
+	selectTimestamp bool
+
+	sampleTracker *query.SampleTracker
 }
 
 // NewVectorSelector creates operator which selects vector of series.
@@ -61,12 +66,13 @@ func NewVectorSelector(
 	queryOpts *query.Options,
 	offset time.Duration,
 	batchSize int64,
+	selectTimestamp bool,
 	shard, numShards int,
 ) model.VectorOperator {
 	o := &vectorSelector{
-		OperatorTelemetry: &model.NoopTelemetry{},
-		storage:           selector,
-		vectorPool:        pool,
+		StatsTelemetry: &model.NoopTelemetry{},
+		storage:        selector,
+		vectorPool:     pool,
 
 		mint:            queryOpts.Start.UnixMilli(),
 		maxt:            queryOpts.End.UnixMilli(),
@@ -79,9 +85,13 @@ func NewVectorSelector(
 
 		shard:     shard,
 		numShards: numShards,
+
+		selectTimestamp: selectTimestamp,
+
+		sampleTracker: queryOpts.SampleTracker,
 	}
 	if queryOpts.EnableAnalysis {
-		o.OperatorTelemetry = &model.TrackedTelemetry{}
+		o.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 	// For instant queries, set the step to a positive value
 	// so that the operator can terminate.
@@ -98,6 +108,9 @@ func (o *vectorSelector) Analyze() (model.OperatorTelemetry, []model.ObservableV
 }
 
 func (o *vectorSelector) Explain() (me string, next []model.VectorOperator) {
+	if o.selectTimestamp {
+		return fmt.Sprintf("[*vectorSelector] timestamp({%v}) %v mod %v", o.storage.Matchers(), o.shard, o.numShards), nil
+	}
 	return fmt.Sprintf("[*vectorSelector] {%v} %v mod %v", o.storage.Matchers(), o.shard, o.numShards), nil
 }
 
@@ -144,12 +157,14 @@ func (o *vectorSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 			seriesTs = ts
 		)
 		for currStep := 0; currStep < o.numSteps && seriesTs <= o.maxt; currStep++ {
-			_, v, h, ok, err := selectPoint(series.samples, seriesTs, o.lookbackDelta, o.offset)
+			t, v, h, ok, err := selectPoint(series.samples, seriesTs, o.lookbackDelta, o.offset)
 			if err != nil {
 				return nil, err
 			}
 			if ok {
-				if h != nil {
+				if o.selectTimestamp {
+					vectors[currStep].AppendSample(o.vectorPool, series.signature, float64(t)/1000)
+				} else if h != nil {
 					vectors[currStep].AppendHistogram(o.vectorPool, series.signature, h)
 				} else {
 					vectors[currStep].AppendSample(o.vectorPool, series.signature, v)
@@ -162,6 +177,12 @@ func (o *vectorSelector) Next(ctx context.Context) ([]model.StepVector, error) {
 		o.currentStep += o.step * int64(o.numSteps)
 		o.currentSeries = 0
 	}
+	for i := range vectors {
+		o.sampleTracker.AddSamplesAtTimestamp(vectors[i].T, int64(len(vectors[i].Samples)+len(vectors[i].Histograms)))
+	}
+	// Each returned sample is a single sample loaded from storage.
+	o.AddSamplesIn(model.CountSamples(vectors))
+	o.AddNextCall(vectors)
 
 	return vectors, nil
 }
@@ -191,6 +212,7 @@ func (o *vectorSelector) loadSeries(ctx context.Context) error {
 			o.seriesBatchSize = numSeries
 		}
 		o.vectorPool.SetStepSize(int(o.seriesBatchSize))
+		o.SetSeries(len(o.series))
 	})
 	return err
 }
@@ -32,7 +32,7 @@ type stepInvariantOperator struct {
 	step        int64
 	currentStep int64
 	stepsBatch  int
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func (u *stepInvariantOperator) Analyze() (model.OperatorTelemetry, []model.ObservableVectorOperator) {
@@ -75,9 +75,9 @@ func NewStepInvariantOperator(
 	case *parser.MatrixSelector, *parser.SubqueryExpr:
 		u.cacheResult = false
 	}
-	u.OperatorTelemetry = &model.NoopTelemetry{}
+	u.StatsTelemetry = &model.NoopTelemetry{}
 	if opts.EnableAnalysis {
-		u.OperatorTelemetry = &model.TrackedTelemetry{}
+		u.StatsTelemetry = &model.TrackedTelemetry{}
 	}
 
 	return u, nil
@@ -88,6 +88,7 @@ func (u *stepInvariantOperator) Series(ctx context.Context) ([]labels.Labels, er
 	u.seriesOnce.Do(func() {
 		u.series, err = u.next.Series(ctx)
 		u.vectorPool.SetStepSize(len(u.series))
+		u.SetSeries(len(u.series))
 	})
 	if err != nil {
 		return nil, err
@@ -112,7 +113,13 @@ func (u *stepInvariantOperator) Next(ctx context.Context) ([]model.StepVector, e
 	}
 
 	if !u.cacheResult {
-		return u.next.Next(ctx)
+		out, err := u.next.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		u.AddSamplesIn(model.CountSamples(out))
+		u.AddNextCall(out)
+		return out, nil
 	}
 
 	if err := u.cacheInputVector(ctx); err != nil {
@@ -128,6 +135,7 @@ func (u *stepInvariantOperator) Next(ctx context.Context) ([]model.StepVector, e
 		u.currentStep += u.step
 	}
 	u.AddExecutionTimeTaken(time.Since(start))
+	u.AddNextCall(result)
 
 	return result, nil
 }
@@ -141,6 +149,7 @@ func (u *stepInvariantOperator) cacheInputVector(ctx context.Context) error {
 			return
 		}
 		defer u.next.GetPool().PutVectors(in)
+		u.AddSamplesIn(model.CountSamples(in))
 
 		if len(in) == 0 || (len(in[0].Samples) == 0 && len(in[0].Histograms) == 0) {
 			return
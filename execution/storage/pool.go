@@ -10,6 +10,8 @@ import (
 	"github.com/cespare/xxhash/v2"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
+
+	"github.com/thanos-io/promql-engine/execution/limits"
 )
 
 var sep = []byte{'\xff'}
@@ -17,20 +19,22 @@ var sep = []byte{'\xff'}
 type SelectorPool struct {
 	selectors map[uint64]*seriesSelector
 
-	queryable storage.Queryable
+	queryable     storage.Queryable
+	memoryTracker *limits.MemoryTracker
 }
 
-func NewSelectorPool(queryable storage.Queryable) *SelectorPool {
+func NewSelectorPool(queryable storage.Queryable, memoryTracker *limits.MemoryTracker) *SelectorPool {
 	return &SelectorPool{
-		selectors: make(map[uint64]*seriesSelector),
-		queryable: queryable,
+		selectors:     make(map[uint64]*seriesSelector),
+		queryable:     queryable,
+		memoryTracker: memoryTracker,
 	}
 }
 
 func (p *SelectorPool) GetSelector(mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
 	key := hashMatchers(matchers, mint, maxt, hints)
 	if _, ok := p.selectors[key]; !ok {
-		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
+		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints, p.memoryTracker)
 	}
 	return p.selectors[key]
 }
@@ -38,7 +42,7 @@ func (p *SelectorPool) GetSelector(mint, maxt, step int64, matchers []*labels.Ma
 func (p *SelectorPool) GetFilteredSelector(mint, maxt, step int64, matchers, filters []*labels.Matcher, hints storage.SelectHints) SeriesSelector {
 	key := hashMatchers(matchers, mint, maxt, hints)
 	if _, ok := p.selectors[key]; !ok {
-		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints)
+		p.selectors[key] = newSeriesSelector(p.queryable, mint, maxt, step, matchers, hints, p.memoryTracker)
 	}
 
 	return NewFilteredSelector(p.selectors[key], NewFilter(filters))
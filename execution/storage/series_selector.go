@@ -6,13 +6,17 @@ package storage
 import (
 	"context"
 	"sync"
+	"unsafe"
 
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
 
+	"github.com/thanos-io/promql-engine/execution/limits"
 	"github.com/thanos-io/promql-engine/execution/warnings"
 )
 
+const signedSeriesSize = int64(unsafe.Sizeof(SignedSeries{}))
+
 type SeriesSelector interface {
 	GetSeries(ctx context.Context, shard, numShards int) ([]SignedSeries, error)
 	Matchers() []*labels.Matcher
@@ -31,18 +35,22 @@ type seriesSelector struct {
 	matchers []*labels.Matcher
 	hints    storage.SelectHints
 
+	memoryTracker *limits.MemoryTracker
+
 	once   sync.Once
+	err    error
 	series []SignedSeries
 }
 
-func newSeriesSelector(storage storage.Queryable, mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints) *seriesSelector {
+func newSeriesSelector(storage storage.Queryable, mint, maxt, step int64, matchers []*labels.Matcher, hints storage.SelectHints, memoryTracker *limits.MemoryTracker) *seriesSelector {
 	return &seriesSelector{
-		storage:  storage,
-		maxt:     maxt,
-		mint:     mint,
-		step:     step,
-		matchers: matchers,
-		hints:    hints,
+		storage:       storage,
+		maxt:          maxt,
+		mint:          mint,
+		step:          step,
+		matchers:      matchers,
+		hints:         hints,
+		memoryTracker: memoryTracker,
 	}
 }
 
@@ -51,10 +59,9 @@ func (o *seriesSelector) Matchers() []*labels.Matcher {
 }
 
 func (o *seriesSelector) GetSeries(ctx context.Context, shard int, numShards int) ([]SignedSeries, error) {
-	var err error
-	o.once.Do(func() { err = o.loadSeries(ctx) })
-	if err != nil {
-		return nil, err
+	o.once.Do(func() { o.err = o.loadSeries(ctx) })
+	if o.err != nil {
+		return nil, o.err
 	}
 
 	return seriesShard(o.series, shard, numShards), nil
@@ -71,6 +78,9 @@ func (o *seriesSelector) loadSeries(ctx context.Context) error {
 	i := 0
 	for seriesSet.Next() {
 		s := seriesSet.At()
+		if err := o.memoryTracker.Reserve(signedSeriesSize + limits.LabelsSize(s.Labels())); err != nil {
+			return err
+		}
 		o.series = append(o.series, SignedSeries{
 			Series:    s,
 			Signature: uint64(i),
@@ -0,0 +1,81 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package execution
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/thanos-io/promql-engine/execution/model"
+	"github.com/thanos-io/promql-engine/query"
+	"github.com/thanos-io/promql-engine/tracing"
+)
+
+// traced wraps the operator so that its Series and Next calls are recorded as spans
+// when a tracer is configured in the options. Otherwise the operator is returned as is.
+func traced(op model.VectorOperator, opts *query.Options) model.VectorOperator {
+	if opts.Tracer == nil {
+		return op
+	}
+	name, _ := op.Explain()
+	t := tracedOperator{VectorOperator: op, tracer: opts.Tracer, name: name}
+	if obs, ok := op.(model.ObservableVectorOperator); ok {
+		return &tracedObservableOperator{ObservableVectorOperator: obs, tracedOperator: t}
+	}
+	return &t
+}
+
+type tracedOperator struct {
+	model.VectorOperator
+	tracer tracing.Tracer
+	name   string
+}
+
+// Unwrap returns the traced operator.
+func (o *tracedOperator) Unwrap() model.VectorOperator {
+	return o.VectorOperator
+}
+
+func (o *tracedOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	ctx, span := o.tracer.Start(ctx, o.name+" Series")
+	defer span.End()
+
+	series, err := o.VectorOperator.Series(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("series", len(series))
+	return series, nil
+}
+
+func (o *tracedOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	ctx, span := o.tracer.Start(ctx, o.name+" Next")
+	defer span.End()
+
+	vectors, err := o.VectorOperator.Next(ctx)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttribute("steps", len(vectors))
+	span.SetAttribute("samples", model.CountSamples(vectors))
+	return vectors, nil
+}
+
+// tracedObservableOperator traces an operator which collects telemetry,
+// so that the operator can still be analyzed through the wrapper.
+type tracedObservableOperator struct {
+	model.ObservableVectorOperator
+	tracedOperator
+}
+
+func (o *tracedObservableOperator) Series(ctx context.Context) ([]labels.Labels, error) {
+	return o.tracedOperator.Series(ctx)
+}
+
+func (o *tracedObservableOperator) Next(ctx context.Context) ([]model.StepVector, error) {
+	return o.tracedOperator.Next(ctx)
+}
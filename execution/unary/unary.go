@@ -19,7 +19,7 @@ type unaryNegation struct {
 	once sync.Once
 
 	series []labels.Labels
-	model.OperatorTelemetry
+	model.StatsTelemetry
 }
 
 func (u *unaryNegation) Explain() (me string, next []model.VectorOperator) {
@@ -31,8 +31,8 @@ func NewUnaryNegation(
 	stepsBatch int,
 ) (model.VectorOperator, error) {
 	u := &unaryNegation{
-		next:              next,
-		OperatorTelemetry: &model.TrackedTelemetry{},
+		next:           next,
+		StatsTelemetry: &model.TrackedTelemetry{},
 	}
 
 	return u, nil
@@ -66,6 +66,7 @@ func (u *unaryNegation) loadSeries(ctx context.Context) error {
 			lbls := labels.NewBuilder(series[i]).Del(labels.MetricName).Labels()
 			u.series[i] = lbls
 		}
+		u.SetSeries(len(u.series))
 	})
 	return err
 }
@@ -88,9 +89,11 @@ func (u *unaryNegation) Next(ctx context.Context) ([]model.StepVector, error) {
 	if in == nil {
 		return nil, nil
 	}
+	u.AddSamplesIn(model.CountSamples(in))
 	for i := range in {
 		floats.Scale(-1, in[i].Samples)
 	}
 	u.AddExecutionTimeTaken(time.Since(start))
+	u.AddNextCall(in)
 	return in, nil
 }
@@ -0,0 +1,647 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/execution/function"
+)
+
+// PlanVersion is the version of the format logical plans are serialised in.
+// It is increased whenever a change to the format is not backwards compatible.
+const PlanVersion = 1
+
+// Types of the serialised plan nodes.
+const (
+	numberLiteralNode  = "numberLiteral"
+	stringLiteralNode  = "stringLiteral"
+	vectorSelectorNode = "vectorSelector"
+	matrixSelectorNode = "matrixSelector"
+	aggregationNode    = "aggregation"
+	binaryNode         = "binary"
+	callNode           = "call"
+	parenNode          = "paren"
+	unaryNode          = "unary"
+	subqueryNode       = "subquery"
+	planSelectorNode   = "planVectorSelector"
+	remoteNode         = "remoteExecution"
+	deduplicateNode    = "deduplicate"
+	noopNode           = "noop"
+)
+
+var builtinNodes = map[string]struct{}{
+	numberLiteralNode:  {},
+	stringLiteralNode:  {},
+	vectorSelectorNode: {},
+	matrixSelectorNode: {},
+	aggregationNode:    {},
+	binaryNode:         {},
+	callNode:           {},
+	parenNode:          {},
+	unaryNode:          {},
+	subqueryNode:       {},
+	planSelectorNode:   {},
+	remoteNode:         {},
+	deduplicateNode:    {},
+	noopNode:           {},
+}
+
+var (
+	customNodesMtx  sync.RWMutex
+	customNodes     = map[string]func() parser.Expr{}
+	customNodeTypes = map[reflect.Type]string{}
+)
+
+// RegisterNodeType registers a custom plan node, such as a UserDefinedExpr, so that plans
+// containing it can be serialised. Custom nodes are serialised as a whole with encoding/json
+// and decoded into the node returned by newNode, which therefore has to be a pointer.
+// It panics if a node type with the same name is already registered.
+func RegisterNodeType(name string, newNode func() parser.Expr) {
+	customNodesMtx.Lock()
+	defer customNodesMtx.Unlock()
+
+	if _, ok := builtinNodes[name]; ok {
+		panic(fmt.Sprintf("logicalplan: node type %q is reserved", name))
+	}
+	if _, ok := customNodes[name]; ok {
+		panic(fmt.Sprintf("logicalplan: node type %q is already registered", name))
+	}
+	customNodes[name] = newNode
+	customNodeTypes[reflect.TypeOf(newNode())] = name
+}
+
+type encodedPlan struct {
+	Version int          `json:"version"`
+	Root    *encodedNode `json:"root"`
+}
+
+type encodedNode struct {
+	Type     string          `json:"type"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Children []*encodedNode  `json:"children,omitempty"`
+}
+
+type matcherData struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type literalData struct {
+	Value string `json:"value"`
+}
+
+type vectorSelectorData struct {
+	Name           string        `json:"name,omitempty"`
+	LabelMatchers  []matcherData `json:"labelMatchers"`
+	OriginalOffset time.Duration `json:"originalOffset,omitempty"`
+	Offset         time.Duration `json:"offset,omitempty"`
+	Timestamp      *int64        `json:"timestamp,omitempty"`
+	StartOrEnd     string        `json:"startOrEnd,omitempty"`
+}
+
+type matrixSelectorData struct {
+	Range time.Duration `json:"range"`
+}
+
+type aggregationData struct {
+	Op       string   `json:"op"`
+	Grouping []string `json:"grouping,omitempty"`
+	Without  bool     `json:"without,omitempty"`
+	HasParam bool     `json:"hasParam,omitempty"`
+}
+
+type vectorMatchingData struct {
+	Card           string   `json:"card"`
+	MatchingLabels []string `json:"matchingLabels,omitempty"`
+	On             bool     `json:"on,omitempty"`
+	Include        []string `json:"include,omitempty"`
+}
+
+type binaryData struct {
+	Op             string              `json:"op"`
+	ReturnBool     bool                `json:"returnBool,omitempty"`
+	VectorMatching *vectorMatchingData `json:"vectorMatching,omitempty"`
+}
+
+type callData struct {
+	Func string `json:"func"`
+}
+
+type unaryData struct {
+	Op string `json:"op"`
+}
+
+type subqueryData struct {
+	Range          time.Duration `json:"range"`
+	Step           time.Duration `json:"step,omitempty"`
+	OriginalOffset time.Duration `json:"originalOffset,omitempty"`
+	Offset         time.Duration `json:"offset,omitempty"`
+	Timestamp      *int64        `json:"timestamp,omitempty"`
+	StartOrEnd     string        `json:"startOrEnd,omitempty"`
+}
+
+type planSelectorData struct {
+	Filters   []matcherData `json:"filters,omitempty"`
+	BatchSize int64         `json:"batchSize,omitempty"`
+}
+
+type remoteData struct {
+	Query           string    `json:"query"`
+	QueryRangeStart time.Time `json:"queryRangeStart"`
+	ValueType       string    `json:"valueType"`
+}
+
+// Marshal serialises a logical plan into a versioned JSON document which can be decoded with Unmarshal.
+// Step invariant nodes are not serialised since they depend on the evaluation time of the plan, and are
+// added again when a plan is created from the decoded expression. The engines of remote executions
+// are not serialised either.
+func Marshal(expr parser.Expr) ([]byte, error) {
+	root, err := encodeNode(expr)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(encodedPlan{Version: PlanVersion, Root: root})
+}
+
+// Unmarshal decodes a logical plan serialised with Marshal.
+func Unmarshal(data []byte) (parser.Expr, error) {
+	var plan encodedPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, errors.Wrap(err, "decoding plan")
+	}
+	if plan.Version != PlanVersion {
+		return nil, errors.Newf("unsupported plan version %d, expected %d", plan.Version, PlanVersion)
+	}
+	if plan.Root == nil {
+		return nil, errors.New("plan has no root node")
+	}
+	return decodeNode(plan.Root)
+}
+
+func encodeNode(expr parser.Expr) (*encodedNode, error) {
+	switch e := expr.(type) {
+	case *parser.StepInvariantExpr:
+		return encodeNode(e.Expr)
+	case *parser.NumberLiteral:
+		return newEncodedNode(numberLiteralNode, literalData{Value: strconv.FormatFloat(e.Val, 'g', -1, 64)})
+	case *parser.StringLiteral:
+		return newEncodedNode(stringLiteralNode, literalData{Value: e.Val})
+	case *parser.VectorSelector:
+		return newEncodedNode(vectorSelectorNode, vectorSelectorData{
+			Name:           e.Name,
+			LabelMatchers:  encodeMatchers(e.LabelMatchers),
+			OriginalOffset: e.OriginalOffset,
+			Offset:         e.Offset,
+			Timestamp:      e.Timestamp,
+			StartOrEnd:     encodeStartOrEnd(e.StartOrEnd, e.Timestamp),
+		})
+	case *parser.MatrixSelector:
+		return newEncodedNode(matrixSelectorNode, matrixSelectorData{Range: e.Range}, e.VectorSelector)
+	case *parser.AggregateExpr:
+		children := []parser.Expr{e.Expr}
+		if e.Param != nil {
+			children = append(children, e.Param)
+		}
+		return newEncodedNode(aggregationNode, aggregationData{
+			Op:       e.Op.String(),
+			Grouping: e.Grouping,
+			Without:  e.Without,
+			HasParam: e.Param != nil,
+		}, children...)
+	case *parser.BinaryExpr:
+		data := binaryData{Op: e.Op.String(), ReturnBool: e.ReturnBool}
+		if m := e.VectorMatching; m != nil {
+			data.VectorMatching = &vectorMatchingData{
+				Card:           m.Card.String(),
+				MatchingLabels: m.MatchingLabels,
+				On:             m.On,
+				Include:        m.Include,
+			}
+		}
+		return newEncodedNode(binaryNode, data, e.LHS, e.RHS)
+	case *parser.Call:
+		return newEncodedNode(callNode, callData{Func: e.Func.Name}, e.Args...)
+	case *parser.ParenExpr:
+		return newEncodedNode(parenNode, nil, e.Expr)
+	case *parser.UnaryExpr:
+		return newEncodedNode(unaryNode, unaryData{Op: e.Op.String()}, e.Expr)
+	case *parser.SubqueryExpr:
+		return newEncodedNode(subqueryNode, subqueryData{
+			Range:          e.Range,
+			Step:           e.Step,
+			OriginalOffset: e.OriginalOffset,
+			Offset:         e.Offset,
+			Timestamp:      e.Timestamp,
+			StartOrEnd:     encodeStartOrEnd(e.StartOrEnd, e.Timestamp),
+		}, e.Expr)
+	case *VectorSelector:
+		return newEncodedNode(planSelectorNode, planSelectorData{
+			Filters:   encodeMatchers(e.Filters),
+			BatchSize: e.BatchSize,
+		}, e.VectorSelector)
+	case RemoteExecution:
+		data := remoteData{Query: e.Query, QueryRangeStart: e.QueryRangeStart, ValueType: string(e.valueType)}
+		if e.Plan == nil {
+			return newEncodedNode(remoteNode, data)
+		}
+		return newEncodedNode(remoteNode, data, e.Plan)
+	case Deduplicate:
+		children := make([]parser.Expr, len(e.Expressions))
+		for i, r := range e.Expressions {
+			children[i] = r
+		}
+		return newEncodedNode(deduplicateNode, nil, children...)
+	case Noop:
+		return newEncodedNode(noopNode, nil)
+	}
+
+	customNodesMtx.RLock()
+	name, ok := customNodeTypes[reflect.TypeOf(expr)]
+	customNodesMtx.RUnlock()
+	if !ok {
+		return nil, errors.Newf("cannot serialise plan node of type %T", expr)
+	}
+	data, err := json.Marshal(expr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "encoding %s node", name)
+	}
+	return &encodedNode{Type: name, Data: data}, nil
+}
+
+func newEncodedNode(typ string, data any, children ...parser.Expr) (*encodedNode, error) {
+	node := &encodedNode{Type: typ}
+	if data != nil {
+		var err error
+		if node.Data, err = json.Marshal(data); err != nil {
+			return nil, errors.Wrapf(err, "encoding %s node", typ)
+		}
+	}
+	for _, c := range children {
+		child, err := encodeNode(c)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, child)
+	}
+	return node, nil
+}
+
+func decodeNode(node *encodedNode) (parser.Expr, error) {
+	children := make([]parser.Expr, len(node.Children))
+	for i, c := range node.Children {
+		child, err := decodeNode(c)
+		if err != nil {
+			return nil, err
+		}
+		children[i] = child
+	}
+	childCount := func(n int) error {
+		if len(children) != n {
+			return errors.Newf("%s node has %d children, expected %d", node.Type, len(children), n)
+		}
+		return nil
+	}
+
+	switch node.Type {
+	case numberLiteralNode:
+		var data literalData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		val, err := strconv.ParseFloat(data.Value, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding %s node", node.Type)
+		}
+		return &parser.NumberLiteral{Val: val}, nil
+	case stringLiteralNode:
+		var data literalData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		return &parser.StringLiteral{Val: data.Value}, nil
+	case vectorSelectorNode:
+		var data vectorSelectorData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		matchers, err := decodeMatchers(data.LabelMatchers)
+		if err != nil {
+			return nil, err
+		}
+		startOrEnd, err := decodeItemType(data.StartOrEnd)
+		if err != nil {
+			return nil, err
+		}
+		return &parser.VectorSelector{
+			Name:           data.Name,
+			LabelMatchers:  matchers,
+			OriginalOffset: data.OriginalOffset,
+			Offset:         data.Offset,
+			Timestamp:      data.Timestamp,
+			StartOrEnd:     startOrEnd,
+		}, nil
+	case matrixSelectorNode:
+		var data matrixSelectorData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		if err := childCount(1); err != nil {
+			return nil, err
+		}
+		return &parser.MatrixSelector{VectorSelector: children[0], Range: data.Range}, nil
+	case aggregationNode:
+		var data aggregationData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		op, err := decodeItemType(data.Op)
+		if err != nil {
+			return nil, err
+		}
+		expected := 1
+		if data.HasParam {
+			expected = 2
+		}
+		if err := childCount(expected); err != nil {
+			return nil, err
+		}
+		aggr := &parser.AggregateExpr{Op: op, Expr: children[0], Grouping: data.Grouping, Without: data.Without}
+		if data.HasParam {
+			aggr.Param = children[1]
+		}
+		return aggr, nil
+	case binaryNode:
+		var data binaryData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		op, err := decodeItemType(data.Op)
+		if err != nil {
+			return nil, err
+		}
+		if err := childCount(2); err != nil {
+			return nil, err
+		}
+		binary := &parser.BinaryExpr{Op: op, LHS: children[0], RHS: children[1], ReturnBool: data.ReturnBool}
+		if m := data.VectorMatching; m != nil {
+			card, err := decodeCardinality(m.Card)
+			if err != nil {
+				return nil, err
+			}
+			binary.VectorMatching = &parser.VectorMatching{
+				Card:           card,
+				MatchingLabels: m.MatchingLabels,
+				On:             m.On,
+				Include:        m.Include,
+			}
+		}
+		return binary, nil
+	case callNode:
+		var data callData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		f, ok := parser.Functions[data.Func]
+		if !ok {
+			f, ok = function.XFunctions[data.Func]
+		}
+		if !ok {
+			return nil, errors.Newf("unknown function %q", data.Func)
+		}
+		return &parser.Call{Func: f, Args: children}, nil
+	case parenNode:
+		if err := childCount(1); err != nil {
+			return nil, err
+		}
+		return &parser.ParenExpr{Expr: children[0]}, nil
+	case unaryNode:
+		var data unaryData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		op, err := decodeItemType(data.Op)
+		if err != nil {
+			return nil, err
+		}
+		if err := childCount(1); err != nil {
+			return nil, err
+		}
+		return &parser.UnaryExpr{Op: op, Expr: children[0]}, nil
+	case subqueryNode:
+		var data subqueryData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		startOrEnd, err := decodeItemType(data.StartOrEnd)
+		if err != nil {
+			return nil, err
+		}
+		if err := childCount(1); err != nil {
+			return nil, err
+		}
+		return &parser.SubqueryExpr{
+			Expr:           children[0],
+			Range:          data.Range,
+			Step:           data.Step,
+			OriginalOffset: data.OriginalOffset,
+			Offset:         data.Offset,
+			Timestamp:      data.Timestamp,
+			StartOrEnd:     startOrEnd,
+		}, nil
+	case planSelectorNode:
+		var data planSelectorData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		filters, err := decodeMatchers(data.Filters)
+		if err != nil {
+			return nil, err
+		}
+		if err := childCount(1); err != nil {
+			return nil, err
+		}
+		selector, ok := children[0].(*parser.VectorSelector)
+		if !ok {
+			return nil, errors.Newf("%s node has a child of type %T, expected a vector selector", node.Type, children[0])
+		}
+		return &VectorSelector{VectorSelector: selector, Filters: filters, BatchSize: data.BatchSize}, nil
+	case remoteNode:
+		var data remoteData
+		if err := decodeData(node, &data); err != nil {
+			return nil, err
+		}
+		remote := RemoteExecution{
+			Query:           data.Query,
+			QueryRangeStart: data.QueryRangeStart,
+			valueType:       parser.ValueType(data.ValueType),
+		}
+		switch len(children) {
+		case 0:
+		case 1:
+			remote.Plan = children[0]
+		default:
+			return nil, errors.Newf("%s node has %d children, expected at most 1", node.Type, len(children))
+		}
+		return remote, nil
+	case deduplicateNode:
+		if len(children) == 0 {
+			return nil, errors.Newf("%s node has no children", node.Type)
+		}
+		remotes := make(RemoteExecutions, len(children))
+		for i, c := range children {
+			remote, ok := c.(RemoteExecution)
+			if !ok {
+				return nil, errors.Newf("%s node has a child of type %T, expected a remote execution", node.Type, c)
+			}
+			remotes[i] = remote
+		}
+		return Deduplicate{Expressions: remotes}, nil
+	case noopNode:
+		return Noop{}, nil
+	}
+
+	customNodesMtx.RLock()
+	newNode, ok := customNodes[node.Type]
+	customNodesMtx.RUnlock()
+	if !ok {
+		return nil, errors.Newf("unknown plan node type %q", node.Type)
+	}
+	expr := newNode()
+	if err := decodeData(node, expr); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func decodeData(node *encodedNode, v any) error {
+	if len(node.Data) == 0 {
+		return errors.Newf("%s node has no data", node.Type)
+	}
+	if err := json.Unmarshal(node.Data, v); err != nil {
+		return errors.Wrapf(err, "decoding %s node", node.Type)
+	}
+	return nil
+}
+
+func encodeMatchers(matchers []*labels.Matcher) []matcherData {
+	if matchers == nil {
+		return nil
+	}
+	result := make([]matcherData, len(matchers))
+	for i, m := range matchers {
+		result[i] = matcherData{Type: m.Type.String(), Name: m.Name, Value: m.Value}
+	}
+	return result
+}
+
+func decodeMatchers(matchers []matcherData) ([]*labels.Matcher, error) {
+	if matchers == nil {
+		return nil, nil
+	}
+	result := make([]*labels.Matcher, len(matchers))
+	for i, m := range matchers {
+		var t labels.MatchType
+		switch m.Type {
+		case labels.MatchEqual.String():
+			t = labels.MatchEqual
+		case labels.MatchNotEqual.String():
+			t = labels.MatchNotEqual
+		case labels.MatchRegexp.String():
+			t = labels.MatchRegexp
+		case labels.MatchNotRegexp.String():
+			t = labels.MatchNotRegexp
+		default:
+			return nil, errors.Newf("unknown matcher type %q", m.Type)
+		}
+		matcher, err := labels.NewMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding matcher for label %s", m.Name)
+		}
+		result[i] = matcher
+	}
+	return result, nil
+}
+
+// itemTypes maps the representations of operators, aggregations and preprocessors to their item types.
+var itemTypes = func() map[string]parser.ItemType {
+	result := map[string]parser.ItemType{
+		parser.ItemType(parser.START).String(): parser.START,
+		parser.ItemType(parser.END).String():   parser.END,
+	}
+	for t, s := range parser.ItemTypeStr {
+		if t.IsOperator() || t.IsAggregator() {
+			result[s] = t
+		}
+	}
+	return result
+}()
+
+// encodeStartOrEnd encodes the start() or end() @ modifier only if it was not resolved yet.
+// Resolved modifiers are sent as timestamps, since the plan can be executed in a query
+// with a different range. For example step invariant expressions are evaluated at the
+// start of the query.
+func encodeStartOrEnd(t parser.ItemType, ts *int64) string {
+	if ts != nil {
+		return ""
+	}
+	return encodeItemType(t)
+}
+
+func encodeItemType(t parser.ItemType) string {
+	if t == 0 {
+		return ""
+	}
+	return t.String()
+}
+
+func decodeItemType(s string) (parser.ItemType, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, ok := itemTypes[s]
+	if !ok {
+		return 0, errors.Newf("unknown operator %q", s)
+	}
+	return t, nil
+}
+
+func decodeCardinality(s string) (parser.VectorMatchCardinality, error) {
+	for _, c := range []parser.VectorMatchCardinality{parser.CardOneToOne, parser.CardManyToOne, parser.CardOneToMany, parser.CardManyToMany} {
+		if c.String() == s {
+			return c, nil
+		}
+	}
+	return 0, errors.Newf("unknown vector matching cardinality %q", s)
+}
+
+// remotePlan is the logical plan of a remote execution which is sent to engines that can execute plans.
+type remotePlan struct {
+	expr parser.Expr
+}
+
+func (p remotePlan) String() string { return p.expr.String() }
+
+func (p remotePlan) MarshalJSON() ([]byte, error) { return Marshal(p.expr) }
+
+// RemotePlan returns the logical plan executed by the remote engine, or nil if the
+// remote execution was created without one.
+func (r RemoteExecution) RemotePlan() api.RemotePlan {
+	if r.Plan == nil {
+		return nil
+	}
+	return remotePlan{expr: r.Plan}
+}
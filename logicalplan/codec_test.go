@@ -0,0 +1,243 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/promql/parser/posrange"
+
+	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/execution/model"
+	engstore "github.com/thanos-io/promql-engine/execution/storage"
+	"github.com/thanos-io/promql-engine/query"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	cases := []string{
+		`http_requests_total`,
+		`http_requests_total{pod=~"a.*", code!="500", job!~"b|c", region="east"}`,
+		`http_requests_total offset 5m`,
+		`http_requests_total @ 100 offset -5m`,
+		`http_requests_total @ start()`,
+		`rate(http_requests_total[5m] @ end())`,
+		`sum by (pod) (rate(http_requests_total[5m]))`,
+		`sum without (pod) (http_requests_total)`,
+		`topk(3, http_requests_total)`,
+		`quantile(0.9, http_requests_total)`,
+		`count_values("value", http_requests_total)`,
+		`max(metric_a) / max(metric_a{code="foo"})`,
+		`metric_a / on (pod) group_left (job) metric_b`,
+		`metric_a > bool ignoring (pod) metric_b`,
+		`metric_a and metric_b or metric_c unless metric_d`,
+		`-metric_a ^ 2`,
+		`(metric_a + 1) * 2`,
+		`max_over_time(rate(http_requests_total[5m])[30m:1m] offset 5m)`,
+		`sum_over_time(metric_a[1h:] @ 200)`,
+		`label_replace(metric_a, "dst", "$1", "src", "(.*)")`,
+		`histogram_quantile(0.5, sum by (le) (rate(http_requests_bucket[5m])))`,
+		`absent(nonexistent)`,
+		`time() - max by (foo) (bar)`,
+		`NaN`,
+		`-Inf + metric_a`,
+		`"string"`,
+	}
+	optimizers := append([]Optimizer{SelectorBatchSize{Size: 10}}, DefaultOptimizers...)
+	opts := &query.Options{
+		Start:                    time.Unix(0, 0),
+		End:                      time.Unix(3600, 0),
+		Step:                     time.Minute,
+		NoStepSubqueryIntervalFn: func(time.Duration) time.Duration { return time.Minute },
+	}
+	for _, tcase := range cases {
+		t.Run(tcase, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase)
+			testutil.Ok(t, err)
+			plan, _ := New(expr, opts).Optimize(optimizers)
+
+			data, err := Marshal(plan.Expr())
+			testutil.Ok(t, err)
+			decoded, err := Unmarshal(data)
+			testutil.Ok(t, err)
+			testutil.Equals(t, plan.Expr().String(), decoded.String())
+
+			// Encoding the decoded plan again has to produce the same document.
+			reencoded, err := Marshal(decoded)
+			testutil.Ok(t, err)
+			testutil.Equals(t, string(data), string(reencoded))
+
+			// Plans can be created from decoded expressions.
+			testutil.Equals(t, plan.Expr().String(), New(decoded, opts).Expr().String())
+		})
+	}
+}
+
+func TestMarshalResolvedAtModifiers(t *testing.T) {
+	opts := &query.Options{
+		Start:                    time.Unix(0, 0),
+		End:                      time.Unix(600, 0),
+		Step:                     30 * time.Second,
+		NoStepSubqueryIntervalFn: func(time.Duration) time.Duration { return time.Minute },
+	}
+	for _, tcase := range []struct {
+		expr     string
+		expected string
+	}{
+		{expr: `foo @ end()`, expected: `foo @ 600.000`},
+		{expr: `rate(foo[2m] @ start())`, expected: `rate(foo[2m] @ 0.000)`},
+		{expr: `max_over_time(foo[5m:1m] @ end())`, expected: `max_over_time(foo[5m:1m] @ 600.000)`},
+	} {
+		t.Run(tcase.expr, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+			data, err := Marshal(New(expr, opts).Expr())
+			testutil.Ok(t, err)
+			decoded, err := Unmarshal(data)
+			testutil.Ok(t, err)
+
+			// The modifiers were resolved against the range of the original query, so they must not
+			// be resolved again against the range of the query which executes the decoded plan.
+			instantOpts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0), NoStepSubqueryIntervalFn: opts.NoStepSubqueryIntervalFn}
+			testutil.Equals(t, tcase.expected, New(decoded, instantOpts).Expr().String())
+		})
+	}
+}
+
+func TestMarshalPreservesOptimizerState(t *testing.T) {
+	expr, err := parser.ParseExpr(`max(metric_a) / max(metric_a{code="foo"})`)
+	testutil.Ok(t, err)
+	optimizers := append([]Optimizer{SelectorBatchSize{Size: 10}}, DefaultOptimizers...)
+	plan, _ := New(expr, &query.Options{}).Optimize(optimizers)
+
+	data, err := Marshal(plan.Expr())
+	testutil.Ok(t, err)
+	decoded, err := Unmarshal(data)
+	testutil.Ok(t, err)
+
+	selector := decoded.(*parser.BinaryExpr).RHS.(*parser.AggregateExpr).Expr.(*VectorSelector)
+	testutil.Equals(t, int64(10), selector.BatchSize)
+	testutil.Equals(t, 1, len(selector.Filters))
+	testutil.Equals(t, `code="foo"`, selector.Filters[0].String())
+	testutil.Equals(t, `metric_a`, selector.VectorSelector.String())
+}
+
+func TestMarshalDistributedPlan(t *testing.T) {
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+	optimizers := []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+
+	expr, err := parser.ParseExpr(`sum by (pod) (rate(http_requests_total[5m]))`)
+	testutil.Ok(t, err)
+	opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(3600, 0), Step: time.Minute, LookbackDelta: 5 * time.Minute}
+	plan, _ := New(expr, opts).Optimize(optimizers)
+
+	data, err := Marshal(plan.Expr())
+	testutil.Ok(t, err)
+	decoded, err := Unmarshal(data)
+	testutil.Ok(t, err)
+	testutil.Equals(t, plan.Expr().String(), decoded.String())
+	testutil.Equals(t, plan.Expr().String(), New(decoded, opts).Expr().String())
+
+	dedup := decoded.(*parser.AggregateExpr).Expr.(Deduplicate)
+	testutil.Equals(t, 2, len(dedup.Expressions))
+	for _, remote := range dedup.Expressions {
+		// Engines are not serialised.
+		testutil.Equals(t, nil, remote.Engine)
+		testutil.Equals(t, parser.ValueTypeVector, remote.Type())
+		testutil.Equals(t, remote.Query, remote.Plan.String())
+
+		remotePlan, err := json.Marshal(remote.RemotePlan())
+		testutil.Ok(t, err)
+		remoteExpr, err := Unmarshal(remotePlan)
+		testutil.Ok(t, err)
+		testutil.Equals(t, `sum by (pod, region) (rate(http_requests_total[5m]))`, remoteExpr.String())
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{
+			name: "unsupported version",
+			data: `{"version":2,"root":{"type":"noop"}}`,
+			err:  "unsupported plan version 2, expected 1",
+		},
+		{
+			name: "missing root",
+			data: `{"version":1}`,
+			err:  "plan has no root node",
+		},
+		{
+			name: "unknown node",
+			data: `{"version":1,"root":{"type":"unknown"}}`,
+			err:  `unknown plan node type "unknown"`,
+		},
+		{
+			name: "unknown function",
+			data: `{"version":1,"root":{"type":"call","data":{"func":"unknown"}}}`,
+			err:  `unknown function "unknown"`,
+		},
+		{
+			name: "missing children",
+			data: `{"version":1,"root":{"type":"paren"}}`,
+			err:  "paren node has 0 children, expected 1",
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			_, err := Unmarshal([]byte(tcase.data))
+			testutil.NotOk(t, err)
+			testutil.Equals(t, tcase.err, err.Error())
+		})
+	}
+}
+
+func TestMarshalCustomNode(t *testing.T) {
+	expr := &parser.BinaryExpr{
+		Op:             parser.ADD,
+		LHS:            &parser.VectorSelector{Name: "metric_a", LabelMatchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, "metric_a")}},
+		RHS:            &customNode{Value: 42},
+		VectorMatching: &parser.VectorMatching{Card: parser.CardOneToOne},
+	}
+	_, err := Marshal(expr)
+	testutil.NotOk(t, err)
+
+	RegisterNodeType("customNode", func() parser.Expr { return &customNode{} })
+	data, err := Marshal(expr)
+	testutil.Ok(t, err)
+	decoded, err := Unmarshal(data)
+	testutil.Ok(t, err)
+	testutil.Equals(t, &customNode{Value: 42}, decoded.(*parser.BinaryExpr).RHS)
+}
+
+type customNode struct {
+	Value int `json:"value"`
+}
+
+func (c *customNode) String() string { return "custom" }
+
+func (c *customNode) Pretty(level int) string { return c.String() }
+
+func (c *customNode) PositionRange() posrange.PositionRange { return posrange.PositionRange{} }
+
+func (c *customNode) Type() parser.ValueType { return parser.ValueTypeVector }
+
+func (c *customNode) PromQLExpr() {}
+
+func (c *customNode) MakeExecutionOperator(*model.VectorPool, *engstore.SelectorPool, *query.Options, storage.SelectHints) (model.VectorOperator, error) {
+	return nil, nil
+}
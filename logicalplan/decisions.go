@@ -0,0 +1,121 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/util/annotations"
+
+	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/query"
+)
+
+// Reasons for selecting or excluding remote engines.
+const (
+	EngineSelected          = "engine selected"
+	EngineStartAdjusted     = "engine selected with the start time adjusted to the engine time range"
+	EngineAfterQueryEnd     = "engine min time is after the end of the query"
+	EngineBeforeQueryStart  = "engine max time is before the start of the query"
+	EngineLabelsNotMatching = "engine label sets do not match the query"
+	EngineInsufficientRange = "engine time range does not cover the lookback of the instant query"
+	EngineOffsetTooLarge    = "query lookback exceeds the overlap between engines"
+	EngineMultipleMatching  = "multiple engines match the query"
+	EngineAbsentFallback    = "no engine matches the query, absent is evaluated against the latest engine"
+)
+
+// EngineDecision describes why a remote engine was selected for or excluded
+// from executing a query when distributing the logical plan.
+type EngineDecision struct {
+	// Query is the query which was distributed.
+	Query string `json:"query"`
+	// EngineLabelSets, EngineMinT and EngineMaxT identify the remote engine.
+	EngineLabelSets []string `json:"engineLabelSets,omitempty"`
+	EngineMinT      int64    `json:"engineMinT"`
+	EngineMaxT      int64    `json:"engineMaxT"`
+	Selected        bool     `json:"selected"`
+	Reason          string   `json:"reason"`
+	// QueryRangeStart is the start of the query executed by a selected engine.
+	QueryRangeStart time.Time `json:"queryRangeStart,omitempty"`
+	// StartOffset is the lookback of the query which the engine needs to cover.
+	StartOffset time.Duration `json:"startOffset,omitempty"`
+}
+
+func (d EngineDecision) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "engine %s [%d, %d] ", strings.Join(d.EngineLabelSets, ", "), d.EngineMinT, d.EngineMaxT)
+	if d.Selected {
+		sb.WriteString("selected")
+	} else {
+		sb.WriteString("excluded")
+	}
+	fmt.Fprintf(&sb, " for %s: %s", d.Query, d.Reason)
+	if d.Selected {
+		fmt.Fprintf(&sb, " (start=%d, offset=%s)", d.QueryRangeStart.UnixMilli(), d.StartOffset)
+	}
+	return sb.String()
+}
+
+// distributingOptimizer is implemented by optimizers which distribute queries to remote engines
+// and record the decisions they made for each engine in the trace of the plan.
+type distributingOptimizer interface {
+	optimizeAndExplain(plan parser.Expr, opts *query.Options, decisions *engineDecisions) (parser.Expr, annotations.Annotations)
+}
+
+// engineDecisions collects the decisions of a distributing optimizer.
+// Decisions are not recorded when it is nil, which is the case for plans which are not traced.
+type engineDecisions []EngineDecision
+
+func (d *engineDecisions) exclude(query string, e api.RemoteEngine, reason string) {
+	if d == nil {
+		return
+	}
+	*d = append(*d, newEngineDecision(query, e, false, reason))
+}
+
+func (d *engineDecisions) selectEngine(query string, e api.RemoteEngine, opts *query.Options, start time.Time, offset time.Duration) {
+	if d == nil {
+		return
+	}
+	reason := EngineSelected
+	if !start.Equal(opts.Start) {
+		reason = EngineStartAdjusted
+	}
+	decision := newEngineDecision(query, e, true, reason)
+	decision.QueryRangeStart = start
+	decision.StartOffset = offset
+	*d = append(*d, decision)
+}
+
+// selectAbsentFallback records the engine which evaluates absent when no engine matches the query.
+func (d *engineDecisions) selectAbsentFallback(query string, e api.RemoteEngine, start time.Time, offset time.Duration) {
+	if d == nil {
+		return
+	}
+	decision := newEngineDecision(query, e, true, EngineAbsentFallback)
+	decision.QueryRangeStart = start
+	decision.StartOffset = offset
+	*d = append(*d, decision)
+}
+
+func newEngineDecision(query string, e api.RemoteEngine, selected bool, reason string) EngineDecision {
+	lsets := e.LabelSets()
+	decision := EngineDecision{
+		Query:      query,
+		EngineMinT: e.MinT(),
+		EngineMaxT: e.MaxT(),
+		Selected:   selected,
+		Reason:     reason,
+	}
+	if len(lsets) > 0 {
+		decision.EngineLabelSets = make([]string, 0, len(lsets))
+		for _, lset := range lsets {
+			decision.EngineLabelSets = append(decision.EngineLabelSets, lset.String())
+		}
+	}
+	return decision
+}
@@ -0,0 +1,180 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/query"
+)
+
+func TestEngineDecisions(t *testing.T) {
+	var (
+		east     = []labels.Labels{labels.FromStrings("region", "east")}
+		west     = []labels.Labels{labels.FromStrings("region", "west")}
+		hour     = time.Hour.Milliseconds()
+		minute   = time.Minute.Milliseconds()
+		start    = time.UnixMilli(hour)
+		end      = time.UnixMilli(2 * hour)
+		lookback = 5 * time.Minute
+	)
+	engines := []api.RemoteEngine{
+		newEngineMock(0, 2*hour, east),
+		newEngineMock(minute, 10*minute, west),
+		newEngineMock(90*minute, 2*hour, east),
+	}
+
+	cases := []struct {
+		name      string
+		expr      string
+		optimizer Optimizer
+		expected  []EngineDecision
+	}{
+		{
+			name:      "distributed execution",
+			expr:      `sum(X{region="east"})`,
+			optimizer: DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)},
+			expected: []EngineDecision{
+				{
+					Query:           `sum by (region) (X{region="east"})`,
+					EngineLabelSets: []string{`{region="east"}`},
+					EngineMinT:      0,
+					EngineMaxT:      2 * hour,
+					Selected:        true,
+					Reason:          EngineSelected,
+					QueryRangeStart: start,
+					StartOffset:     lookback,
+				},
+				{
+					Query:           `sum by (region) (X{region="east"})`,
+					EngineLabelSets: []string{`{region="west"}`},
+					EngineMinT:      minute,
+					EngineMaxT:      10 * minute,
+					Reason:          EngineLabelsNotMatching,
+				},
+				{
+					Query:           `sum by (region) (X{region="east"})`,
+					EngineLabelSets: []string{`{region="east"}`},
+					EngineMinT:      90 * minute,
+					EngineMaxT:      2 * hour,
+					Selected:        true,
+					Reason:          EngineStartAdjusted,
+					QueryRangeStart: time.UnixMilli(95 * minute),
+					StartOffset:     lookback,
+				},
+			},
+		},
+		{
+			name:      "engine outside of the query range",
+			expr:      `sum(X{region="west"})`,
+			optimizer: DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)},
+			expected: []EngineDecision{
+				{
+					Query:           `sum by (region) (X{region="west"})`,
+					EngineLabelSets: []string{`{region="east"}`},
+					EngineMinT:      0,
+					EngineMaxT:      2 * hour,
+					Reason:          EngineLabelsNotMatching,
+				},
+				{
+					Query:           `sum by (region) (X{region="west"})`,
+					EngineLabelSets: []string{`{region="west"}`},
+					EngineMinT:      minute,
+					EngineMaxT:      10 * minute,
+					Reason:          EngineBeforeQueryStart,
+				},
+				{
+					Query:           `sum by (region) (X{region="west"})`,
+					EngineLabelSets: []string{`{region="east"}`},
+					EngineMinT:      90 * minute,
+					EngineMaxT:      2 * hour,
+					Reason:          EngineLabelsNotMatching,
+				},
+			},
+		},
+		{
+			name:      "passthrough",
+			expr:      `X{region="west"}`,
+			optimizer: PassthroughOptimizer{Endpoints: api.NewStaticEndpoints(engines[:2])},
+			expected: []EngineDecision{
+				{
+					Query:           `X{region="west"}`,
+					EngineLabelSets: []string{`{region="east"}`},
+					EngineMinT:      0,
+					EngineMaxT:      2 * hour,
+					Reason:          EngineLabelsNotMatching,
+				},
+				{
+					Query:           `X{region="west"}`,
+					EngineLabelSets: []string{`{region="west"}`},
+					EngineMinT:      minute,
+					EngineMaxT:      10 * minute,
+					Reason:          EngineBeforeQueryStart,
+				},
+			},
+		},
+		{
+			name:      "passthrough with multiple matching engines",
+			expr:      `X`,
+			optimizer: PassthroughOptimizer{Endpoints: api.NewStaticEndpoints(engines[:2])},
+			expected: []EngineDecision{
+				{
+					Query:           `X`,
+					EngineLabelSets: []string{`{region="east"}`},
+					EngineMinT:      0,
+					EngineMaxT:      2 * hour,
+					Reason:          EngineMultipleMatching,
+				},
+				{
+					Query:           `X`,
+					EngineLabelSets: []string{`{region="west"}`},
+					EngineMinT:      minute,
+					EngineMaxT:      10 * minute,
+					Reason:          EngineMultipleMatching,
+				},
+			},
+		},
+		{
+			name:      "passthrough with repeated selector",
+			expr:      `X{region="east"} + X{region="east"}`,
+			optimizer: PassthroughOptimizer{Endpoints: api.NewStaticEndpoints(engines[:2])},
+			expected: []EngineDecision{
+				{
+					Query:           `X{region="east"} + X{region="east"}`,
+					EngineLabelSets: []string{`{region="east"}`},
+					EngineMinT:      0,
+					EngineMaxT:      2 * hour,
+					Selected:        true,
+					Reason:          EngineSelected,
+					QueryRangeStart: start,
+				},
+				{
+					Query:           `X{region="east"} + X{region="east"}`,
+					EngineLabelSets: []string{`{region="west"}`},
+					EngineMinT:      minute,
+					EngineMaxT:      10 * minute,
+					Reason:          EngineLabelsNotMatching,
+				},
+			},
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			opts := &query.Options{Start: start, End: end, Step: time.Minute, LookbackDelta: lookback}
+			plan, _ := NewTraced(expr, opts).Optimize([]Optimizer{tcase.optimizer})
+			trace := plan.(TracedPlan).Trace()
+			testutil.Equals(t, 1, len(trace))
+			testutil.Equals(t, tcase.expected, trace[0].EngineDecisions)
+		})
+	}
+}
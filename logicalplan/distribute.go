@@ -83,6 +83,9 @@ type RemoteExecution struct {
 	Engine          api.RemoteEngine
 	Query           string
 	QueryRangeStart time.Time
+	// Plan is the logical plan of the Query. It is sent instead of the Query
+	// to engines which can execute plans.
+	Plan parser.Expr
 
 	valueType parser.ValueType
 }
@@ -133,6 +136,9 @@ func (r Noop) PromQLExpr() {}
 
 // distributiveAggregations are all PromQL aggregations which support
 // distributed execution.
+// Results of count_values cannot be deduplicated across engines with overlapping
+// time ranges since its output series depend on sample values, so only its operand
+// is distributed and values are counted locally.
 var distributiveAggregations = map[parser.ItemType]struct{}{
 	parser.SUM:     {},
 	parser.MIN:     {},
@@ -151,6 +157,10 @@ type DistributedExecutionOptimizer struct {
 }
 
 func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr, opts *query.Options) (parser.Expr, annotations.Annotations) {
+	return m.optimizeAndExplain(plan, opts, nil)
+}
+
+func (m DistributedExecutionOptimizer) optimizeAndExplain(plan parser.Expr, opts *query.Options, decisions *engineDecisions) (parser.Expr, annotations.Annotations) {
 	engines := m.Endpoints.Engines()
 	sort.Slice(engines, func(i, j int) bool {
 		return engines[i].MinT() < engines[j].MinT()
@@ -190,7 +200,7 @@ func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr, opts *query.Op
 			}
 
 			remoteAggregation := newRemoteAggregation(aggr, engines)
-			subQueries := m.distributeQuery(&remoteAggregation, engines, opts, minEngineOverlap)
+			subQueries := m.distributeQuery(&remoteAggregation, engines, opts, minEngineOverlap, decisions)
 			*current = &parser.AggregateExpr{
 				Op:       localAggregation,
 				Expr:     subQueries,
@@ -202,7 +212,7 @@ func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr, opts *query.Op
 			return true
 		}
 		if isAbsent(*current) {
-			*current = m.distributeAbsent(*current, engines, calculateStartOffset(current, opts.LookbackDelta), opts)
+			*current = m.distributeAbsent(*current, engines, calculateStartOffset(current, opts.LookbackDelta), opts, decisions)
 			return true
 		}
 
@@ -211,7 +221,7 @@ func (m DistributedExecutionOptimizer) Optimize(plan parser.Expr, opts *query.Op
 			return false
 		}
 
-		*current = m.distributeQuery(current, engines, opts, minEngineOverlap)
+		*current = m.distributeQuery(current, engines, opts, minEngineOverlap, decisions)
 		return true
 	})
 
@@ -250,9 +260,14 @@ func newRemoteAggregation(rootAggregation *parser.AggregateExpr, engines []api.R
 // distributeQuery takes a PromQL expression in the form of *parser.Expr and a set of remote engines.
 // For each engine which matches the time range of the query, it creates a RemoteExecution scoped to the range of the engine.
 // All remote executions are wrapped in a Deduplicate logical node to make sure that results from overlapping engines are deduplicated.
-func (m DistributedExecutionOptimizer) distributeQuery(expr *parser.Expr, engines []api.RemoteEngine, opts *query.Options, allowedStartOffset time.Duration) parser.Expr {
+// The reason each engine was selected or excluded is added to decisions.
+func (m DistributedExecutionOptimizer) distributeQuery(expr *parser.Expr, engines []api.RemoteEngine, opts *query.Options, allowedStartOffset time.Duration, decisions *engineDecisions) parser.Expr {
+	qs := (*expr).String()
 	startOffset := calculateStartOffset(expr, opts.LookbackDelta)
 	if allowedStartOffset < startOffset {
+		for _, e := range engines {
+			decisions.exclude(qs, e, EngineOffsetTooLarge)
+		}
 		return *expr
 	}
 
@@ -266,24 +281,30 @@ func (m DistributedExecutionOptimizer) distributeQuery(expr *parser.Expr, engine
 	remoteQueries := make(RemoteExecutions, 0, len(engines))
 	for _, e := range engines {
 		if !matchesExternalLabelSet(*expr, e.LabelSets()) {
+			decisions.exclude(qs, e, EngineLabelsNotMatching)
 			continue
 		}
 		if e.MinT() > opts.End.UnixMilli() {
+			decisions.exclude(qs, e, EngineAfterQueryEnd)
 			continue
 		}
 		if e.MaxT() < opts.Start.UnixMilli()-startOffset.Milliseconds() {
+			decisions.exclude(qs, e, EngineBeforeQueryStart)
 			continue
 		}
 
 		start, keep := getStartTimeForEngine(e, opts, startOffset, globalMinT)
 		if !keep {
+			decisions.exclude(qs, e, EngineInsufficientRange)
 			continue
 		}
 
+		decisions.selectEngine(qs, e, opts, start, startOffset)
 		remoteQueries = append(remoteQueries, RemoteExecution{
 			Engine:          e,
-			Query:           (*expr).String(),
+			Query:           qs,
 			QueryRangeStart: start,
+			Plan:            *expr,
 			valueType:       (*expr).Type(),
 		})
 	}
@@ -297,19 +318,24 @@ func (m DistributedExecutionOptimizer) distributeQuery(expr *parser.Expr, engine
 	}
 }
 
-func (m DistributedExecutionOptimizer) distributeAbsent(expr parser.Expr, engines []api.RemoteEngine, startOffset time.Duration, opts *query.Options) parser.Expr {
+func (m DistributedExecutionOptimizer) distributeAbsent(expr parser.Expr, engines []api.RemoteEngine, startOffset time.Duration, opts *query.Options, decisions *engineDecisions) parser.Expr {
+	qs := expr.String()
 	queries := make(RemoteExecutions, 0, len(engines))
 	for i, e := range engines {
 		if e.MaxT() < opts.Start.UnixMilli()-startOffset.Milliseconds() {
+			decisions.exclude(qs, e, EngineBeforeQueryStart)
 			continue
 		}
 		if e.MinT() > opts.End.UnixMilli() {
+			decisions.exclude(qs, e, EngineAfterQueryEnd)
 			continue
 		}
+		decisions.selectEngine(qs, e, opts, opts.Start, startOffset)
 		queries = append(queries, RemoteExecution{
 			Engine:          engines[i],
-			Query:           expr.String(),
+			Query:           qs,
 			QueryRangeStart: opts.Start,
+			Plan:            expr,
 			valueType:       expr.Type(),
 		})
 	}
@@ -318,10 +344,12 @@ func (m DistributedExecutionOptimizer) distributeAbsent(expr parser.Expr, engine
 	// For practicality, we choose the latest one since it likely has data in memory or on disk.
 	// TODO(fpetkovski): This could also solved by a synthetic node which acts as a number literal but has specific labels.
 	if len(queries) == 0 && len(engines) > 0 {
+		decisions.selectAbsentFallback(qs, engines[len(engines)-1], opts.Start, startOffset)
 		return RemoteExecution{
 			Engine:          engines[len(engines)-1],
-			Query:           expr.String(),
+			Query:           qs,
 			QueryRangeStart: opts.Start,
+			Plan:            expr,
 			valueType:       expr.Type(),
 		}
 	}
@@ -159,6 +159,17 @@ max by (pod) (quantile(0.9,
     remote(http_requests_total)
   )
 ))`,
+		},
+		{
+			name: "count_values is executed locally",
+			expr: `count_values by (pod) ("value", http_requests_total)`,
+			expected: `
+count_values by (pod) ("value",
+  dedup(
+    remote(http_requests_total),
+    remote(http_requests_total)
+  )
+)`,
 		},
 		{
 			name: "label replace",
@@ -22,13 +22,18 @@ type VectorSelector struct {
 }
 
 func (f VectorSelector) String() string {
+	return f.format(f.VectorSelector.String())
+}
+
+// format decorates the given rendering of the selector with filters and the batch size.
+func (f VectorSelector) format(selector string) string {
 	if f.BatchSize != 0 && len(f.Filters) != 0 {
-		return fmt.Sprintf("filter(%s, %s[batch=%d])", f.Filters, f.VectorSelector.String(), f.BatchSize)
+		return fmt.Sprintf("filter(%s, %s[batch=%d])", f.Filters, selector, f.BatchSize)
 	}
 	if f.BatchSize != 0 {
-		return fmt.Sprintf("%s[batch=%d]", f.VectorSelector.String(), f.BatchSize)
+		return fmt.Sprintf("%s[batch=%d]", selector, f.BatchSize)
 	}
-	return fmt.Sprintf("filter(%s, %s)", f.Filters, f.VectorSelector.String())
+	return fmt.Sprintf("filter(%s, %s)", f.Filters, selector)
 }
 
 func (f VectorSelector) Pretty(level int) string { return f.String() }
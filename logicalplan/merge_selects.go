@@ -92,8 +92,10 @@ func replaceMatchers(selectors matcherHeap, expr *parser.Expr) {
 					Filters:        filters,
 				}
 			case *VectorSelector:
+				// Keep the filters of selectors which were already merged,
+				// for example in plans optimized by a remote engine.
 				e.LabelMatchers = replacement
-				e.Filters = filters
+				e.Filters = append(filters, e.Filters...)
 			}
 
 			return
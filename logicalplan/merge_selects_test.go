@@ -51,3 +51,28 @@ func TestMergeSelects(t *testing.T) {
 		})
 	}
 }
+
+func TestMergeSelectsDecodedPlan(t *testing.T) {
+	expr, err := parser.ParseExpr(`X{a="b", c="d"} / X{c="d"}`)
+	testutil.Ok(t, err)
+	optimizedPlan, _ := New(expr, &query.Options{}).Optimize(DefaultOptimizers)
+	testutil.Equals(t, `filter([a="b"], X{c="d"}) / X{c="d"}`, optimizedPlan.Expr().String())
+
+	data, err := Marshal(optimizedPlan.Expr())
+	testutil.Ok(t, err)
+	decoded, err := Unmarshal(data)
+	testutil.Ok(t, err)
+
+	// Optimizing the decoded plan again does not change it.
+	reoptimized, _ := New(decoded, &query.Options{}).Optimize(DefaultOptimizers)
+	testutil.Equals(t, optimizedPlan.Expr().String(), reoptimized.Expr().String())
+
+	// Filters of merged selectors are kept when they are merged with a less selective selector.
+	decoded, err = Unmarshal(data)
+	testutil.Ok(t, err)
+	rhs, err := parser.ParseExpr(`X`)
+	testutil.Ok(t, err)
+	combined := &parser.BinaryExpr{Op: parser.ADD, LHS: decoded, RHS: rhs}
+	reoptimized, _ = New(combined, &query.Options{}).Optimize(DefaultOptimizers)
+	testutil.Equals(t, `filter([c="d" a="b"], X) / filter([c="d"], X) + X`, reoptimized.Expr().String())
+}
@@ -40,20 +40,37 @@ func labelSetsMatch(matchers []*labels.Matcher, lset ...labels.Labels) bool {
 	return false
 }
 
-func matchingEngineTime(e api.RemoteEngine, opts *query.Options) bool {
-	return !(opts.Start.UnixMilli() > e.MaxT() || opts.End.UnixMilli() < e.MinT())
+// engineTimeMismatch returns the reason why the time range of the engine does not
+// overlap with the query, or an empty string if it does.
+func engineTimeMismatch(e api.RemoteEngine, opts *query.Options) string {
+	if opts.Start.UnixMilli() > e.MaxT() {
+		return EngineBeforeQueryStart
+	}
+	if opts.End.UnixMilli() < e.MinT() {
+		return EngineAfterQueryEnd
+	}
+	return ""
 }
 
 func (m PassthroughOptimizer) Optimize(plan parser.Expr, opts *query.Options) (parser.Expr, annotations.Annotations) {
+	return m.optimizeAndExplain(plan, opts, nil)
+}
+
+func (m PassthroughOptimizer) optimizeAndExplain(plan parser.Expr, opts *query.Options, decisions *engineDecisions) (parser.Expr, annotations.Annotations) {
 	engines := m.Endpoints.Engines()
 	if len(engines) == 1 {
-		if !matchingEngineTime(engines[0], opts) {
+		qs := plan.String()
+		if reason := engineTimeMismatch(engines[0], opts); reason != "" {
+			decisions.exclude(qs, engines[0], reason)
 			return plan, nil
 		}
+		decisions.selectEngine(qs, engines[0], opts, opts.Start, 0)
 		return RemoteExecution{
 			Engine:          engines[0],
-			Query:           plan.String(),
+			Query:           qs,
 			QueryRangeStart: opts.Start,
+			Plan:            plan,
+			valueType:       plan.Type(),
 		}, nil
 	}
 
@@ -61,25 +78,51 @@ func (m PassthroughOptimizer) Optimize(plan parser.Expr, opts *query.Options) (p
 		return plan, nil
 	}
 
-	matchingLabelsEngines := make([]api.RemoteEngine, 0, len(engines))
+	matched := make([]bool, len(engines))
 	TraverseBottomUp(nil, &plan, func(parent, current *parser.Expr) (stop bool) {
 		if vs, ok := (*current).(*parser.VectorSelector); ok {
-			for _, e := range engines {
-				if !labelSetsMatch(vs.LabelMatchers, e.LabelSets()...) {
-					continue
+			for i, e := range engines {
+				if labelSetsMatch(vs.LabelMatchers, e.LabelSets()...) {
+					matched[i] = true
 				}
-
-				matchingLabelsEngines = append(matchingLabelsEngines, e)
 			}
 		}
 		return false
 	})
+	// Engines are counted once even if they match several selectors of the query.
+	matchingLabelsEngines := make([]api.RemoteEngine, 0, len(engines))
+	for i, e := range engines {
+		if matched[i] {
+			matchingLabelsEngines = append(matchingLabelsEngines, e)
+		}
+	}
+
+	if decisions != nil {
+		qs := plan.String()
+		for i, e := range engines {
+			if !matched[i] {
+				decisions.exclude(qs, e, EngineLabelsNotMatching)
+				continue
+			}
+			if len(matchingLabelsEngines) > 1 {
+				decisions.exclude(qs, e, EngineMultipleMatching)
+				continue
+			}
+			if reason := engineTimeMismatch(e, opts); reason != "" {
+				decisions.exclude(qs, e, reason)
+				continue
+			}
+			decisions.selectEngine(qs, e, opts, opts.Start, 0)
+		}
+	}
 
-	if len(matchingLabelsEngines) == 1 && matchingEngineTime(matchingLabelsEngines[0], opts) {
+	if len(matchingLabelsEngines) == 1 && engineTimeMismatch(matchingLabelsEngines[0], opts) == "" {
 		return RemoteExecution{
 			Engine:          matchingLabelsEngines[0],
 			Query:           plan.String(),
 			QueryRangeStart: opts.Start,
+			Plan:            plan,
+			valueType:       plan.Type(),
 		}, nil
 	}
 
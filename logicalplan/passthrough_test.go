@@ -74,6 +74,22 @@ func TestPassthrough(t *testing.T) {
 		testutil.Equals(t, `remote({region="east"})`, optimizedPlan.Expr().String())
 	})
 
+	t.Run("optimized with repeated selector matching one engine", func(t *testing.T) {
+		selectorExpr, err := parser.ParseExpr(`{region="east"} + {region="east"}`)
+		testutil.Ok(t, err)
+
+		engines := []api.RemoteEngine{
+			newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+			newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+		}
+		optimizers := []Optimizer{PassthroughOptimizer{Endpoints: api.NewStaticEndpoints(engines)}}
+
+		plan := New(selectorExpr, &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)})
+		optimizedPlan, _ := plan.Optimize(optimizers)
+
+		testutil.Equals(t, `remote({region="east"} + {region="east"})`, optimizedPlan.Expr().String())
+	})
+
 	t.Run("not optimized due to multiple engines", func(t *testing.T) {
 		selectorExpr, err := parser.ParseExpr(`{region=~"east|west"}`)
 		testutil.Ok(t, err)
@@ -8,7 +8,6 @@ import (
 	"math"
 	"time"
 
-	"github.com/efficientgo/core/errors"
 	"github.com/prometheus/prometheus/model/timestamp"
 	"github.com/prometheus/prometheus/promql"
 	"github.com/prometheus/prometheus/util/annotations"
@@ -33,6 +32,14 @@ type Plan interface {
 	Expr() parser.Expr
 }
 
+// TracedPlan is a plan which records how each optimizer changed it.
+// Plans created with NewTraced implement it.
+type TracedPlan interface {
+	Plan
+	// Trace returns how each optimizer applied to the plan changed it.
+	Trace() []OptimizerTrace
+}
+
 type Optimizer interface {
 	Optimize(plan parser.Expr, opts *query.Options) (parser.Expr, annotations.Annotations)
 }
@@ -43,6 +50,17 @@ type plan struct {
 }
 
 func New(expr parser.Expr, opts *query.Options) Plan {
+	return newPlan(expr, opts)
+}
+
+// NewTraced creates a plan which records how each optimizer changed it. Tracing renders
+// the whole plan before and after each optimizer, so it should only be used when the
+// trace is going to be inspected, for example when explaining a query.
+func NewTraced(expr parser.Expr, opts *query.Options) TracedPlan {
+	return &tracedPlan{plan: *newPlan(expr, opts)}
+}
+
+func newPlan(expr parser.Expr, opts *query.Options) *plan {
 	expr = preprocessExpr(expr, opts.Start, opts.End)
 	setOffsetForAtModifier(opts.Start.UnixMilli(), expr)
 	setOffsetForInnerSubqueries(expr, opts)
@@ -269,6 +287,12 @@ func preprocessExprHelper(expr parser.Expr, start, end time.Time) bool {
 		// strings should be used as fixed strings; no need
 		// to wrap under stepInvariantExpr
 		return false
+
+	// Nodes of logical plans can be part of decoded plans.
+	case *VectorSelector:
+		return preprocessExprHelper(n.VectorSelector, start, end)
+	case RemoteExecution, Deduplicate, Noop, UserDefinedExpr:
+		return false
 	}
 
 	panic(fmt.Sprintf("found unexpected node %#v", expr))
@@ -300,19 +324,20 @@ func setOffsetForAtModifier(evalTime int64, expr parser.Expr) {
 		return originalOffset + offsetDiff
 	}
 
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+	inspect(expr, nil, func(node parser.Node, path []parser.Node) bool {
 		switch n := node.(type) {
 		case *parser.VectorSelector:
 			n.Offset = getOffset(n.Timestamp, n.OriginalOffset, path)
 
 		case *parser.MatrixSelector:
-			vs := n.VectorSelector.(*parser.VectorSelector)
-			vs.Offset = getOffset(vs.Timestamp, vs.OriginalOffset, path)
+			if vs, ok := n.VectorSelector.(*parser.VectorSelector); ok {
+				vs.Offset = getOffset(vs.Timestamp, vs.OriginalOffset, path)
+			}
 
 		case *parser.SubqueryExpr:
 			n.Offset = getOffset(n.Timestamp, n.OriginalOffset, path)
 		}
-		return nil
+		return true
 	})
 }
 
@@ -347,14 +372,44 @@ func subqueryTimes(path []parser.Node) (time.Duration, time.Duration, *int64) {
 }
 
 func setOffsetForInnerSubqueries(expr parser.Expr, opts *query.Options) {
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+	// The traversal stops at the first subquery.
+	var stop bool
+	inspect(expr, nil, func(node parser.Node, path []parser.Node) bool {
+		if stop {
+			return false
+		}
 		switch n := node.(type) {
 		case *parser.SubqueryExpr:
 			nOpts := query.NestedOptionsForSubquery(opts, n)
 			setOffsetForAtModifier(nOpts.Start.UnixMilli(), n.Expr)
 			setOffsetForInnerSubqueries(n.Expr, nOpts)
-			return errors.New("stop iteration")
+			stop = true
+			return false
 		}
-		return nil
+		return true
 	})
 }
+
+// inspect traverses the expression in depth-first order like parser.Inspect, but it also
+// supports the nodes of logical plans. Children of a node are only visited if f returns true.
+func inspect(node parser.Node, path []parser.Node, f func(node parser.Node, path []parser.Node) bool) {
+	if !f(node, path) {
+		return
+	}
+	path = append(path, node)
+	for _, child := range children(node) {
+		inspect(child, path, f)
+	}
+}
+
+func children(node parser.Node) []parser.Node {
+	switch n := node.(type) {
+	case *VectorSelector:
+		return []parser.Node{n.VectorSelector}
+	case RemoteExecution, Deduplicate, Noop, UserDefinedExpr:
+		// Remote executions are evaluated by their engines and user defined
+		// expressions by their own operators.
+		return nil
+	}
+	return parser.Children(node)
+}
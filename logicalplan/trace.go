@@ -0,0 +1,188 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// OptimizerTrace describes how a single optimizer changed the logical plan.
+type OptimizerTrace struct {
+	// Optimizer is the type name of the optimizer.
+	Optimizer string `json:"optimizer"`
+	// Before and After are the logical plan before and after the optimizer ran.
+	Before string `json:"before"`
+	After  string `json:"after"`
+	// Rewrites are the nodes of the plan changed by the optimizer.
+	// It is empty when the optimizer did not change the plan.
+	Rewrites []Rewrite `json:"rewrites,omitempty"`
+	// Annotations are the warnings and infos returned by the optimizer.
+	Annotations []string `json:"annotations,omitempty"`
+	// EngineDecisions describe which remote engines were selected or excluded
+	// by optimizers which distribute queries.
+	EngineDecisions []EngineDecision `json:"engineDecisions,omitempty"`
+}
+
+// tracedPlan is a plan which records a trace of the optimizers applied to it.
+type tracedPlan struct {
+	plan
+	trace []OptimizerTrace
+}
+
+func (p *tracedPlan) Optimize(optimizers []Optimizer) (Plan, annotations.Annotations) {
+	annos := annotations.New()
+	trace := append([]OptimizerTrace{}, p.trace...)
+	for _, o := range optimizers {
+		var a annotations.Annotations
+		before := snapshot(p.expr)
+		var decisions engineDecisions
+		if d, ok := o.(distributingOptimizer); ok {
+			p.expr, a = d.optimizeAndExplain(p.expr, p.opts, &decisions)
+		} else {
+			p.expr, a = o.Optimize(p.expr, p.opts)
+		}
+		annos.Merge(a)
+		t := newOptimizerTrace(o, before, snapshot(p.expr), a)
+		t.EngineDecisions = decisions
+		trace = append(trace, t)
+	}
+
+	return &tracedPlan{plan: plan{expr: p.expr, opts: p.opts}, trace: trace}, *annos
+}
+
+func (p *tracedPlan) Trace() []OptimizerTrace {
+	return p.trace
+}
+
+// Rewrite is a node of the logical plan which was replaced or modified by an optimizer.
+type Rewrite struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// planNode is a snapshot of a node of the logical plan. Optimizers modify the plan
+// in place, so nodes have to be rendered before the optimizer runs in order to be
+// compared with the result.
+type planNode struct {
+	expr     string
+	typ      string
+	children []planNode
+}
+
+// snapshot renders the plan bottom up. Nodes are rendered from the already rendered
+// strings of their children, which also allows rendering matrix selectors with
+// selectors modified by optimizers.
+func snapshot(expr parser.Expr) planNode {
+	node := planNode{typ: fmt.Sprintf("%T", expr)}
+	render := func(e parser.Expr) parser.Expr {
+		child := snapshot(e)
+		node.children = append(node.children, child)
+		return renderedExpr{Expr: e, str: child.expr}
+	}
+
+	switch e := expr.(type) {
+	case *parser.AggregateExpr:
+		c := *e
+		c.Expr = render(e.Expr)
+		if e.Param != nil {
+			c.Param = render(e.Param)
+		}
+		node.expr = c.String()
+	case *parser.BinaryExpr:
+		c := *e
+		c.LHS = render(e.LHS)
+		c.RHS = render(e.RHS)
+		node.expr = c.String()
+	case *parser.Call:
+		c := *e
+		c.Args = make(parser.Expressions, 0, len(e.Args))
+		for _, arg := range e.Args {
+			c.Args = append(c.Args, render(arg))
+		}
+		node.expr = c.String()
+	case *parser.ParenExpr:
+		c := *e
+		c.Expr = render(e.Expr)
+		node.expr = c.String()
+	case *parser.UnaryExpr:
+		c := *e
+		c.Expr = render(e.Expr)
+		node.expr = c.String()
+	case *parser.SubqueryExpr:
+		c := *e
+		c.Expr = render(e.Expr)
+		node.expr = c.String()
+	case *parser.StepInvariantExpr:
+		c := *e
+		c.Expr = render(e.Expr)
+		node.expr = c.String()
+	case *parser.MatrixSelector:
+		node.children = append(node.children, snapshot(e.VectorSelector))
+		vs, ok := e.VectorSelector.(*VectorSelector)
+		if !ok {
+			node.expr = e.String()
+			break
+		}
+		c := *e
+		c.VectorSelector = vs.VectorSelector
+		node.expr = vs.format(c.String())
+	case Deduplicate:
+		for _, r := range e.Expressions {
+			render(r)
+		}
+		node.expr = e.String()
+	default:
+		node.expr = expr.String()
+	}
+	return node
+}
+
+// renderedExpr is an expression with a precomputed string representation.
+type renderedExpr struct {
+	parser.Expr
+	str string
+}
+
+func (r renderedExpr) String() string { return r.str }
+
+// rewrites returns the outermost nodes which differ between two snapshots of the same plan.
+// A node is reported as rewritten when it was replaced by a node of another type or
+// when its own attributes changed while all of its children remained the same.
+func rewrites(before, after planNode) []Rewrite {
+	if before.expr == after.expr && before.typ == after.typ {
+		return nil
+	}
+	changed := Rewrite{Before: before.expr, After: after.expr}
+	if before.typ != after.typ || len(before.children) != len(after.children) {
+		return []Rewrite{changed}
+	}
+
+	var result []Rewrite
+	for i := range before.children {
+		result = append(result, rewrites(before.children[i], after.children[i])...)
+	}
+	if len(result) == 0 {
+		return []Rewrite{changed}
+	}
+	return result
+}
+
+func newOptimizerTrace(o Optimizer, before, after planNode, annos annotations.Annotations) OptimizerTrace {
+	trace := OptimizerTrace{
+		Optimizer: strings.TrimPrefix(fmt.Sprintf("%T", o), "*"),
+		Before:    before.expr,
+		After:     after.expr,
+		Rewrites:  rewrites(before, after),
+	}
+	if len(annos) > 0 {
+		trace.Annotations = annos.AsStrings("", 0)
+		sort.Strings(trace.Annotations)
+	}
+	return trace
+}
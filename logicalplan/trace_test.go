@@ -0,0 +1,146 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package logicalplan
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-io/promql-engine/api"
+	"github.com/thanos-io/promql-engine/query"
+)
+
+func TestOptimizerTrace(t *testing.T) {
+	engines := []api.RemoteEngine{
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "east")}),
+		newEngineMock(math.MinInt64, math.MaxInt64, []labels.Labels{labels.FromStrings("region", "west")}),
+	}
+	cases := []struct {
+		name       string
+		expr       string
+		optimizers []Optimizer
+		expected   []OptimizerTrace
+	}{
+		{
+			name:       "no optimizers",
+			expr:       `X`,
+			optimizers: NoOptimizers,
+			expected:   []OptimizerTrace{},
+		},
+		{
+			name:       "default optimizers",
+			expr:       `X{a="b", b="c"} / X`,
+			optimizers: DefaultOptimizers,
+			expected: []OptimizerTrace{
+				{
+					Optimizer: "logicalplan.SortMatchers",
+					Before:    `X{a="b",b="c"} / X`,
+					After:     `X{a="b",b="c"} / X`,
+				},
+				{
+					Optimizer: "logicalplan.MergeSelectsOptimizer",
+					Before:    `X{a="b",b="c"} / X`,
+					After:     `filter([a="b" b="c"], X) / X`,
+					Rewrites:  []Rewrite{{Before: `X{a="b",b="c"}`, After: `filter([a="b" b="c"], X)`}},
+				},
+			},
+		},
+		{
+			name:       "optimizer does not change the plan",
+			expr:       `sum(X)`,
+			optimizers: []Optimizer{MergeSelectsOptimizer{}},
+			expected: []OptimizerTrace{
+				{
+					Optimizer: "logicalplan.MergeSelectsOptimizer",
+					Before:    `sum(X)`,
+					After:     `sum(X)`,
+				},
+			},
+		},
+		{
+			name:       "matrix selector with batch size",
+			expr:       `sum(rate(X[5m]))`,
+			optimizers: []Optimizer{SelectorBatchSize{Size: 10}},
+			expected: []OptimizerTrace{
+				{
+					Optimizer: "logicalplan.SelectorBatchSize",
+					Before:    `sum(rate(X[5m]))`,
+					After:     `sum(rate(X[5m][batch=10]))`,
+					Rewrites:  []Rewrite{{Before: `X`, After: `X[batch=10]`}},
+				},
+			},
+		},
+		{
+			name:       "distributed execution",
+			expr:       `sum by (pod) (X)`,
+			optimizers: []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}},
+			expected: []OptimizerTrace{
+				{
+					Optimizer: "logicalplan.DistributedExecutionOptimizer",
+					Before:    `sum by (pod) (X)`,
+					After:     `sum by (pod) (dedup(remote(sum by (pod, region) (X)), remote(sum by (pod, region) (X))))`,
+					Rewrites: []Rewrite{{
+						Before: `X`,
+						After:  `dedup(remote(sum by (pod, region) (X)), remote(sum by (pod, region) (X)))`,
+					}},
+					EngineDecisions: []EngineDecision{
+						{
+							Query:           `sum by (pod, region) (X)`,
+							EngineLabelSets: []string{`{region="east"}`},
+							EngineMinT:      math.MinInt64,
+							EngineMaxT:      math.MaxInt64,
+							Selected:        true,
+							Reason:          EngineSelected,
+							QueryRangeStart: time.Unix(0, 0),
+						},
+						{
+							Query:           `sum by (pod, region) (X)`,
+							EngineLabelSets: []string{`{region="west"}`},
+							EngineMinT:      math.MinInt64,
+							EngineMaxT:      math.MaxInt64,
+							Selected:        true,
+							Reason:          EngineSelected,
+							QueryRangeStart: time.Unix(0, 0),
+						},
+					},
+				},
+			},
+		},
+		{
+			name:       "distributed execution with annotations",
+			expr:       `max by (location) (label_replace(X, "region", "$1", "instance", "(.*)"))`,
+			optimizers: []Optimizer{DistributedExecutionOptimizer{Endpoints: api.NewStaticEndpoints(engines)}},
+			expected: []OptimizerTrace{
+				{
+					Optimizer:   "logicalplan.DistributedExecutionOptimizer",
+					Before:      `max by (location) (label_replace(X, "region", "$1", "instance", "(.*)"))`,
+					After:       `max by (location) (label_replace(X, "region", "$1", "instance", "(.*)"))`,
+					Annotations: []string{RewrittenExternalLabelWarning.Error()},
+				},
+			},
+		},
+	}
+	for _, tcase := range cases {
+		t.Run(tcase.name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+
+			opts := &query.Options{Start: time.Unix(0, 0), End: time.Unix(0, 0)}
+			optimizedPlan, _ := NewTraced(expr, opts).Optimize(tcase.optimizers)
+			testutil.Equals(t, tcase.expected, optimizedPlan.(TracedPlan).Trace())
+
+			// Plans are only traced when requested.
+			expr, err = parser.ParseExpr(tcase.expr)
+			testutil.Ok(t, err)
+			optimizedPlan, _ = New(expr, opts).Optimize(tcase.optimizers)
+			_, traced := optimizedPlan.(TracedPlan)
+			testutil.Assert(t, !traced, "plan should not be traced")
+		})
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"time"
 
 	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/thanos-io/promql-engine/execution/limits"
+	"github.com/thanos-io/promql-engine/tracing"
 )
 
 type Options struct {
@@ -21,6 +24,14 @@ type Options struct {
 	NoStepSubqueryIntervalFn func(time.Duration) time.Duration
 	EnableSubqueries         bool
 	EnableAnalysis           bool
+	MemoryTracker            *limits.MemoryTracker
+	SampleTracker            *SampleTracker
+	// Parallelism is used to size the number of shards of each selector and to decide whether
+	// operators are executed concurrently. It is not a limit on the number of goroutines of the
+	// query, which grows with the number of selectors, aggregations and remote executions.
+	Parallelism int
+	// Tracer records spans for the Series and Next calls of operators. Operators are not traced if it is nil.
+	Tracer tracing.Tracer
 }
 
 func (o *Options) NumSteps() int {
@@ -36,6 +47,21 @@ func (o *Options) NumSteps() int {
 	return int(totalSteps)
 }
 
+// NumShards returns the number of shards each selector is split into.
+func (o *Options) NumShards() int {
+	numShards := o.Parallelism / 2
+	if numShards < 1 {
+		return 1
+	}
+	return numShards
+}
+
+// IsConcurrent returns whether selector shards, aggregations and remote executions
+// run in separate goroutines. Each of them starts its own goroutine.
+func (o *Options) IsConcurrent() bool {
+	return o.Parallelism > 1
+}
+
 func (o *Options) IsInstantQuery() bool {
 	return o.NumSteps() == 1
 }
@@ -55,6 +81,10 @@ func NestedOptionsForSubquery(opts *Options, t *parser.SubqueryExpr) *Options {
 		ExtLookbackDelta:         opts.ExtLookbackDelta,
 		NoStepSubqueryIntervalFn: opts.NoStepSubqueryIntervalFn,
 		EnableSubqueries:         opts.EnableSubqueries,
+		MemoryTracker:            opts.MemoryTracker,
+		SampleTracker:            opts.SampleTracker,
+		Parallelism:              opts.Parallelism,
+		Tracer:                   opts.Tracer,
 	}
 	if t.Step != 0 {
 		nOpts.Step = t.Step
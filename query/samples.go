@@ -0,0 +1,96 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package query
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/prometheus/util/stats"
+)
+
+// SampleTracker counts samples loaded by selectors of a query for every step.
+// It is safe for concurrent use. A nil *SampleTracker is valid and tracks nothing.
+type SampleTracker struct {
+	start int64
+	step  int64
+	steps []atomic.Int64
+}
+
+// NewSampleTracker creates a tracker for a query evaluated between start and end with the given step.
+func NewSampleTracker(start, end time.Time, step time.Duration) *SampleTracker {
+	numSteps := 1
+	if step.Milliseconds() > 0 {
+		numSteps = int((end.UnixMilli()-start.UnixMilli())/step.Milliseconds()) + 1
+	}
+	return &SampleTracker{
+		start: start.UnixMilli(),
+		step:  step.Milliseconds(),
+		steps: make([]atomic.Int64, numSteps),
+	}
+}
+
+// AddSamplesAtTimestamp adds samples loaded for the step at timestamp t.
+// Samples loaded for timestamps between steps, for example by subqueries,
+// are accounted for in the next step.
+func (t *SampleTracker) AddSamplesAtTimestamp(ts int64, samples int64) {
+	if t == nil || samples == 0 {
+		return
+	}
+	i := 0
+	if t.step > 0 && ts > t.start {
+		i = int((ts - t.start + t.step - 1) / t.step)
+	}
+	if i >= len(t.steps) {
+		i = len(t.steps) - 1
+	}
+	t.steps[i].Add(samples)
+}
+
+// Total returns the total number of samples loaded by the query.
+func (t *SampleTracker) Total() int64 {
+	if t == nil {
+		return 0
+	}
+	var total int64
+	for i := range t.steps {
+		total += t.steps[i].Load()
+	}
+	return total
+}
+
+// MaxStepSamples returns the highest number of samples loaded for a single step.
+func (t *SampleTracker) MaxStepSamples() int {
+	if t == nil {
+		return 0
+	}
+	var peak int64
+	for i := range t.steps {
+		if s := t.steps[i].Load(); s > peak {
+			peak = s
+		}
+	}
+	return int(peak)
+}
+
+// QuerySamples converts the tracked samples into Prometheus query statistics.
+// PeakSamples is set to the highest number of samples loaded for a single step. This differs
+// from Prometheus, where it is the highest number of samples held in memory at the same time
+// while evaluating the query, which is compared against the MaxSamples limit.
+func (t *SampleTracker) QuerySamples(enablePerStepStats bool) *stats.QuerySamples {
+	samples := stats.NewQuerySamples(enablePerStepStats)
+	if t == nil {
+		return samples
+	}
+	step := t.step
+	if step == 0 {
+		step = 1
+	}
+	samples.InitStepTracking(t.start, t.start+int64(len(t.steps)-1)*step, step)
+	for i := range t.steps {
+		samples.IncrementSamplesAtStep(i, t.steps[i].Load())
+	}
+	samples.UpdatePeak(t.MaxStepSamples())
+	return samples
+}
@@ -0,0 +1,95 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+package tracing
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type recorderKey struct{}
+
+// Recorder is a Tracer which keeps spans in memory. It is meant to be used in tests.
+type Recorder struct {
+	mu     sync.Mutex
+	nextID uint64
+	spans  []*RecordedSpan
+}
+
+// NewRecorder creates an empty Recorder.
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// RecordedSpan is a span started by a Recorder.
+type RecordedSpan struct {
+	ID uint64
+	// ParentID is the ID of the parent span, or zero for root spans.
+	ParentID   uint64
+	Name       string
+	Attributes map[string]any
+	Err        error
+	StartTime  time.Time
+	EndTime    time.Time
+
+	recorder *Recorder
+}
+
+func (r *Recorder) Start(ctx context.Context, name string) (context.Context, Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	span := &RecordedSpan{
+		ID:         r.nextID,
+		Name:       name,
+		Attributes: map[string]any{},
+		StartTime:  time.Now(),
+		recorder:   r,
+	}
+	if parent, ok := ctx.Value(recorderKey{}).(*RecordedSpan); ok && parent.recorder == r {
+		span.ParentID = parent.ID
+	}
+	r.spans = append(r.spans, span)
+	return context.WithValue(ctx, recorderKey{}, span), span
+}
+
+// Spans returns a copy of the finished spans in the order they were started.
+func (r *Recorder) Spans() []RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := make([]RecordedSpan, 0, len(r.spans))
+	for _, s := range r.spans {
+		if s.EndTime.IsZero() {
+			continue
+		}
+		span := *s
+		span.Attributes = make(map[string]any, len(s.Attributes))
+		for k, v := range s.Attributes {
+			span.Attributes[k] = v
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+func (s *RecordedSpan) SetAttribute(key string, value any) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *RecordedSpan) RecordError(err error) {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.Err = err
+}
+
+func (s *RecordedSpan) End() {
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.EndTime = time.Now()
+}
@@ -0,0 +1,27 @@
+// Copyright (c) The Thanos Community Authors.
+// Licensed under the Apache License 2.0.
+
+// Package tracing defines hooks for tracing the execution of queries.
+// The engine does not depend on a tracing library. Instead, users can adapt
+// the library of their choice by implementing the Tracer interface.
+package tracing
+
+import "context"
+
+// Tracer starts spans for the work done by a query.
+type Tracer interface {
+	// Start starts a span with the given name. The span is a child of the span
+	// carried by ctx, if any. The returned context carries the new span and has
+	// to be used for work done on behalf of the span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single unit of work started by a Tracer.
+type Span interface {
+	// SetAttribute attaches a key-value pair to the span.
+	SetAttribute(key string, value any)
+	// RecordError records an error which happened during the span.
+	RecordError(err error)
+	// End finishes the span. It must be called exactly once.
+	End()
+}